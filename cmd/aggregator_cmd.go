@@ -1,12 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/gargath/pleiades/pkg/aggregator"
-	"github.com/gargath/pleiades/pkg/aggregator/file"
-	"github.com/gargath/pleiades/pkg/aggregator/kafka"
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/gargath/pleiades/pkg/transport/kafka"
 	"github.com/gargath/pleiades/pkg/util"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -14,43 +21,265 @@ var (
 		Use:   "aggregate",
 		Short: "Starts Pleiades stats aggregator",
 		Long: `The aggregate command starts the stats aggregation server.
-	It will consume events from kafka and write aggregate stats to redis.`,
+	It will consume events from the configured transport and write aggregate stats to the configured counter store.`,
 		RunE: startAggregator,
 	}
 
-	redis            string
-	redisUseSentinel bool
+	redis               string
+	redisUseSentinel    bool
+	rulesFile           string
+	rulesReloadInterval time.Duration
+	batchSize           int
+	batchInterval       time.Duration
+	replayWindow        time.Duration
+	resolutions         string
+	bucketTTLs          string
+	timeZones           string
+	homeZones           string
+	signalsFile         string
+	sitematrixFile      string
+	allowedLateness     time.Duration
+	latePolicy          string
+	hotPageWindow       time.Duration
+	hotPageMinEdits     int
+	hotPageMaxUsers     int
+	hotPageMinReverts   int
+	hotPageTopic        string
+	anomalyInterval     time.Duration
+	anomalyAlpha        float64
+	anomalyThreshold    float64
+	anomalyMinRate      float64
+	anomalyWebhook      string
+	compactionInterval  time.Duration
+	rollupAfter         time.Duration
+	retention           string
+	storeKind           string
+	storePath           string
 )
 
 func init() { //TODO: Use Sentinels
 	cmdAgg.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server to write aggregated stats to")
 	cmdAgg.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	addAggregatorFlags(cmdAgg.Flags())
+}
+
+// addAggregatorFlags registers the flags configuring how events are aggregated
+func addAggregatorFlags(flags *pflag.FlagSet) {
+	addStoreFlags(flags)
+	flags.StringVar(&rulesFile, "rules", "", "a JSON file defining the counters to aggregate (defaults to the built-in rules)")
+	flags.DurationVar(&rulesReloadInterval, "rules-reload-interval", 10*time.Second, "how often to check the rules file for changes (0 disables reloading)")
+	flags.IntVar(&batchSize, "batch-size", 100, "the maximum number of events to pre-aggregate and write to Redis together")
+	flags.DurationVar(&batchInterval, "batch-interval", 100*time.Millisecond, "the maximum time to hold events before writing a batch to Redis")
+	addBucketFlags(flags)
+	addEnrichmentFlags(flags)
+	flags.DurationVar(&replayWindow, "replay-window", 24*time.Hour, "how long to remember event IDs to avoid counting replayed events twice (0 disables)")
+	flags.DurationVar(&allowedLateness, "allowed-lateness", time.Hour, "how far an event may lag behind the latest event seen before it is late and its day is finalized (0 disables)")
+	flags.StringVar(&latePolicy, "late-policy", aggregator.DefaultLatePolicy, fmt.Sprintf("what to do with late events: one of %s", strings.Join(aggregator.LatePolicies, ", ")))
+	d := aggregator.DefaultHotPageConfig
+	flags.DurationVar(&hotPageWindow, "hot-pages-window", d.Window, "how far back edits to a page are considered to flag hot pages and edit wars (0 disables)")
+	flags.IntVar(&hotPageMinEdits, "hot-pages-min-edits", d.MinEdits, "the number of edits within the window that makes a page hot if made by few users")
+	flags.IntVar(&hotPageMaxUsers, "hot-pages-max-users", d.MaxUsers, "the largest number of distinct users whose edits can make a page hot")
+	flags.IntVar(&hotPageMinReverts, "hot-pages-min-reverts", d.MinReverts, "the number of reverts within the window, alternating between users, that makes an edit war")
+	flags.StringVar(&hotPageTopic, "hot-pages-topic", "", "a kafka topic on the kafka.broker to publish flagged pages to, keyed by page (disabled if empty)")
+	r := aggregator.DefaultRateConfig
+	flags.DurationVar(&anomalyInterval, "anomaly-interval", r.Interval, "the interval event rates are counted in to detect anomalies (0 disables)")
+	flags.Float64Var(&anomalyAlpha, "anomaly-alpha", r.Alpha, "the weight of the latest interval in the baseline rates, between 0 and 1")
+	flags.Float64Var(&anomalyThreshold, "anomaly-threshold", r.Threshold, "the number of standard deviations from its baseline at which a rate is anomalous")
+	flags.Float64Var(&anomalyMinRate, "anomaly-min-rate", r.MinRate, "the number of events per interval below which neither rate nor baseline are anomalous")
+	flags.StringVar(&anomalyWebhook, "anomaly-webhook", "", "a URL to POST new anomalies to as JSON (disabled if empty)")
+	flags.DurationVar(&compactionInterval, "compaction-interval", aggregator.DefaultCompactionConfig.Interval, "how often to roll up and delete old buckets and measure their keys, with the redis store (0 disables)")
+	flags.DurationVar(&rollupAfter, "rollup-after", 0, "how long after it ends to roll a day bucket up into the week and month buckets not kept and delete it (0 disables)")
+	flags.StringVar(&retention, "retention", "", "how long after they end to delete the buckets of each resolution, e.g. day=2160h,week=8760h (others are kept)")
+}
+
+// addBucketFlags registers the flags selecting the time buckets counters are kept in
+func addBucketFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&resolutions, "resolutions", bucket.Day.Name, fmt.Sprintf("the time buckets to keep counters in besides the all-time counters, any of %s", strings.Join(bucket.Names(), ", ")))
+	flags.StringVar(&bucketTTLs, "bucket-ttls", "", fmt.Sprintf("override how long buckets are kept, e.g. minute=24h (defaults: minute=%s, hour=%s, others forever)", bucket.Minute.TTL, bucket.Hour.TTL))
+	flags.StringVar(&timeZones, "time-zones", "UTC", "the IANA time zones day, week and month buckets are aligned to")
+	flags.StringVar(&homeZones, "home-zones", "", "also align buckets to the home time zone of each wiki: builtin, or a JSON file mapping wikis or languages to time zones")
+}
+
+// addEnrichmentFlags registers the flags configuring how events are pseudonymized and enriched and the heuristics of the signal counters
+func addEnrichmentFlags(flags *pflag.FlagSet) {
+	addPrivacyFlag(flags)
+	flags.StringVar(&sitematrixFile, "sitematrix", "", "a MediaWiki sitematrix API response to look up the family and language of wikis in (defaults to the bundled sites)")
+	addSignalsFlag(flags)
+}
+
+// addSignalsFlag registers the flag configuring the heuristics of the signal counters
+func addSignalsFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&signalsFile, "signals", "", "a JSON file configuring the revert, blanking, removal and new user heuristics (defaults to the built-in ones)")
+}
+
+// addStoreFlags registers the flags selecting the counter store
+func addStoreFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&storeKind, "store", aggregator.StoreRedis, fmt.Sprintf("where to keep counters: one of %s", strings.Join(aggregator.StoreKinds, ", ")))
+	flags.StringVar(&storePath, "store-path", "pleiades-data", "the directory the file store keeps counters in")
+}
+
+// bucketing returns the time buckets selected by the flags registered with addBucketFlags
+func bucketing() (*aggregator.Bucketing, error) {
+	res, err := bucket.Parse(resolutions, bucketTTLs)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := bucket.ParseZones(timeZones)
+	if err != nil {
+		return nil, err
+	}
+	bk := &aggregator.Bucketing{Resolutions: res, Zones: zones}
+	if homeZones == "builtin" {
+		bk.Home, err = aggregator.LoadHomeZones("")
+	} else if homeZones != "" {
+		bk.Home, err = aggregator.LoadHomeZones(homeZones)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bk, nil
+}
+
+// openStore opens the counter store selected by the flags registered with addStoreFlags
+func openStore(redisOpts *util.RedisOpts) (aggregator.CounterStore, error) {
+	s, err := aggregator.OpenStore(storeKind, redisOpts, storePath, replayWindow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s store: %w", storeKind, err)
+	}
+	return s, nil
+}
+
+// requireRedisStore fails unless the flags registered with addStoreFlags select Redis, for commands working on its keys
+func requireRedisStore(command string) error {
+	if storeKind != aggregator.StoreRedis {
+		return fmt.Errorf("%w: %s only works with the %s store, not %s", aggregator.ErrUnsupportedByStore, command, aggregator.StoreRedis, storeKind)
+	}
+	return nil
+}
+
+// closeStore closes a counter store once nothing writes to it anymore, logging any error
+func closeStore(s aggregator.CounterStore) {
+	err := s.Close()
+	if err != nil {
+		logger.Errorf("Error closing %s store: %v", storeKind, err)
+	}
+}
+
+func aggregatorOpts() (*aggregator.Opts, error) {
+	bk, err := bucketing()
+	if err != nil {
+		return nil, err
+	}
+	err = aggregator.ValidateLatePolicy(latePolicy)
+	if err != nil {
+		return nil, err
+	}
+	signals, err := aggregator.LoadSignals(signalsFile)
+	if err != nil {
+		return nil, err
+	}
+	sites, err := aggregator.LoadSites(sitematrixFile)
+	if err != nil {
+		return nil, err
+	}
+	pp, err := privacy.Load(privacyFile)
+	if err != nil {
+		return nil, err
+	}
+	var hot *aggregator.HotPageConfig
+	var publisher transport.Producer
+	if hotPageWindow > 0 {
+		hot = &aggregator.HotPageConfig{
+			Window:     hotPageWindow,
+			MinEdits:   hotPageMinEdits,
+			MaxUsers:   hotPageMaxUsers,
+			MinReverts: hotPageMinReverts,
+			MaxPages:   aggregator.DefaultHotPageConfig.MaxPages,
+		}
+		if hotPageTopic != "" {
+			opts := transportOptsFor(kafka.Name)
+			opts[kafka.OptTopic] = hotPageTopic
+			publisher, err = transport.NewProducer(kafka.Name, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create hot page publisher: %v", err)
+			}
+		}
+	}
+	var rates *aggregator.RateConfig
+	if anomalyInterval > 0 {
+		if anomalyAlpha <= 0 || anomalyAlpha > 1 {
+			return nil, fmt.Errorf("--anomaly-alpha must be between 0 and 1, got %v", anomalyAlpha)
+		}
+		rates = &aggregator.RateConfig{
+			Interval:  anomalyInterval,
+			Alpha:     anomalyAlpha,
+			Threshold: anomalyThreshold,
+			MinRate:   anomalyMinRate,
+			WarmUp:    aggregator.DefaultRateConfig.WarmUp,
+			MaxSeries: aggregator.DefaultRateConfig.MaxSeries,
+			Webhook:   anomalyWebhook,
+		}
+	}
+	var compaction *aggregator.CompactionConfig
+	if storeKind != aggregator.StoreRedis && (rollupAfter > 0 || retention != "") {
+		return nil, fmt.Errorf("%w: buckets are only rolled up and deleted in Redis, the %s store relies on --bucket-ttls", aggregator.ErrUnsupportedByStore, storeKind)
+	}
+	if compactionInterval > 0 && storeKind == aggregator.StoreRedis {
+		ret, err := bucket.ParseDurations(retention)
+		if err != nil {
+			return nil, err
+		}
+		compaction = &aggregator.CompactionConfig{
+			Interval:    compactionInterval,
+			RollupAfter: rollupAfter,
+			Retention:   ret,
+		}
+	}
+	return &aggregator.Opts{
+		Transport:           transportName,
+		RulesFile:           rulesFile,
+		RulesReloadInterval: rulesReloadInterval,
+		BatchSize:           batchSize,
+		BatchInterval:       batchInterval,
+		ReplayWindow:        replayWindow,
+		AllowedLateness:     allowedLateness,
+		LatePolicy:          latePolicy,
+		Buckets:             bk,
+		Signals:             signals,
+		Sites:               sites,
+		Privacy:             pp,
+		HotPages:            hot,
+		HotPagePublisher:    publisher,
+		Rates:               rates,
+		Compaction:          compaction,
+	}, nil
 }
 
 func startAggregator(cmd *cobra.Command, args []string) error {
 	logger.Info("Aggregation server starting...")
 
-	var a aggregator.Server
-	var aggErr error
 	redisOpts := &util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel}
-	if fileOn {
-		a, aggErr = file.NewAggregator(redisOpts, &file.Opts{
-			Source: fileDir,
-		})
+	opts, err := aggregatorOpts()
+	if err != nil {
+		return err
 	}
-	if kafkaOn {
-		a, aggErr = kafka.NewAggregator(redisOpts, &kafka.Opts{
-			Broker: kafkaBroker,
-			Topic:  kafkaTopic,
-		})
+	opts.Store, err = openStore(redisOpts)
+	if err != nil {
+		return err
 	}
-	if aggErr != nil {
-		return aggErr
+	defer closeStore(opts.Store)
+	c, err := transport.NewConsumer(transportName, selectedTransportOpts())
+	if err != nil {
+		return err
+	}
+	a, err := aggregator.NewAggregator(redisOpts, opts, c)
+	if err != nil {
+		return err
 	}
 
 	registerShutdownHook(a)
 
-	err := a.Start()
+	err = a.Start()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/ingester"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/gargath/pleiades/pkg/web"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdAll = &cobra.Command{
+		Use:   "all",
+		Short: "Starts Pleiades ingest, aggregation and frontend servers in a single process",
+		Long: `The all command runs the ingest server, the stats aggregator and the frontend web server together.
+	Events are passed between them through an in-memory transport unless another transport is selected.
+	The aggregator and the frontend share a single counter store, which need not be Redis.`,
+		RunE: startAll,
+	}
+)
+
+func init() {
+	cmdAll.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server to write aggregated stats to")
+	cmdAll.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	cmdAll.Flags().StringVar(&listenAddr, "listen-addr", ":8080", "the address to listen on")
+	cmdAll.Flags().BoolVarP(&resume, "resume", "r", true, "try to resume from last seen event ID")
+	addAggregatorFlags(cmdAll.Flags())
+}
+
+func startAll(cmd *cobra.Command, args []string) error {
+	logger.Infof("Starting all servers using %s transport...", transportName)
+
+	redisOpts := &util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel}
+	opts := selectedTransportOpts()
+	aggOpts, err := aggregatorOpts()
+	if err != nil {
+		return err
+	}
+
+	aggOpts.Store, err = openStore(redisOpts)
+	if err != nil {
+		return err
+	}
+	// The frontend closes the store when stopped after the aggregator, this covers failing before that
+	defer closeStore(aggOpts.Store)
+
+	consumer, err := transport.NewConsumer(transportName, opts)
+	if err != nil {
+		return err
+	}
+	a, err := aggregator.NewAggregator(redisOpts, aggOpts, consumer)
+	if err != nil {
+		return err
+	}
+	f, err := web.NewFrontend(&web.Opts{
+		ListenAddr: listenAddr,
+		Redis:      redisOpts,
+		Store:      aggOpts.Store,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to start frontend server: %v", err)
+	}
+	coord := &ingester.Coordinator{
+		Resume:        resume,
+		Transport:     transportName,
+		TransportOpts: opts,
+		Privacy:       aggOpts.Privacy,
+		Signals:       aggOpts.Signals,
+	}
+
+	// Stop the ingester first so that no new events are published while the aggregator shuts down
+	registerShutdownHook(coord, a, f)
+
+	errs := make(chan error, 3)
+	go func() {
+		lastEventID, err := coord.Start()
+		logger.Info("Ingest shutdown complete")
+		logger.Infof("Last seen Event ID: %s", lastEventID)
+		errs <- err
+	}()
+	go func() {
+		err := a.Start()
+		logger.Info("Aggregation shutdown complete")
+		errs <- err
+	}()
+	go func() {
+		err := f.Start()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		logger.Info("Web server shutdown complete")
+		errs <- err
+	}()
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/gargath/pleiades/pkg/web"
 	"github.com/spf13/cobra"
@@ -14,7 +15,8 @@ var (
 		Use:   "frontend",
 		Short: "Starts Pleiades frontend server",
 		Long: `The frontend command starts the frontend web server.
-	It will serve a page displaying redis counters.`,
+	It will serve a page displaying the counters of the store selected by --store.
+	Memory and file stores can only be opened by the process aggregating into them, so serve them with the all command.`,
 		RunE: startFrontend,
 	}
 
@@ -27,18 +29,26 @@ func init() { //TODO: Use Sentinels
 	cmdFront.Flags().StringVar(&frontendRedis, "frontend-redis-addr", "localhost:6379", "the Redis server to write aggregated stats to")
 	cmdFront.Flags().BoolVar(&frontendRedisUseSentinel, "frontend-redis-use-sentinel", false, "should Redis use Sentinel for connect")
 	cmdFront.Flags().StringVar(&listenAddr, "listen-addr", ":8080", "the address to listen on")
+	addStoreFlags(cmdFront.Flags())
 }
 
 func startFrontend(cmd *cobra.Command, args []string) error {
+	redisOpts := &util.RedisOpts{
+		RedisAddr:        frontendRedis,
+		RedisUseSentinel: frontendRedisUseSentinel,
+	}
+	store, err := aggregator.OpenReadOnlyStore(storeKind, redisOpts, storePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s store: %w", storeKind, err)
+	}
 	f, err := web.NewFrontend(&web.Opts{
 		ListenAddr: listenAddr,
-		Redis: &util.RedisOpts{
-			RedisAddr:        frontendRedis,
-			RedisUseSentinel: frontendRedisUseSentinel,
-		},
+		Redis:      redisOpts,
+		Store:      store,
 	})
 
 	if err != nil {
+		closeStore(store)
 		return fmt.Errorf("Failed to start frontend server: %v", err)
 	}
 
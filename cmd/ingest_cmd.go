@@ -1,9 +1,9 @@
 package main
 
 import (
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/ingester"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/privacy"
 	"github.com/spf13/cobra"
 )
 
@@ -22,26 +22,28 @@ It will begin consuming the WMF stream and publish received events to the config
 
 func init() {
 	cmdIngest.Flags().BoolVarP(&resume, "resume", "r", true, "try to resume from last seen event ID")
+	addPrivacyFlag(cmdIngest.Flags())
+	addSignalsFlag(cmdIngest.Flags())
 }
 
 func startIngest(cmd *cobra.Command, args []string) error {
 
 	logger.Info("Ingest server starting...")
 
-	c = &ingester.Coordinator{
-		Resume: resume,
+	pp, err := privacy.Load(privacyFile)
+	if err != nil {
+		return err
 	}
-
-	if fileOn {
-		c.File = &file.Opts{
-			Destination: fileDir,
-		}
+	signals, err := aggregator.LoadSignals(signalsFile)
+	if err != nil {
+		return err
 	}
-	if kafkaOn {
-		c.Kafka = &kafka.Opts{
-			Broker: kafkaBroker,
-			Topic:  kafkaTopic,
-		}
+	c = &ingester.Coordinator{
+		Resume:        resume,
+		Transport:     transportName,
+		TransportOpts: selectedTransportOpts(),
+		Privacy:       pp,
+		Signals:       signals,
 	}
 
 	registerShutdownHook(c)
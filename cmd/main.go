@@ -9,6 +9,8 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport/kafka"
+	"github.com/gargath/pleiades/pkg/transport/memory"
 )
 
 const moduleName = "main"
@@ -18,11 +20,6 @@ var (
 	verbose     bool
 	quiet       bool
 	metricsPort string
-	fileOn      bool
-	kafkaOn     bool
-	fileDir     string
-	kafkaBroker string
-	kafkaTopic  string
 )
 
 func main() {
@@ -39,12 +36,19 @@ func main() {
 			} else {
 				log.InitLogLevel(log.DEFAULT)
 			}
-			if cmd.Use != "frontend" {
-				if fileOn && kafkaOn {
-					return fmt.Errorf("Can only specify either --file.enable or --kafka.enable")
-
-				} else if !fileOn && !kafkaOn {
-					return fmt.Errorf("No queue backend specified (use either --file.enable or --kafka.enable)")
+			switch cmd.Use {
+			case "frontend", "reaggregate", "pseudonymize", "reindex":
+			case "all":
+				if err := resolveTransport(cmd.Flags(), memory.Name); err != nil {
+					return err
+				}
+			case "reset-offsets":
+				if err := resolveTransport(cmd.Flags(), kafka.Name); err != nil {
+					return err
+				}
+			default:
+				if err := resolveTransport(cmd.Flags(), ""); err != nil {
+					return err
 				}
 			}
 			initMetrics(metricsPort)
@@ -58,15 +62,14 @@ func main() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "suppress all output except for errors")
 	rootCmd.PersistentFlags().StringVar(&metricsPort, "metricsPort", "9000", "the port to serve Prometheus metrics on")
-	rootCmd.PersistentFlags().BoolVar(&fileOn, "file.enable", false, "enable the filesystem publisher")
-	rootCmd.PersistentFlags().StringVar(&fileDir, "file.publishDir", "./events", "the directory to publish events to")
-	rootCmd.PersistentFlags().BoolVar(&kafkaOn, "kafka.enable", false, "enable the kafka publisher")
-	rootCmd.PersistentFlags().StringVar(&kafkaBroker, "kafka.broker", "localhost:9092", "the kafka broker to connect to")
-	rootCmd.PersistentFlags().StringVar(&kafkaTopic, "kafka.topic", "pleiades-events", "the kafka topic to publish to")
+	addTransportFlags(rootCmd.PersistentFlags())
 
 	rootCmd.AddCommand(cmdIngest)
 	rootCmd.AddCommand(cmdAgg)
 	rootCmd.AddCommand(cmdFront)
+	rootCmd.AddCommand(cmdAll)
+	rootCmd.AddCommand(cmdReaggregate)
+	rootCmd.AddCommand(cmdPseudonymize)
 
 	logger = log.MustGetLogger(moduleName)
 	logger.Infof("Pleiades %s\n", version())
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	cmdPseudonymize = &cobra.Command{
+		Use:   "pseudonymize",
+		Short: "Prints the pseudonyms of users under each key of a privacy policy",
+		Long: `The pseudonymize command prints the pseudonym of each user given as an argument under every key of the
+	privacy policy, including keys that have been rotated, e.g. to find the data stored about a user.`,
+		RunE: pseudonymize,
+	}
+
+	privacyFile string
+)
+
+func init() {
+	addPrivacyFlag(cmdPseudonymize.Flags())
+}
+
+// addPrivacyFlag registers the flag selecting the privacy policy applied to events
+func addPrivacyFlag(flags *pflag.FlagSet) {
+	flags.StringVar(&privacyFile, "privacy", "", "a JSON file defining how users are pseudonymized and which fields are dropped (disabled if empty)")
+}
+
+func pseudonymize(cmd *cobra.Command, args []string) error {
+	p, err := privacy.Load(privacyFile)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("--privacy is required")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no users given")
+	}
+	for _, user := range args {
+		ps := p.Pseudonyms(user)
+		for _, id := range p.KeyIDs() {
+			fmt.Printf("%s\t%s\t%s\n", user, id, ps[id])
+		}
+	}
+	return nil
+}
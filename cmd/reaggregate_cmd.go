@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/gargath/pleiades/pkg/transport/file"
+	"github.com/gargath/pleiades/pkg/util"
+
+	"github.com/spf13/cobra"
+)
+
+// replaySlack is how far around the rebuilt days events are read, to catch those published late or early
+const replaySlack = time.Hour
+
+var (
+	cmdReaggregate = &cobra.Command{
+		Use:   "reaggregate",
+		Short: "Rebuilds the counters of a range of days",
+		Long: `The reaggregate command recomputes the counters of a range of days from the events retained by a transport.
+	All buckets lying within these days, in the time zone each bucket is aligned to, are rebuilt in a staging namespace
+	and swapped in atomically once all events have been read. All-time counters and buckets extending beyond the range
+	are not changed. Nothing is swapped in unless the transport still retains events from before the first day until
+	after the last one.`,
+		RunE: reaggregate,
+	}
+
+	reaggFrom   string
+	reaggTo     string
+	reaggSource string
+	reaggDryRun bool
+)
+
+func init() {
+	cmdReaggregate.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server holding the counters")
+	cmdReaggregate.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	addStoreFlags(cmdReaggregate.Flags())
+	cmdReaggregate.Flags().StringVar(&rulesFile, "rules", "", "a JSON file defining the counters to aggregate (defaults to the built-in rules)")
+	cmdReaggregate.Flags().StringVar(&reaggFrom, "from", "", "the first day to rebuild, as YYYY-MM-DD or day number")
+	cmdReaggregate.Flags().StringVar(&reaggTo, "to", "", "the last day to rebuild, as YYYY-MM-DD or day number (defaults to --from)")
+	cmdReaggregate.Flags().StringVar(&reaggSource, "source", "kafka", "the transport to read events from (kafka or files)")
+	addBucketFlags(cmdReaggregate.Flags())
+	addEnrichmentFlags(cmdReaggregate.Flags())
+	cmdReaggregate.Flags().BoolVar(&reaggDryRun, "dry-run", false, "print the changes instead of applying them")
+}
+
+// parseDay accepts a day given as YYYY-MM-DD or as the number of days since the epoch
+func parseDay(s string) (int64, error) {
+	if d, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return d, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid day %s, expected YYYY-MM-DD or a day number", s)
+	}
+	return t.Unix() / 86400, nil
+}
+
+func reaggregate(cmd *cobra.Command, args []string) error {
+	err := requireRedisStore(cmd.Name())
+	if err != nil {
+		return err
+	}
+	if reaggFrom == "" {
+		return fmt.Errorf("--from is required")
+	}
+	if reaggTo == "" {
+		reaggTo = reaggFrom
+	}
+	from, err := parseDay(reaggFrom)
+	if err != nil {
+		return err
+	}
+	to, err := parseDay(reaggTo)
+	if err != nil {
+		return err
+	}
+	if to < from {
+		return fmt.Errorf("--to must not be before --from")
+	}
+	if reaggSource == "files" {
+		reaggSource = file.Name
+	}
+
+	rs, err := aggregator.LoadRules(rulesFile)
+	if err != nil {
+		return fmt.Errorf("failed to load counter rules: %v", err)
+	}
+	bk, err := bucketing()
+	if err != nil {
+		return err
+	}
+	signals, err := aggregator.LoadSignals(signalsFile)
+	if err != nil {
+		return err
+	}
+	rs.UseSignals(signals)
+	sites, err := aggregator.LoadSites(sitematrixFile)
+	if err != nil {
+		return err
+	}
+	rs.UseSites(sites)
+	pp, err := privacy.Load(privacyFile)
+	if err != nil {
+		return err
+	}
+	rs.UsePrivacy(pp)
+	replayer, err := transport.NewReplayer(reaggSource, transportOptsFor(reaggSource))
+	if err != nil {
+		return err
+	}
+	defer replayer.Close()
+	r, err := util.NewValidatedRedisClient(&util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis at %s: %v", redis, err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	g := aggregator.NewReaggregation(r, rs, bk, from, to)
+	start, end := g.Window()
+	logger.Infof("Rebuilding counters from %s to %s using %s", start.Format(time.RFC3339), end.Format(time.RFC3339), reaggSource)
+	err = replayer.Replay(ctx, start.Add(-replaySlack), end.Add(replaySlack), func(m *transport.Message) error {
+		return g.Add(ctx, m)
+	})
+	if err == nil {
+		err = g.Flush(ctx)
+	}
+	if err != nil {
+		g.Discard(ctx)
+		return err
+	}
+	logger.Infof("Counted %d events", g.Events())
+	if g.Events() == 0 {
+		g.Discard(ctx)
+		return fmt.Errorf("no events found for the given days, leaving counters unchanged")
+	}
+
+	if reaggDryRun {
+		defer g.Discard(ctx)
+		if !g.Covered() {
+			logger.Warningf("The events read do not cover all days, these changes would not be applied")
+		}
+		diffs, err := g.Diff(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range diffs {
+			name := d.Key
+			if d.Member != "" {
+				name = fmt.Sprintf("%s[%s]", d.Key, d.Member)
+			}
+			fmt.Printf("%s: %d -> %d (%+d)\n", name, d.Old, d.New, d.New-d.Old)
+		}
+		fmt.Printf("%d counter values would change\n", len(diffs))
+		return nil
+	}
+	err = g.Commit(ctx)
+	if err != nil {
+		g.Discard(ctx)
+	}
+	return err
+}
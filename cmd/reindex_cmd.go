@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/util"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdReindex = &cobra.Command{
+		Use:   "reindex",
+		Short: "Builds the bucket index from the existing counters",
+		Long: `The reindex command scans the bucket keys in Redis and records each bucket and the names of its counters
+	in the bucket index the frontend lists buckets and counters from. Aggregators keep the index up to date, so it only
+	needs to run once for counters written before the index existed. It is safe to run while aggregators are running.`,
+		RunE: reindex,
+	}
+)
+
+func init() {
+	cmdReindex.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server the aggregators write to")
+	cmdReindex.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	addStoreFlags(cmdReindex.Flags())
+	addBucketFlags(cmdReindex.Flags())
+	cmdAgg.AddCommand(cmdReindex)
+}
+
+func reindex(cmd *cobra.Command, args []string) error {
+	err := requireRedisStore(cmd.Name())
+	if err != nil {
+		return err
+	}
+	bk, err := bucketing()
+	if err != nil {
+		return err
+	}
+	r, err := util.NewValidatedRedisClient(&util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis at %s: %v", redis, err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	n, err := aggregator.Reindex(ctx, r, bk)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Indexed %d buckets", n)
+	return nil
+}
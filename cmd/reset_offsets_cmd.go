@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/transport/kafka"
+	"github.com/gargath/pleiades/pkg/util"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdResetOffsets = &cobra.Command{
+		Use:   "reset-offsets",
+		Short: "Moves the Kafka aggregator consumer group to a different position",
+		Long: `The reset-offsets command commits new offsets for the aggregator consumer group and rewinds the offsets
+	recorded as applied in the counter store, so events from that position on are aggregated again.
+	Existing counters are not cleared, so replayed events are counted twice: in the all-time counters and in their buckets.
+	It therefore requires --recount. Once the aggregators have caught up, rebuild the buckets of the affected days
+	with reaggregate. Stop all aggregators of the group before running it.`,
+		RunE: resetOffsets,
+	}
+
+	resetToTime  string
+	resetTo      string
+	resetRecount bool
+)
+
+func init() {
+	cmdResetOffsets.Flags().StringVar(&redis, "redis-addr", "localhost:6379", "the Redis server the aggregators write to")
+	cmdResetOffsets.Flags().BoolVar(&redisUseSentinel, "redis-use-sentinel", false, "should Redis use Sentinel for connect")
+	addStoreFlags(cmdResetOffsets.Flags())
+	cmdResetOffsets.Flags().StringVar(&resetToTime, "to-time", "", "move to the first event at or after this RFC3339 timestamp")
+	cmdResetOffsets.Flags().StringVar(&resetTo, "to", "", "move to earliest, latest or the given partition:offset pairs")
+	cmdResetOffsets.Flags().BoolVar(&resetRecount, "recount", false, "acknowledge that replayed events are counted again on top of the existing counters")
+	cmdAgg.AddCommand(cmdResetOffsets)
+}
+
+func resetOffsets(cmd *cobra.Command, args []string) error {
+	if transportName != kafka.Name {
+		return fmt.Errorf("reset-offsets only supports the %s transport", kafka.Name)
+	}
+	if (resetToTime == "") == (resetTo == "") {
+		return fmt.Errorf("exactly one of --to-time and --to is required")
+	}
+	if !resetRecount {
+		return fmt.Errorf("existing counters are not cleared, so replayed events are counted twice; pass --recount to proceed and rebuild the affected days with reaggregate afterwards")
+	}
+	pos, err := kafka.ParseStartPosition(resetTo + resetToTime)
+	if err != nil {
+		return err
+	}
+	if resetToTime != "" && pos.Time.IsZero() {
+		return fmt.Errorf("--to-time must be an RFC3339 timestamp, got %s", resetToTime)
+	}
+
+	if storeKind == aggregator.StoreMemory {
+		return fmt.Errorf("%w: the %s store does not keep applied offsets beyond its process", aggregator.ErrUnsupportedByStore, storeKind)
+	}
+	store, err := openStore(&util.RedisOpts{RedisAddr: redis, RedisUseSentinel: redisUseSentinel})
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	opts := selectedTransportOpts()
+	offsets, err := kafka.ResetOffsets(ctx, opts, pos)
+	if err != nil {
+		return err
+	}
+
+	group := opts[kafka.OptGroupID]
+	applied := make(map[string]int64)
+	for p, o := range offsets {
+		logger.Infof("Partition %d of %s reset to offset %d for group %s", p, opts[kafka.OptTopic], o, group)
+		applied[kafka.PartitionName(group, opts[kafka.OptTopic], p)] = o - 1
+	}
+	return store.SetAppliedOffsets(ctx, applied)
+}
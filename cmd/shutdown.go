@@ -5,13 +5,16 @@ import (
 	"os/signal"
 )
 
-func registerShutdownHook(s Stoppable) {
+// registerShutdownHook stops the given components in order once an interrupt is received
+func registerShutdownHook(components ...Stoppable) {
 	logger.Debug("Registering shutdown handler")
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	go func() {
 		<-quit
 		logger.Debug("Shutting down...")
-		s.Stop()
+		for _, s := range components {
+			s.Stop()
+		}
 	}()
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/spf13/pflag"
+
+	// Register the bundled transport backends
+	_ "github.com/gargath/pleiades/pkg/transport/file"
+	_ "github.com/gargath/pleiades/pkg/transport/kafka"
+	_ "github.com/gargath/pleiades/pkg/transport/memory"
+)
+
+var (
+	transportName string
+	transportOpts = make(map[string]map[string]*string)
+)
+
+// addTransportFlags registers the --transport selector and one flag per option of every registered backend
+func addTransportFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&transportName, "transport", "", fmt.Sprintf("the transport to publish events to or consume events from (one of: %s)", strings.Join(transport.Names(), ", ")))
+	for _, b := range transport.Backends() {
+		opts := make(map[string]*string)
+		for _, o := range b.Options {
+			opts[o.Name] = flags.String(b.Name+"."+o.Name, o.Default, o.Usage)
+		}
+		transportOpts[b.Name] = opts
+		flags.Bool(b.Name+".enable", false, fmt.Sprintf("enable the %s transport", b.Name))
+		flags.MarkDeprecated(b.Name+".enable", "use --transport="+b.Name+" instead")
+	}
+}
+
+// resolveTransport determines the selected transport, taking the deprecated --<name>.enable flags into account
+// If no transport was selected, def is used. An empty def means a transport must be selected explicitly.
+func resolveTransport(flags *pflag.FlagSet, def string) error {
+	for _, name := range transport.Names() {
+		if on, _ := flags.GetBool(name + ".enable"); on {
+			if transportName != "" && transportName != name {
+				return fmt.Errorf("Can only select a single transport, got both %s and %s", transportName, name)
+			}
+			transportName = name
+		}
+	}
+	if transportName == "" {
+		transportName = def
+	}
+	if transportName == "" {
+		return fmt.Errorf("No transport specified (use --transport with one of: %s)", strings.Join(transport.Names(), ", "))
+	}
+	_, err := transport.Lookup(transportName)
+	return err
+}
+
+// selectedTransportOpts returns the option values given on the command line for the selected transport
+func selectedTransportOpts() transport.Opts {
+	return transportOptsFor(transportName)
+}
+
+// transportOptsFor returns the option values given on the command line for the named transport
+func transportOptsFor(name string) transport.Opts {
+	opts := make(transport.Opts)
+	for k, v := range transportOpts[name] {
+		opts[k] = *v
+	}
+	return opts
+}
@@ -20,4 +20,5 @@ require (
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.0
+	go.etcd.io/bbolt v1.3.5
 )
@@ -2,12 +2,15 @@ package aggregator
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"time"
 
+	"github.com/gargath/pleiades/pkg/bucket"
 	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -28,41 +31,118 @@ var (
 	)
 )
 
-// CountersFromEventData parses an event body and generates the Redis counters to increment for it
-func CountersFromEventData(data []byte) ([]string, int64, error) { //TODO: This should return a set of counters and increments to allow for more than just +1
-	var lendiff int64 = 0
-	var counters = []string{"pleiades_total"}
-	var event MediawikiRecentchange
+// PoisonError is returned for messages that can never be aggregated, no matter how often they are retried
+type PoisonError struct {
+	Err error
+}
+
+func (e *PoisonError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PoisonError) Unwrap() error {
+	return e.Err
+}
+
+// IsPoison reports whether err was caused by the content of a message rather than a transient failure
+func IsPoison(err error) bool {
+	var p *PoisonError
+	return errors.As(err, &p)
+}
+
+// CountersFromEventData parses an event body and evaluates the given rules against it to generate the Redis counters to increment
+func CountersFromEventData(rs *RuleSet, data []byte) ([]Increment, error) {
+	event, err := decodeEvent(data)
+	if err != nil {
+		return nil, err
+	}
+	return countersFromEvent(rs, event), nil
+}
+
+func decodeEvent(data []byte) (map[string]interface{}, error) {
+	var event map[string]interface{}
 	err := json.Unmarshal(data, &event)
 	if err != nil {
 		logger.Debugf("failed to parse event data line: %s", string(data))
-		return counters, 0, fmt.Errorf("failed to parse event data: %v", err)
+		return nil, fmt.Errorf("failed to parse event data: %v", err)
 	}
-	if event.Wiki != "" {
-		counters = append(counters, "pleiades_wiki_"+event.Wiki)
-	} else {
-		logger.Info("Encountered event without a Wiki: %+v", event)
+	return event, nil
+}
+
+func countersFromEvent(rs *RuleSet, event map[string]interface{}) []Increment {
+	enrich(rs.sites, event)
+	rs.signals.Annotate(event)
+	rs.signals.observe(event)
+	increments, err := rs.Evaluate(event)
+	if err != nil {
+		logger.Errorf("Error evaluating counter rules: %v", err)
 	}
-	if event.Type != "" {
-		counters = append(counters, "pleiades_type_"+event.Type)
-	} else {
-		logger.Info("Encountered event without Type: %+v", event)
+	return increments
+}
+
+// EventID returns the upstream meta.id of a parsed event, or an empty string if it has none
+func EventID(event map[string]interface{}) string {
+	meta, ok := event["meta"].(map[string]interface{})
+	if !ok {
+		return ""
 	}
-	if event.Bot {
-		counters = append(counters, "pleiades_bot")
+	id, _ := meta["id"].(string)
+	return id
+}
+
+// Aggregate computes the Update for a single message
+// Every counter produced by the rules is incremented both in its all-time key and in each bucket the event falls into.
+func Aggregate(rs *RuleSet, bk *Bucketing, msg *transport.Message) (*Update, error) {
+	u, _, err := aggregate(rs, bk, msg)
+	return u, err
+}
+
+// aggregate computes the Update for a single message and also returns the parsed event
+func aggregate(rs *RuleSet, bk *Bucketing, msg *transport.Message) (*Update, map[string]interface{}, error) {
+	event, err := decodeEvent(msg.Data)
+	if err != nil {
+		return nil, nil, &PoisonError{Err: fmt.Errorf("error processing event: %s, %v", string(msg.Data), err)}
 	}
-	if event.Minor {
-		counters = append(counters, "pleiades_minor")
+	eventTimestamp, err := ParseTimestamp(msg.ID)
+	if err != nil {
+		return nil, nil, &PoisonError{Err: fmt.Errorf("failed to parse timestamp from message: %s: %v", msg.ID, err)}
 	}
-	if event.Length != nil {
-		if event.Length.Old < event.Length.New {
-			counters = append(counters, "pleiades_length_inc")
-		} else {
-			counters = append(counters, "pleiades_length_dec")
+	counters := countersFromEvent(rs, event)
+	t := EventTime(eventTimestamp)
+	buckets := bk.Buckets(t, eventWiki(event))
+	return &Update{
+		Partition:  msg.Partition,
+		Offset:     msg.Offset,
+		EventID:    EventID(event),
+		Time:       t,
+		Increments: append(counters, Bucketed(counters, buckets)...),
+		allTime:    len(counters),
+		buckets:    buckets,
+	}, event, nil
+}
+
+// EventTime converts an event timestamp in milliseconds since the epoch to a time
+func EventTime(eventTimestamp int64) time.Time {
+	return time.Unix(eventTimestamp/1000, (eventTimestamp%1000)*int64(time.Millisecond)).UTC()
+}
+
+func eventWiki(event map[string]interface{}) string {
+	wiki, _ := event["wiki"].(string)
+	return wiki
+}
+
+// Bucketed expands counter increments into key increments for each of the given buckets
+func Bucketed(counters []Increment, buckets []bucket.Bucket) []Increment {
+	out := make([]Increment, 0, len(counters)*len(buckets))
+	for _, b := range buckets {
+		p := b.Prefix()
+		for _, c := range counters {
+			c.Key = p + c.Key
+			c.TTL = b.Resolution.TTL
+			out = append(out, c)
 		}
-		lendiff = event.Length.New - event.Length.Old
 	}
-	return counters, lendiff, nil
+	return out
 }
 
 // RecordLag parses the timestamp from a event ID and observes the lag as Prometheus metrics
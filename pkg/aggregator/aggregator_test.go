@@ -1,6 +1,11 @@
 package aggregator
 
 import (
+	"fmt"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+
 	. "github.com/onsi/ginkgo"
 
 	. "github.com/onsi/gomega"
@@ -27,3 +32,73 @@ var _ = Describe("Aggregator Parser", func() {
 		}
 	})
 })
+
+var _ = Describe("Aggregation Core", func() {
+
+	It("increments all-time and daily keys", func() {
+		rs, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+		msg := &transport.Message{
+			ID:   `[{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":1597056638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit","length":{"old":10,"new":25},"meta":{"id":"abc-123"}}`),
+		}
+		u, err := Aggregate(rs, DefaultBucketing(), msg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.EventID).Should(Equal("abc-123"))
+		incs := u.Increments
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_total", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_pleiades_total", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_growth", Delta: 15}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_pleiades_growth", Delta: 15}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_top_wikis", Delta: 1, Member: "enwiki", Size: DefaultTopSize}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_xtab_events", Delta: 1, Field: "wiki=enwiki|type=edit|bot=", Size: DefaultCrosstabSize}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_hist_growth", Delta: 1, Field: "16", Size: 44}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_pleiades_family_wikipedia", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "day_18484_xtab_sites", Delta: 1, Field: "family=wikipedia|language=en|type=edit|bot=", Size: DefaultCrosstabSize}))
+		Expect(incs).Should(HaveLen(22))
+	})
+
+	It("increments buckets of every resolution", func() {
+		rs, err := ParseRules([]byte(`{"counters":[{"name":"pleiades_total"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		u, err := Aggregate(rs, &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Minute, bucket.Hour, bucket.Day, bucket.Week, bucket.Month},
+			Zones:       []*bucket.Zone{bucket.UTC},
+		}, &transport.Message{
+			ID:   `[{"timestamp":1597056638001}]`,
+			Data: []byte(`{}`),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Increments).Should(Equal([]Increment{
+			{Key: "pleiades_total", Delta: 1},
+			{Key: "minute_26617610_pleiades_total", Delta: 1, TTL: bucket.Minute.TTL},
+			{Key: "hour_443626_pleiades_total", Delta: 1, TTL: bucket.Hour.TTL},
+			{Key: "day_18484_pleiades_total", Delta: 1},
+			{Key: "week_202033_pleiades_total", Delta: 1},
+			{Key: "month_202008_pleiades_total", Delta: 1},
+		}))
+	})
+
+	It("carries the partition offset of the message", func() {
+		rs, _ := LoadRules("")
+		u, err := Aggregate(rs, DefaultBucketing(), &transport.Message{ID: `[{"timestamp":1597056638001}]`, Data: []byte(`{}`), Partition: "events/3", Offset: 42})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Partition).Should(Equal("events/3"))
+		Expect(u.Offset).Should(Equal(int64(42)))
+		Expect(u.EventID).Should(BeEmpty())
+	})
+
+	It("rejects messages without a timestamp", func() {
+		rs, _ := LoadRules("")
+		_, err := Aggregate(rs, DefaultBucketing(), &transport.Message{ID: "foo", Data: []byte(`{}`)})
+		Expect(err).To(HaveOccurred())
+		Expect(IsPoison(err)).To(BeTrue())
+	})
+
+	It("classifies malformed event data as poison", func() {
+		rs, _ := LoadRules("")
+		_, err := Aggregate(rs, DefaultBucketing(), &transport.Message{ID: "1597056638001", Data: []byte(`{"wiki":`)})
+		Expect(IsPoison(err)).To(BeTrue())
+		Expect(IsPoison(fmt.Errorf("connection refused"))).To(BeFalse())
+	})
+})
@@ -0,0 +1,223 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// AnomalySpike flags a rate far above its baseline
+	AnomalySpike = "spike"
+	// AnomalyDrop flags a rate far below its baseline
+	AnomalyDrop = "drop"
+	// AnomalyStall flags a series that stopped receiving events altogether
+	AnomalyStall = "stall"
+
+	// AnomaliesKey is the hash holding the active anomalies as JSON, keyed by series
+	AnomaliesKey = "anomalies"
+)
+
+// DefaultRateConfig is the rate anomaly detection used unless configured otherwise
+var DefaultRateConfig = RateConfig{
+	Interval:  time.Minute,
+	Alpha:     0.1,
+	Threshold: 4,
+	MinRate:   10,
+	WarmUp:    30,
+	MaxSeries: 10000,
+}
+
+var (
+	anomalyScore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_anomaly_score",
+			Help: "Deviation of the rate of a series from its baseline in standard deviations, while it is anomalous",
+		},
+		[]string{"series", "kind"},
+	)
+
+	anomaliesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_anomalies_total",
+			Help: "Number of anomalies raised, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	rateSeries = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_rate_series",
+			Help: "Number of series whose rates are tracked for anomaly detection",
+		},
+	)
+
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// NewRates returns a Rates detector
+func NewRates(cfg RateConfig) *Rates {
+	return &Rates{
+		cfg:    cfg,
+		counts: make(map[string]float64),
+		series: make(map[string]*baseline),
+		active: make(map[string]*Anomaly),
+	}
+}
+
+// Observe counts an event in the total series and in the series of its wiki, its type and, for bot events, its wiki's bots
+func (r *Rates) Observe(event map[string]interface{}) {
+	series := []string{"total"}
+	if wiki := eventWiki(event); wiki != "" {
+		series = append(series, "wiki:"+wiki)
+		if Truthy(event["bot"]) {
+			series = append(series, "bot:"+wiki)
+		}
+	}
+	if t := toString(event["type"]); t != "" {
+		series = append(series, "type:"+t)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range series {
+		if _, ok := r.series[s]; !ok {
+			if len(r.series) >= r.cfg.MaxSeries {
+				continue
+			}
+			r.series[s] = &baseline{}
+		}
+		r.counts[s]++
+	}
+}
+
+// Tick ends the current interval at now, compares each series' rate to its baseline and updates the baseline
+// It returns all active anomalies and those among them that are new.
+func (r *Rates) Tick(now time.Time) ([]*Anomaly, []*Anomaly) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var active, raised []*Anomaly
+	for s, b := range r.series {
+		rate := r.counts[s]
+		a := b.check(s, rate, r.cfg)
+		b.update(rate, r.cfg.Alpha)
+		if b.n > r.cfg.WarmUp && b.mean < 0.01 {
+			delete(r.series, s)
+		}
+		prev := r.active[s]
+		if prev != nil && (a == nil || a.Kind != prev.Kind) {
+			anomalyScore.DeleteLabelValues(s, prev.Kind)
+			delete(r.active, s)
+		}
+		if a == nil {
+			continue
+		}
+		a.Since, a.Time = now.Unix(), now.Unix()
+		if prev != nil && prev.Kind == a.Kind {
+			a.Since = prev.Since
+		} else {
+			anomaliesTotal.WithLabelValues(a.Kind).Inc()
+			raised = append(raised, a)
+		}
+		anomalyScore.WithLabelValues(s, a.Kind).Set(a.Score)
+		r.active[s] = a
+		active = append(active, a)
+	}
+	r.counts = make(map[string]float64)
+	rateSeries.Set(float64(len(r.series)))
+	return active, raised
+}
+
+// check returns the anomaly a rate constitutes for a series with this baseline, or nil if it is normal
+// The standard deviation is at least that of a Poisson process with the baseline's mean, so that a series
+// with a steady rate does not become anomalous at the slightest change.
+func (b *baseline) check(series string, rate float64, cfg RateConfig) *Anomaly {
+	if b.n < cfg.WarmUp || math.Max(rate, b.mean) < cfg.MinRate {
+		return nil
+	}
+	sd := math.Max(math.Sqrt(b.variance), math.Max(math.Sqrt(b.mean), 1))
+	score := (rate - b.mean) / sd
+	if math.Abs(score) < cfg.Threshold {
+		return nil
+	}
+	a := &Anomaly{Series: series, Rate: rate, Baseline: b.mean, Score: score}
+	switch {
+	case rate == 0:
+		a.Kind = AnomalyStall
+	case score > 0:
+		a.Kind = AnomalySpike
+	default:
+		a.Kind = AnomalyDrop
+	}
+	return a
+}
+
+// update folds the rate of the latest interval into the baseline
+func (b *baseline) update(rate float64, alpha float64) {
+	if b.n == 0 {
+		b.mean = rate
+	} else {
+		diff := rate - b.mean
+		incr := alpha * diff
+		b.mean += incr
+		b.variance = (1 - alpha) * (b.variance + diff*incr)
+	}
+	b.n++
+}
+
+// watchRates ends a rate interval every interval, records the active anomalies and reports new ones
+func (a *Aggregator) watchRates() {
+	if a.rates == nil {
+		return
+	}
+	cfg := a.Opts.Rates
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-t.C:
+			active, raised := a.rates.Tick(now)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := a.store.SetAnomalies(ctx, active, 3*cfg.Interval)
+			cancel()
+			if err != nil {
+				logger.Errorf("Failed to record anomalies: %v", err)
+			}
+			for _, an := range raised {
+				logger.Warningf("Anomalous %s of %s: %.0f events per %s against a baseline of %.1f", an.Kind, an.Series, an.Rate, cfg.Interval, an.Baseline)
+				if cfg.Webhook == "" {
+					continue
+				}
+				err = notifyWebhook(cfg.Webhook, an)
+				if err != nil {
+					logger.Errorf("Failed to post anomaly of %s to webhook: %v", an.Series, err)
+				}
+			}
+		}
+	}
+}
+
+// notifyWebhook POSTs an anomaly to a webhook as JSON
+func notifyWebhook(url string, an *Anomaly) error {
+	data, err := json.Marshal(an)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
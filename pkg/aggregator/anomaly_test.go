@@ -0,0 +1,66 @@
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rates", func() {
+	start := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+	cfg := RateConfig{Interval: time.Minute, Alpha: 0.1, Threshold: 4, MinRate: 10, WarmUp: 5, MaxSeries: 100}
+
+	// run observes n copies of event in each interval and returns the result of the last tick
+	run := func(r *Rates, event string, counts ...int) ([]*Anomaly, []*Anomaly) {
+		var active, raised []*Anomaly
+		for i, n := range counts {
+			for j := 0; j < n; j++ {
+				r.Observe(parseEvent(event))
+			}
+			active, raised = r.Tick(start.Add(time.Duration(i) * time.Minute))
+		}
+		return active, raised
+	}
+
+	It("raises a spike once and keeps it active while it lasts", func() {
+		r := NewRates(cfg)
+		_, raised := run(r, `{"wiki":"enwiki","type":"edit","bot":true}`, 100, 100, 100, 100, 100, 100, 400)
+		Expect(raised).Should(HaveLen(4))
+		for _, a := range raised {
+			Expect(a.Kind).Should(Equal(AnomalySpike))
+			Expect(a.Rate).Should(Equal(float64(400)))
+			Expect(a.Baseline).Should(Equal(float64(100)))
+		}
+		// The baseline has moved towards the spike, so it takes a higher rate to remain anomalous
+		active, raised := run(r, `{"wiki":"enwiki","type":"edit","bot":true}`, 1000)
+		Expect(raised).Should(BeEmpty())
+		Expect(active).Should(HaveLen(4))
+		Expect(active[0].Since).Should(Equal(start.Add(6 * time.Minute).Unix()))
+	})
+
+	It("flags a stalled stream", func() {
+		r := NewRates(cfg)
+		active, raised := run(r, `{"wiki":"enwiki"}`, 50, 50, 50, 50, 50, 50, 0)
+		Expect(raised).Should(HaveLen(2))
+		Expect(active[0].Kind).Should(Equal(AnomalyStall))
+	})
+
+	It("ignores steady, low volume and warming up series", func() {
+		r := NewRates(cfg)
+		_, raised := run(r, `{"wiki":"enwiki"}`, 100, 95, 105, 100, 98, 102, 104)
+		Expect(raised).Should(BeEmpty())
+		_, raised = run(NewRates(cfg), `{"wiki":"dewiki"}`, 1, 1, 1, 1, 1, 1, 8)
+		Expect(raised).Should(BeEmpty())
+		_, raised = run(NewRates(cfg), `{"wiki":"frwiki"}`, 100, 400)
+		Expect(raised).Should(BeEmpty())
+	})
+
+	It("tracks at most MaxSeries series", func() {
+		r := NewRates(RateConfig{Interval: time.Minute, Alpha: 0.1, Threshold: 4, MinRate: 10, WarmUp: 5, MaxSeries: 2})
+		r.Observe(parseEvent(`{"wiki":"enwiki","type":"edit"}`))
+		Expect(r.series).Should(HaveLen(2))
+		Expect(r.series).Should(HaveKey("total"))
+		Expect(r.series).Should(HaveKey("wiki:enwiki"))
+	})
+})
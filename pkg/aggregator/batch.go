@@ -0,0 +1,165 @@
+package aggregator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	batchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_batch_size_events",
+			Help:    "Number of events written to Redis per batch",
+			Buckets: []float64{1, 10, 50, 100, 500, 1000, 5000},
+		},
+	)
+
+	flushTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_flush_duration_milliseconds",
+			Help:    "Time taken to write a batch to Redis",
+			Buckets: []float64{1, 5, 10, 50, 100, 500, 1000},
+		},
+	)
+
+	preAggRatio = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_preaggregation_ratio",
+			Help:    "Ratio of Redis writes to increments computed per batch",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		},
+	)
+)
+
+// batch collects the increments of several events so they can be written to Redis in one go
+// Increments to the same key are pre-aggregated locally when the batch is applied.
+// A batch that failed to flush keeps track of the steps already completed, so retrying it neither
+// double-counts increments nor dead-letters a message twice.
+type batch struct {
+	updates    []*Update
+	msgs       []*transport.Message
+	poison     []*poisoned
+	hotPages   []*HotPage
+	increments int
+	started    time.Time
+	applied    bool
+	flagged    bool
+}
+
+// poisoned is a message that cannot be aggregated, together with the reason why
+type poisoned struct {
+	msg *transport.Message
+	err error
+}
+
+func newBatch() *batch {
+	return &batch{}
+}
+
+// add records the update computed for a message
+func (b *batch) add(msg *transport.Message, u *Update) {
+	b.track(msg)
+	b.updates = append(b.updates, u)
+	b.increments += len(u.Increments)
+}
+
+// flag records a page flagged by an event of the batch
+func (b *batch) flag(p *HotPage) {
+	b.hotPages = append(b.hotPages, p)
+}
+
+// reject records a message that cannot be aggregated
+// It is dead-lettered when the batch is flushed, and committed along with the rest of the batch.
+func (b *batch) reject(msg *transport.Message, err error) {
+	b.track(msg)
+	b.poison = append(b.poison, &poisoned{msg: msg, err: err})
+}
+
+func (b *batch) track(msg *transport.Message) {
+	if len(b.msgs) == 0 {
+		b.started = time.Now()
+	}
+	b.msgs = append(b.msgs, msg)
+}
+
+func (b *batch) len() int {
+	return len(b.msgs)
+}
+
+// due reports whether the batch has reached the given size or age
+func (b *batch) due(size int, interval time.Duration) bool {
+	if len(b.msgs) == 0 {
+		return false
+	}
+	return len(b.msgs) >= size || time.Since(b.started) >= interval
+}
+
+// deadline returns the time at which a batch with the given maximum age must be flushed
+func (b *batch) deadline(interval time.Duration) time.Time {
+	return b.started.Add(interval)
+}
+
+// merged returns the pre-aggregated increments of the batch, sorted by key
+func (b *batch) merged() []Increment {
+	return mergeIncrements(b.updates)
+}
+
+// mergeKey identifies the increments of a set of updates that are written as one
+type mergeKey struct {
+	key, value, member, field string
+}
+
+// mergeIncrements pre-aggregates the increments of the updates, sorted by key and then by value, member or field
+// Deltas to the same counter, leaderboard member or cross-tab field are summed, and counters left unchanged dropped.
+// Values added to the same HyperLogLog more than once are added only once.
+func mergeIncrements(updates []*Update) []Increment {
+	merged := make(map[mergeKey]*Increment)
+	for _, u := range updates {
+		for _, inc := range u.Increments {
+			k := mergeKey{key: inc.Key, value: inc.Value, member: inc.Member, field: inc.Field}
+			m, ok := merged[k]
+			if !ok {
+				m = &Increment{Key: inc.Key, Value: inc.Value, Member: inc.Member, Field: inc.Field}
+				merged[k] = m
+			}
+			if inc.Value == "" {
+				m.Delta += inc.Delta
+			}
+			m.TTL = inc.TTL
+			m.Size = inc.Size
+		}
+	}
+	out := make([]Increment, 0, len(merged))
+	for _, m := range merged {
+		if m.counter() && m.Delta == 0 {
+			continue
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		if a.Member != b.Member {
+			return a.Member < b.Member
+		}
+		return a.Field < b.Field
+	})
+	return out
+}
+
+func (b *batch) observe(d time.Duration, written int) {
+	batchSize.Observe(float64(len(b.msgs)))
+	flushTime.Observe(float64(d.Milliseconds()))
+	if b.increments > 0 {
+		preAggRatio.Observe(float64(written) / float64(b.increments))
+	}
+}
@@ -0,0 +1,56 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregation Batch", func() {
+
+	It("pre-aggregates increments to the same key", func() {
+		b := newBatch()
+		b.add(&transport.Message{ID: "1"}, &Update{Increments: []Increment{{Key: "a", Delta: 1}, {Key: "b", Delta: 5}}})
+		b.add(&transport.Message{ID: "2"}, &Update{Increments: []Increment{{Key: "a", Delta: 1}, {Key: "b", Delta: -5}, {Key: "c", Delta: 2}}})
+		Expect(b.len()).Should(Equal(2))
+		Expect(b.increments).Should(Equal(5))
+		Expect(b.merged()).Should(Equal([]Increment{{Key: "a", Delta: 2}, {Key: "c", Delta: 2}}))
+	})
+
+	It("pre-aggregates distinct values, leaderboards and cross-tabs", func() {
+		b := newBatch()
+		b.add(&transport.Message{ID: "1"}, &Update{Increments: []Increment{{Key: "uniq_b", Value: "x"}, {Key: "top_c", Member: "m", Delta: 1, Size: 10}}})
+		b.add(&transport.Message{ID: "2"}, &Update{Increments: []Increment{{Key: "uniq_b", Value: "x"}, {Key: "uniq_b", Value: "y"}, {Key: "top_c", Member: "m", Delta: 2, Size: 10}}})
+		b.add(&transport.Message{ID: "3"}, &Update{Increments: []Increment{{Key: "xtab_d", Field: "f", Delta: 1, Size: 5}, {Key: "xtab_d", Field: "f", Delta: 1, Size: 5}}})
+		Expect(b.merged()).Should(Equal([]Increment{
+			{Key: "top_c", Member: "m", Delta: 3, Size: 10},
+			{Key: "uniq_b", Value: "x"},
+			{Key: "uniq_b", Value: "y"},
+			{Key: "xtab_d", Field: "f", Delta: 2, Size: 5},
+		}))
+		Expect(b.updates[1].Increments).Should(HaveLen(3))
+	})
+
+	It("commits rejected messages without counting them", func() {
+		b := newBatch()
+		b.add(&transport.Message{ID: "1"}, &Update{Increments: []Increment{{Key: "a", Delta: 1}}})
+		b.reject(&transport.Message{ID: "2"}, fmt.Errorf("bad event"))
+		Expect(b.len()).Should(Equal(2))
+		Expect(b.poison).Should(HaveLen(1))
+		Expect(b.poison[0].msg.ID).Should(Equal("2"))
+		Expect(b.merged()).Should(Equal([]Increment{{Key: "a", Delta: 1}}))
+	})
+
+	It("becomes due by size or age", func() {
+		b := newBatch()
+		Expect(b.due(2, time.Hour)).Should(BeFalse())
+		b.add(&transport.Message{ID: "1"}, &Update{})
+		Expect(b.due(2, time.Hour)).Should(BeFalse())
+		Expect(b.due(1, time.Hour)).Should(BeTrue())
+		Expect(b.due(2, 0)).Should(BeTrue())
+	})
+})
@@ -0,0 +1,166 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+)
+
+// DefaultHomeZones maps language codes to the time zone most of their wikis' editors live in
+// Wikis not covered are aligned to UTC.
+var DefaultHomeZones = map[string]string{
+	"ar": "Asia/Riyadh",
+	"cs": "Europe/Prague",
+	"da": "Europe/Copenhagen",
+	"de": "Europe/Berlin",
+	"el": "Europe/Athens",
+	"es": "Europe/Madrid",
+	"fa": "Asia/Tehran",
+	"fi": "Europe/Helsinki",
+	"fr": "Europe/Paris",
+	"he": "Asia/Jerusalem",
+	"hu": "Europe/Budapest",
+	"id": "Asia/Jakarta",
+	"it": "Europe/Rome",
+	"ja": "Asia/Tokyo",
+	"ko": "Asia/Seoul",
+	"nl": "Europe/Amsterdam",
+	"no": "Europe/Oslo",
+	"pl": "Europe/Warsaw",
+	"pt": "America/Sao_Paulo",
+	"ro": "Europe/Bucharest",
+	"ru": "Europe/Moscow",
+	"sv": "Europe/Stockholm",
+	"th": "Asia/Bangkok",
+	"tr": "Europe/Istanbul",
+	"uk": "Europe/Kiev",
+	"vi": "Asia/Ho_Chi_Minh",
+	"zh": "Asia/Shanghai",
+}
+
+// wikiFamilies are the suffixes of wiki database names that follow the language code
+var wikiFamilies = []string{"wiktionary", "wikibooks", "wikinews", "wikiquote", "wikisource", "wikiversity", "wikivoyage", "wiki"}
+
+// LoadHomeZones returns the home time zone lookup for wikis
+// An empty path yields the DefaultHomeZones, otherwise the file must hold a JSON object mapping
+// wiki database names (e.g. dewiki) or language codes (e.g. de) to IANA time zone names.
+func LoadHomeZones(path string) (*HomeZones, error) {
+	names := DefaultHomeZones
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read home time zones file: %v", err)
+		}
+		names = make(map[string]string)
+		err = json.Unmarshal(data, &names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse home time zones file: %v", err)
+		}
+	}
+	h := &HomeZones{zones: make(map[string]*bucket.Zone)}
+	for k, name := range names {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %s for %s: %v", name, k, err)
+		}
+		h.zones[k] = &bucket.Zone{Tag: bucket.HomeTag, Location: loc}
+	}
+	return h, nil
+}
+
+// HomeZone returns the zone a wiki's buckets are aligned to, looked up by database name and then by language code
+func (h *HomeZones) HomeZone(wiki string) *bucket.Zone {
+	if z, ok := h.zones[wiki]; ok {
+		return z
+	}
+	for _, f := range wikiFamilies {
+		if strings.HasSuffix(wiki, f) {
+			if z, ok := h.zones[strings.TrimSuffix(wiki, f)]; ok {
+				return z
+			}
+			break
+		}
+	}
+	return homeUTC
+}
+
+// homeUTC is the home zone of wikis without a configured zone
+var homeUTC = &bucket.Zone{Tag: bucket.HomeTag, Location: time.UTC}
+
+// DefaultBucketing keeps counters in UTC day buckets only
+func DefaultBucketing() *Bucketing {
+	return &Bucketing{Resolutions: []*bucket.Resolution{bucket.Day}, Zones: []*bucket.Zone{bucket.UTC}}
+}
+
+// Buckets returns the buckets an event that occurred at t counts towards
+// Calendar resolutions are expanded to one bucket per zone, plus one in the wiki's home zone if enabled.
+func (bk *Bucketing) Buckets(t time.Time, wiki string) []bucket.Bucket {
+	var out []bucket.Bucket
+	for _, r := range bk.Resolutions {
+		if !r.Calendar() {
+			out = append(out, r.At(t))
+			continue
+		}
+		for _, z := range bk.Zones {
+			out = append(out, r.In(z).At(t))
+		}
+		if bk.Home != nil {
+			out = append(out, r.In(bk.Home.HomeZone(wiki)).At(t))
+		}
+	}
+	return out
+}
+
+// Aligned returns every combination of resolution and zone, i.e. each distinct family of bucket keys written
+// Buckets in wikis' home zones are not included.
+func (bk *Bucketing) Aligned() []*bucket.Resolution {
+	var out []*bucket.Resolution
+	for _, r := range bk.Resolutions {
+		if !r.Calendar() {
+			out = append(out, r)
+			continue
+		}
+		for _, z := range bk.Zones {
+			out = append(out, r.In(z))
+		}
+	}
+	return out
+}
+
+// Families returns every resolution in every zone, including the home zone if enabled, from finest to coarsest
+// Unlike Aligned, it includes resolutions counters are not kept in, with their default TTL.
+func (bk *Bucketing) Families() []*bucket.Resolution {
+	zones := bk.Zones
+	if bk.Home != nil {
+		zones = append(append([]*bucket.Zone{}, zones...), homeUTC)
+	}
+	var out []*bucket.Resolution
+	for _, name := range bucket.Names() {
+		res := bk.live(name)
+		if res == nil {
+			res, _ = bucket.Lookup(name)
+		}
+		if !res.Calendar() {
+			out = append(out, res)
+			continue
+		}
+		for _, z := range zones {
+			out = append(out, res.In(z))
+		}
+	}
+	return out
+}
+
+// live returns the resolution with the given name if counters are kept in it, or nil
+func (bk *Bucketing) live(name string) *bucket.Resolution {
+	for _, r := range bk.Resolutions {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
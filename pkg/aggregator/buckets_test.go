@@ -0,0 +1,51 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bucketing", func() {
+
+	late := time.Date(2020, 8, 10, 23, 30, 0, 0, time.UTC)
+
+	It("aligns calendar buckets to every zone", func() {
+		zones, err := bucket.ParseZones("UTC,Asia/Tokyo")
+		Expect(err).NotTo(HaveOccurred())
+		bk := &Bucketing{Resolutions: []*bucket.Resolution{bucket.Hour, bucket.Day}, Zones: zones}
+		var prefixes []string
+		for _, b := range bk.Buckets(late, "enwiki") {
+			prefixes = append(prefixes, b.Prefix())
+		}
+		Expect(prefixes).Should(Equal([]string{"hour_443639_", "day_18484_", "day.Asia/Tokyo_18485_"}))
+		Expect(bk.Aligned()).Should(HaveLen(3))
+	})
+
+	It("aligns calendar buckets to the home zone of the wiki", func() {
+		home, err := LoadHomeZones("")
+		Expect(err).NotTo(HaveOccurred())
+		bk := &Bucketing{Resolutions: []*bucket.Resolution{bucket.Day}, Zones: []*bucket.Zone{bucket.UTC}, Home: home}
+		buckets := bk.Buckets(late, "dewiktionary")
+		Expect(buckets).Should(HaveLen(2))
+		Expect(buckets[1].Prefix()).Should(Equal("day.home_18485_"))
+		Expect(buckets[1].Resolution.Zone.Location.String()).Should(Equal("Europe/Berlin"))
+		Expect(bk.Buckets(late, "enwiki")[1].Prefix()).Should(Equal("day.home_18484_"))
+	})
+
+	It("lists every resolution in every zone", func() {
+		bk := &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Day},
+			Zones:       []*bucket.Zone{bucket.UTC},
+			Home:        &HomeZones{},
+		}
+		var tags []string
+		for _, r := range bk.Families() {
+			tags = append(tags, r.Tag())
+		}
+		Expect(tags).Should(Equal([]string{"minute", "hour", "day", "day.home", "week", "week.home", "month", "month.home"}))
+	})
+})
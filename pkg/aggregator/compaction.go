@@ -0,0 +1,347 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// compactionChunk is the number of keys rolled up or deleted together
+	compactionChunk = 500
+	// memorySamples is the number of keys per resolution whose memory usage is measured to estimate the total
+	memorySamples = 100
+)
+
+// DefaultCompactionConfig measures buckets hourly, but neither rolls them up nor deletes them
+var DefaultCompactionConfig = CompactionConfig{
+	Interval: time.Hour,
+}
+
+var (
+	bucketKeys = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_bucket_keys",
+			Help: "Number of Redis keys held by the buckets of each resolution, as of the latest compaction",
+		},
+		[]string{"resolution"},
+	)
+
+	bucketMemory = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_bucket_memory_bytes",
+			Help: "Approximate memory used by the buckets of each resolution, estimated from a sample of their keys",
+		},
+		[]string{"resolution"},
+	)
+
+	bucketsCompacted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_buckets_compacted_total",
+			Help: "Number of buckets rolled up into coarser ones or deleted as they exceeded their retention",
+		},
+		[]string{"resolution", "action"},
+	)
+)
+
+// rollupScript adds counters to those of coarser buckets and deletes them
+// KEYS are keys of a bucket, followed by the keys to add each of them to: those of the first key in each target
+// bucket, then those of the second key and so on. ARGV holds the bucket's key prefix, DistinctPrefix, CrosstabPrefix
+// and CrosstabOther, followed by the TTL of each target bucket. Counters are added, HyperLogLogs merged, sorted sets
+// summed and kept at the larger of both sizes, and hash fields summed. Cross-tabs are capped at the larger of both
+// sizes as well, counting fields beyond it in CrosstabOther. Keys that no longer exist, e.g. because another
+// aggregator rolled them up already, are skipped.
+var rollupScript = redis.NewScript(`
+local src, distinct, xtab, other = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+local targets = #ARGV - 4
+local n = #KEYS / (targets + 1)
+for s = 1, n do
+	local k = KEYS[s]
+	local name = string.sub(k, #src + 1)
+	local t = redis.call("TYPE", k).ok
+	if t ~= "none" then
+		for j = 1, targets do
+			local dest, ttl = KEYS[n + (s - 1) * targets + j], tonumber(ARGV[4 + j])
+			local existed = redis.call("EXISTS", dest) == 1
+			if t == "string" and string.sub(name, 1, #distinct) == distinct then
+				redis.call("PFMERGE", dest, k)
+			elseif t == "string" then
+				redis.call("INCRBY", dest, redis.call("GET", k))
+			elseif t == "zset" then
+				local size = math.max(redis.call("ZCARD", dest), redis.call("ZCARD", k))
+				redis.call("ZUNIONSTORE", dest, 2, dest, k)
+				redis.call("ZREMRANGEBYRANK", dest, 0, -size - 1)
+			elseif t == "hash" then
+				local size = math.huge
+				if string.sub(name, 1, #xtab) == xtab then
+					size = math.max(redis.call("HLEN", dest), redis.call("HLEN", k))
+				end
+				local fields = redis.call("HGETALL", k)
+				for f = 1, #fields, 2 do
+					local field = fields[f]
+					if redis.call("HEXISTS", dest, field) == 0 and redis.call("HLEN", dest) >= size then
+						field = other
+					end
+					redis.call("HINCRBY", dest, field, fields[f+1])
+				end
+			end
+			if not existed and ttl > 0 then
+				redis.call("EXPIRE", dest, ttl)
+			end
+		end
+		redis.call("DEL", k)
+	end
+end
+return 0
+`)
+
+// NewCompactor returns a Compactor for the buckets counters are kept in
+func NewCompactor(r *redis.Client, bk *Bucketing, cfg CompactionConfig) *Compactor {
+	if bk == nil {
+		bk = DefaultBucketing()
+	}
+	return &Compactor{cfg: cfg, r: r, buckets: bk}
+}
+
+// Compact rolls up and deletes the buckets due at now, then records the number of keys and memory of each resolution
+// Buckets of every resolution are considered in the configured zones, including resolutions the aggregator
+// does not keep (anymore), so their buckets still expire. Buckets and their counters are listed from the bucket
+// index, which also covers the late_ copies of buckets, so Redis is never scanned.
+func (c *Compactor) Compact(ctx context.Context, now time.Time) error {
+	for _, res := range c.buckets.Families() {
+		var kept []*indexedBucket
+		for _, prefix := range []string{"", latePrefix} {
+			ids, err := c.r.ZRange(ctx, prefix+res.IndexKey(), 0, -1).Result()
+			if err != nil {
+				return fmt.Errorf("failed to list %s%s buckets: %v", prefix, res.Tag(), err)
+			}
+			for _, m := range ids {
+				id, err := strconv.ParseInt(m, 10, 64)
+				if err != nil {
+					continue
+				}
+				b := res.Bucket(id)
+				targets, due := c.rollupTargets(b, now)
+				if !due && !c.expired(b, now) {
+					kept = append(kept, &indexedBucket{bucket: b, prefix: prefix})
+					continue
+				}
+				names, err := c.r.SMembers(ctx, prefix+b.IndexKey()).Result()
+				if err != nil {
+					return fmt.Errorf("failed to list counters of %s%s bucket %d: %v", prefix, res.Tag(), id, err)
+				}
+				if due {
+					err = c.rollUp(ctx, prefix, b, targets, names)
+					if err != nil {
+						return fmt.Errorf("failed to roll up %s%s bucket %d: %v", prefix, res.Tag(), id, err)
+					}
+					bucketsCompacted.WithLabelValues(res.Tag(), "rollup").Inc()
+					continue
+				}
+				err = c.delete(ctx, prefix, b, names)
+				if err != nil {
+					return fmt.Errorf("failed to delete %s%s bucket %d: %v", prefix, res.Tag(), id, err)
+				}
+				bucketsCompacted.WithLabelValues(res.Tag(), "expire").Inc()
+			}
+		}
+		err := c.forgetFinalized(ctx, res, now)
+		if err != nil {
+			return err
+		}
+		keys, mem, err := c.measure(ctx, kept)
+		if err != nil {
+			logger.Warningf("Failed to measure %s buckets: %v", res.Tag(), err)
+			continue
+		}
+		bucketKeys.WithLabelValues(res.Tag()).Set(float64(keys))
+		bucketMemory.WithLabelValues(res.Tag()).Set(float64(mem))
+	}
+	return nil
+}
+
+// rollupTargets returns the buckets a day bucket is rolled up into, and whether it is due to be rolled up at now
+// Day buckets are rolled up into their week and month buckets, unless the aggregator keeps those itself and they
+// already hold the day's counts. A day that is due is deleted afterwards, even if there is nothing to roll it up into.
+func (c *Compactor) rollupTargets(b bucket.Bucket, now time.Time) ([]bucket.Bucket, bool) {
+	if c.cfg.RollupAfter <= 0 || b.Resolution.Name != bucket.Day.Name || b.End().After(now.Add(-c.cfg.RollupAfter)) {
+		return nil, false
+	}
+	var out []bucket.Bucket
+	for _, r := range []*bucket.Resolution{bucket.Week, bucket.Month} {
+		if c.buckets.live(r.Name) != nil {
+			continue
+		}
+		out = append(out, r.In(b.Resolution.Zone).At(b.Start()))
+	}
+	return out, true
+}
+
+// expired reports whether a bucket ended longer ago than the retention of its resolution at now
+func (c *Compactor) expired(b bucket.Bucket, now time.Time) bool {
+	d, ok := c.cfg.Retention[b.Resolution.Name]
+	return ok && d > 0 && !b.End().After(now.Add(-d))
+}
+
+// rollUp adds the counters with the given names of a bucket, or of its copy whose keys carry prefix, to the target
+// buckets and deletes them, a chunk at a time, then moves the counters to the targets in the bucket index. Each chunk
+// is rolled up and deleted atomically, so an interrupted rollup never counts a key twice.
+func (c *Compactor) rollUp(ctx context.Context, prefix string, b bucket.Bucket, targets []bucket.Bucket, names []string) error {
+	src := prefix + b.Prefix()
+	args := []interface{}{src, DistinctPrefix, CrosstabPrefix, CrosstabOther}
+	for _, t := range targets {
+		args = append(args, int64(t.Resolution.TTL.Seconds()))
+	}
+	for _, chunk := range chunks(names, compactionChunk) {
+		keys := make([]string, 0, len(chunk)*(len(targets)+1))
+		for _, n := range chunk {
+			keys = append(keys, src+n)
+		}
+		for _, n := range chunk {
+			for _, t := range targets {
+				keys = append(keys, prefix+t.Prefix()+n)
+			}
+		}
+		err := rollupScript.Run(ctx, c.r, keys, args...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	ix := make(bucketIndex)
+	for _, t := range targets {
+		ix.addPrefixed(prefix, t, names...)
+	}
+	_, err := c.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		ix.write(ctx, pipe, time.Now())
+		unindex(ctx, pipe, prefix, b)
+		return nil
+	})
+	return err
+}
+
+// delete deletes the counters with the given names of a bucket, or of its copy whose keys carry prefix, a chunk at
+// a time, and removes it from the bucket index
+func (c *Compactor) delete(ctx context.Context, prefix string, b bucket.Bucket, names []string) error {
+	for _, chunk := range chunks(names, compactionChunk) {
+		keys := make([]string, len(chunk))
+		for i, n := range chunk {
+			keys[i] = prefix + b.Prefix() + n
+		}
+		err := c.r.Del(ctx, keys...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := c.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		unindex(ctx, pipe, prefix, b)
+		return nil
+	})
+	return err
+}
+
+// chunks splits keys into slices of at most n keys
+func chunks(keys []string, n int) [][]string {
+	var out [][]string
+	for len(keys) > n {
+		out = append(out, keys[:n])
+		keys = keys[n:]
+	}
+	if len(keys) > 0 {
+		out = append(out, keys)
+	}
+	return out
+}
+
+// forgetFinalized removes the buckets that are due to be rolled up or deleted at now from the finalized set of a resolution
+func (c *Compactor) forgetFinalized(ctx context.Context, res *bucket.Resolution, now time.Time) error {
+	d := c.cfg.Retention[res.Name]
+	if res.Name == bucket.Day.Name && c.cfg.RollupAfter > 0 && (d <= 0 || c.cfg.RollupAfter < d) {
+		d = c.cfg.RollupAfter
+	}
+	if d <= 0 {
+		return nil
+	}
+	cutoff := res.At(now.Add(-d)).ID
+	err := c.r.ZRemRangeByScore(ctx, res.FinalizedKey(), "-inf", "("+strconv.FormatInt(cutoff, 10)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to forget finalized %s buckets: %v", res.Tag(), err)
+	}
+	return nil
+}
+
+// measure returns the number of keys of the given buckets as recorded in the bucket index, and estimates their memory
+// from the usage of one random key of up to memorySamples of the buckets, spread evenly
+func (c *Compactor) measure(ctx context.Context, buckets []*indexedBucket) (int64, int64, error) {
+	if len(buckets) == 0 {
+		return 0, 0, nil
+	}
+	counts := make([]*redis.IntCmd, len(buckets))
+	step := (len(buckets) + memorySamples - 1) / memorySamples
+	var samples []*redis.StringCmd
+	var sampled []*indexedBucket
+	_, err := c.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, e := range buckets {
+			counts[i] = pipe.SCard(ctx, e.prefix+e.bucket.IndexKey())
+			if i%step == 0 {
+				samples = append(samples, pipe.SRandMember(ctx, e.prefix+e.bucket.IndexKey()))
+				sampled = append(sampled, e)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	var keys int64
+	for _, cmd := range counts {
+		keys += cmd.Val()
+	}
+	var usage []*redis.IntCmd
+	_, err = c.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, cmd := range samples {
+			if name := cmd.Val(); name != "" {
+				usage = append(usage, pipe.MemoryUsage(ctx, sampled[i].prefix+sampled[i].bucket.Prefix()+name))
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return keys, 0, err
+	}
+	if len(usage) == 0 {
+		return keys, 0, nil
+	}
+	var sum int64
+	for _, cmd := range usage {
+		sum += cmd.Val()
+	}
+	return keys, sum * keys / int64(len(usage)), nil
+}
+
+// compact compacts buckets every compaction interval until the aggregator stops
+func (a *Aggregator) compact() {
+	if a.compactor == nil {
+		return
+	}
+	t := time.NewTicker(a.compactor.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case now := <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), a.compactor.cfg.Interval)
+			err := a.compactor.Compact(ctx, now)
+			cancel()
+			if err != nil {
+				logger.Errorf("Failed to compact buckets: %v", err)
+			}
+		}
+	}
+}
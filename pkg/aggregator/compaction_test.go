@@ -0,0 +1,59 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compaction", func() {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	day := bucket.Day.At(time.Date(2020, 8, 10, 0, 0, 0, 0, time.UTC))
+
+	It("rolls up old days into the week and month buckets not kept", func() {
+		c := NewCompactor(nil, &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Hour, bucket.Day, bucket.Week},
+			Zones:       []*bucket.Zone{bucket.UTC},
+		}, CompactionConfig{RollupAfter: 30 * 24 * time.Hour})
+		targets, ok := c.rollupTargets(day, now)
+		Expect(ok).To(BeTrue())
+		Expect(targets).Should(HaveLen(1))
+		Expect(targets[0].Prefix()).Should(Equal("month_202008_"))
+
+		_, ok = c.rollupTargets(bucket.Day.At(now.Add(-24*time.Hour)), now)
+		Expect(ok).To(BeFalse())
+		_, ok = c.rollupTargets(bucket.Week.At(day.Start()), now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rolls up days in their own time zone", func() {
+		berlin, err := bucket.LoadZone("Europe/Berlin")
+		Expect(err).NotTo(HaveOccurred())
+		c := NewCompactor(nil, &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Day},
+			Zones:       []*bucket.Zone{berlin},
+		}, CompactionConfig{RollupAfter: 24 * time.Hour})
+		targets, ok := c.rollupTargets(bucket.Day.In(berlin).Bucket(18474), now)
+		Expect(ok).To(BeTrue())
+		Expect(targets).Should(HaveLen(2))
+		Expect(targets[0].Prefix()).Should(Equal("week.Europe/Berlin_202031_"))
+		Expect(targets[1].Prefix()).Should(Equal("month.Europe/Berlin_202007_"))
+	})
+
+	It("expires buckets past the retention of their resolution", func() {
+		c := NewCompactor(nil, nil, CompactionConfig{Retention: map[string]time.Duration{"day": 7 * 24 * time.Hour}})
+		Expect(c.expired(day, now)).To(BeTrue())
+		Expect(c.expired(bucket.Day.At(now.Add(-6*24*time.Hour)), now)).To(BeFalse())
+		Expect(c.expired(bucket.Week.At(day.Start()), now)).To(BeFalse())
+		_, ok := c.rollupTargets(day, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("splits keys into chunks", func() {
+		Expect(chunks([]string{"a", "b", "c"}, 2)).Should(Equal([][]string{{"a", "b"}, {"c"}}))
+		Expect(chunks(nil, 2)).Should(BeEmpty())
+	})
+})
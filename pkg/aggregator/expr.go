@@ -0,0 +1,622 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expr is a compiled rule expression that can be evaluated against a parsed event
+//
+// Expressions support field lookups using dotted paths (e.g. length.new), string, number and boolean
+// literals, the operators ! && || == != < <= > >= + - * /, parentheses and function calls (see ExprFuncs).
+// Missing fields evaluate to null, which counts as 0 in arithmetic and as false in conditions.
+type Expr interface {
+	Eval(event map[string]interface{}) (interface{}, error)
+	String() string
+}
+
+// ExprFunc is a function that can be called from rule expressions
+type ExprFunc func(args ...interface{}) (interface{}, error)
+
+// ExprFuncs holds the functions available to rule expressions, keyed by name
+// The signal functions (see signalFuncs) are added to them, using DefaultSignals. Rule sets use their own signals instead.
+var ExprFuncs = map[string]ExprFunc{
+	"len": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len expects 1 argument, got %d", len(args))
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return float64(0), nil
+	},
+	"lower": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("lower expects 1 argument, got %d", len(args))
+		}
+		return strings.ToLower(toString(args[0])), nil
+	},
+	"abs": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("abs expects 1 argument, got %d", len(args))
+		}
+		return math.Abs(toNumber(args[0])), nil
+	},
+	"matches": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("matches expects 2 arguments, got %d", len(args))
+		}
+		re, err := cachedRegexp(toString(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(toString(args[0])), nil
+	},
+	"nsname": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("nsname expects 1 argument, got %d", len(args))
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		ns := int(toNumber(args[0]))
+		if name, ok := NamespaceNames[ns]; ok {
+			return name, nil
+		}
+		return strconv.Itoa(ns), nil
+	},
+	"is_ip": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("is_ip expects 1 argument, got %d", len(args))
+		}
+		return net.ParseIP(toString(args[0])) != nil, nil
+	},
+}
+
+// NamespaceNames are the canonical names of the namespaces common to all MediaWiki installations and
+// of the most widespread extension namespaces. Talk namespaces are named after their subject namespace.
+var NamespaceNames = map[int]string{
+	-2:   "Media",
+	-1:   "Special",
+	0:    "Main",
+	1:    "Talk",
+	2:    "User",
+	3:    "User_talk",
+	4:    "Project",
+	5:    "Project_talk",
+	6:    "File",
+	7:    "File_talk",
+	8:    "MediaWiki",
+	9:    "MediaWiki_talk",
+	10:   "Template",
+	11:   "Template_talk",
+	12:   "Help",
+	13:   "Help_talk",
+	14:   "Category",
+	15:   "Category_talk",
+	100:  "Portal",
+	101:  "Portal_talk",
+	118:  "Draft",
+	119:  "Draft_talk",
+	120:  "Property",
+	121:  "Property_talk",
+	828:  "Module",
+	829:  "Module_talk",
+	2300: "Gadget",
+	2301: "Gadget_talk",
+	2302: "Gadget_definition",
+	2303: "Gadget_definition_talk",
+}
+
+var (
+	regexpMu    sync.Mutex
+	regexpCache = make(map[string]*regexp.Regexp)
+)
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpMu.Lock()
+	defer regexpMu.Unlock()
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// ParseExpr compiles a rule expression
+func ParseExpr(src string) (Expr, error) {
+	return parseExpr(src, ExprFuncs)
+}
+
+// parseExpr compiles an expression calling the given functions
+func parseExpr(src string, funcs map[string]ExprFunc) (Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, funcs: funcs}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d in %q", p.peek().text, p.peek().pos, src)
+	}
+	return e, nil
+}
+
+// Truthy reports whether an expression result counts as true in a condition
+func Truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+func toNumber(v interface{}) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case bool:
+		if t {
+			return 1
+		}
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		if err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "*", "/", "(", ")", ","}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			j := i + 1
+			var sb strings.Builder
+			for j < len(src) && rune(src[j]) != c {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				// quotes and backslashes are ASCII, so the bytes of other characters are copied unchanged
+				sb.WriteByte(src[j])
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d in %q", i, src)
+			}
+			toks = append(toks, token{tokString, sb.String(), i})
+			i = j + 1
+		case c < utf8.RuneSelf && isDigit(byte(c)):
+			j := i
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_' || c == '$':
+			j := i
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '$' && r != '.' {
+					break
+				}
+				j += n
+			}
+			toks = append(toks, token{tokIdent, src[i:j], i})
+			i = j
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d in %q", c, i, src)
+			}
+		}
+	}
+	return append(toks, token{tokEOF, "end of expression", len(src)}), nil
+}
+
+// isDigit reports whether b is an ASCII digit, the only digits numbers are parsed from
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	funcs map[string]ExprFunc
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) acceptOp(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseBinary(next func() (Expr, error), ops ...string) (Expr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.acceptOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	return p.parseBinary(p.parseAdditive, "==", "!=", "<=", ">=", "<", ">")
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if op, ok := p.acceptOp("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return &literalExpr{f}, nil
+	case tokString:
+		return &literalExpr{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalExpr{true}, nil
+		case "false":
+			return &literalExpr{false}, nil
+		case "null":
+			return &literalExpr{nil}, nil
+		}
+		if _, ok := p.acceptOp("("); ok {
+			return p.parseCall(t)
+		}
+		return &fieldExpr{path: strings.Split(t.text, ".")}, nil
+	case tokOp:
+		if t.text == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.acceptOp(")"); !ok {
+				return nil, fmt.Errorf("missing ) at offset %d", p.peek().pos)
+			}
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	fn, ok := p.funcs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at offset %d", name.text, name.pos)
+	}
+	call := &callExpr{name: name.text, fn: fn}
+	if _, ok := p.acceptOp(")"); ok {
+		return call, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if _, ok := p.acceptOp(","); ok {
+			continue
+		}
+		if _, ok := p.acceptOp(")"); ok {
+			return call, nil
+		}
+		return nil, fmt.Errorf("expected , or ) at offset %d", p.peek().pos)
+	}
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) Eval(event map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+func (e *literalExpr) String() string {
+	if s, ok := e.value.(string); ok {
+		return strconv.Quote(s)
+	}
+	if e.value == nil {
+		return "null"
+	}
+	return toString(e.value)
+}
+
+type fieldExpr struct {
+	path []string
+}
+
+func (e *fieldExpr) Eval(event map[string]interface{}) (interface{}, error) {
+	var cur interface{} = event
+	for _, p := range e.path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		cur = m[p]
+	}
+	return cur, nil
+}
+
+func (e *fieldExpr) String() string {
+	return strings.Join(e.path, ".")
+}
+
+type unaryExpr struct {
+	op      string
+	operand Expr
+}
+
+func (e *unaryExpr) Eval(event map[string]interface{}) (interface{}, error) {
+	v, err := e.operand.Eval(event)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "!" {
+		return !Truthy(v), nil
+	}
+	return -toNumber(v), nil
+}
+
+func (e *unaryExpr) String() string {
+	return e.op + e.operand.String()
+}
+
+type binaryExpr struct {
+	op          string
+	left, right Expr
+}
+
+func (e *binaryExpr) Eval(event map[string]interface{}) (interface{}, error) {
+	l, err := e.left.Eval(event)
+	if err != nil {
+		return nil, err
+	}
+	// short-circuit boolean operators
+	switch e.op {
+	case "&&":
+		if !Truthy(l) {
+			return false, nil
+		}
+	case "||":
+		if Truthy(l) {
+			return true, nil
+		}
+	}
+	r, err := e.right.Eval(event)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "&&", "||":
+		return Truthy(r), nil
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		return compare(e.op, l, r), nil
+	case "+":
+		if ls, ok := l.(string); ok {
+			return ls + toString(r), nil
+		}
+		return toNumber(l) + toNumber(r), nil
+	case "-":
+		return toNumber(l) - toNumber(r), nil
+	case "*":
+		return toNumber(l) * toNumber(r), nil
+	case "/":
+		d := toNumber(r)
+		if d == 0 {
+			return nil, fmt.Errorf("division by zero in %s", e)
+		}
+		return toNumber(l) / d, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func (e *binaryExpr) String() string {
+	return "(" + e.left.String() + " " + e.op + " " + e.right.String() + ")"
+}
+
+func equal(l, r interface{}) bool {
+	_, lnum := l.(float64)
+	_, rnum := r.(float64)
+	if lnum || rnum {
+		return l != nil && r != nil && toNumber(l) == toNumber(r)
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		return ls == rs
+	}
+	lb, lok := l.(bool)
+	rb, rok := r.(bool)
+	if lok && rok {
+		return lb == rb
+	}
+	return l == nil && r == nil
+}
+
+func compare(op string, l, r interface{}) bool {
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs
+		case "<=":
+			return ls <= rs
+		case ">":
+			return ls > rs
+		}
+		return ls >= rs
+	}
+	lf, rf := toNumber(l), toNumber(r)
+	switch op {
+	case "<":
+		return lf < rf
+	case "<=":
+		return lf <= rf
+	case ">":
+		return lf > rf
+	}
+	return lf >= rf
+}
+
+type callExpr struct {
+	name string
+	fn   ExprFunc
+	args []Expr
+}
+
+func (e *callExpr) Eval(event map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, a := range e.args {
+		v, err := a.Eval(event)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return e.fn(args...)
+}
+
+func (e *callExpr) String() string {
+	args := make([]string, len(e.args))
+	for i, a := range e.args {
+		args[i] = a.String()
+	}
+	return e.name + "(" + strings.Join(args, ", ") + ")"
+}
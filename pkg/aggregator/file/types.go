@@ -1,20 +0,0 @@
-package file
-
-import (
-	"github.com/gargath/pleiades/pkg/util"
-	"github.com/go-redis/redis/v8"
-)
-
-// Aggregator is an aggregator implementation that reads from the filesystem
-type Aggregator struct {
-	File    *Opts
-	stop    chan (bool)
-	Redis   *util.RedisOpts
-	r       *redis.Client
-	spinner *util.Spinner
-}
-
-// Opts hold config options for the file publisher
-type Opts struct {
-	Source string
-}
@@ -0,0 +1,285 @@
+package aggregator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileStoreDB is the name of the bbolt database of a FileStore in its directory
+const fileStoreDB = "counters.db"
+
+var (
+	// Buckets of the database of a FileStore, one per type of key
+	countersBucket = []byte("counters")
+	logsBucket     = []byte("logs")
+	sortedBucket   = []byte("sorted")
+	hashesBucket   = []byte("hashes")
+	setsBucket     = []byte("sets")
+	expiresBucket  = []byte("expires")
+
+	keyBuckets = [][]byte{countersBucket, logsBucket, sortedBucket, hashesBucket, setsBucket, expiresBucket}
+)
+
+// OpenFileStore opens the FileStore in dir, creating it if it does not exist
+// Only one process can open the store at a time. Event IDs are remembered for replayWindow to detect replays of events
+// without a partition offset. Zero disables this.
+func OpenFileStore(dir string, replayWindow time.Duration) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store directory %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, fileStoreDB)
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("failed to open %s: it is open in another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range keyBuckets {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets in %s: %v", path, err)
+	}
+	f := &FileStore{db: db}
+	f.keyStore = newKeyStore(f, replayWindow)
+	return f, nil
+}
+
+// view runs fn in a read-only transaction, alongside other reads and the current write
+func (f *FileStore) view(fn func(ks keyspace)) error {
+	return f.db.View(func(tx *bolt.Tx) error {
+		ks := &boltKeyspace{tx: tx}
+		fn(ks)
+		return ks.err
+	})
+}
+
+// update runs fn in a read-write transaction, which is committed and synced unless a write failed
+func (f *FileStore) update(fn func(ks keyspace)) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		ks := &boltKeyspace{tx: tx}
+		fn(ks)
+		return ks.err
+	})
+}
+
+// Close closes the database, waiting for running transactions to end
+func (f *FileStore) Close() error {
+	return f.db.Close()
+}
+
+// fail keeps err as the error of the transaction, unless there is one already
+func (b *boltKeyspace) fail(err error) {
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+// nested returns the bucket of the sorted set, hash or set at key in parent, creating it if create is set
+// It returns nil if the bucket does not exist and is not created.
+func (b *boltKeyspace) nested(parent []byte, key string, create bool) *bolt.Bucket {
+	p := b.tx.Bucket(parent)
+	if !create {
+		return p.Bucket([]byte(key))
+	}
+	n, err := p.CreateBucketIfNotExists([]byte(key))
+	b.fail(err)
+	return n
+}
+
+func (b *boltKeyspace) counter(key string) (int64, bool) {
+	v := b.tx.Bucket(countersBucket).Get([]byte(key))
+	if v == nil {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), true
+}
+
+func (b *boltKeyspace) setCounter(key string, v int64) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	b.fail(b.tx.Bucket(countersBucket).Put([]byte(key), buf))
+}
+
+func (b *boltKeyspace) log(key string) *hyperLogLog {
+	v := b.tx.Bucket(logsBucket).Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	h := &hyperLogLog{}
+	err := h.UnmarshalBinary(v)
+	if err != nil {
+		b.fail(fmt.Errorf("failed to decode %s: %v", key, err))
+		return nil
+	}
+	return h
+}
+
+func (b *boltKeyspace) setLog(key string, h *hyperLogLog) {
+	v, err := h.MarshalBinary()
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	b.fail(b.tx.Bucket(logsBucket).Put([]byte(key), v))
+}
+
+func (b *boltKeyspace) sorted(key string) map[string]float64 {
+	n := b.nested(sortedBucket, key, false)
+	if n == nil {
+		return nil
+	}
+	out := make(map[string]float64)
+	b.fail(n.ForEach(func(m, v []byte) error {
+		out[string(m)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+		return nil
+	}))
+	return out
+}
+
+func (b *boltKeyspace) zscore(key string, member string) (float64, bool) {
+	n := b.nested(sortedBucket, key, false)
+	if n == nil {
+		return 0, false
+	}
+	v := n.Get([]byte(member))
+	if v == nil {
+		return 0, false
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(v)), true
+}
+
+func (b *boltKeyspace) zadd(key string, member string, score float64) {
+	n := b.nested(sortedBucket, key, true)
+	if n == nil {
+		return
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(score))
+	b.fail(n.Put([]byte(member), buf))
+}
+
+func (b *boltKeyspace) zrem(key string, member string) {
+	if n := b.nested(sortedBucket, key, false); n != nil {
+		b.fail(n.Delete([]byte(member)))
+	}
+}
+
+func (b *boltKeyspace) hash(key string) map[string]string {
+	n := b.nested(hashesBucket, key, false)
+	if n == nil {
+		return nil
+	}
+	out := make(map[string]string)
+	b.fail(n.ForEach(func(f, v []byte) error {
+		out[string(f)] = string(v)
+		return nil
+	}))
+	return out
+}
+
+func (b *boltKeyspace) hget(key string, field string) (string, bool) {
+	n := b.nested(hashesBucket, key, false)
+	if n == nil {
+		return "", false
+	}
+	v := n.Get([]byte(field))
+	if v == nil {
+		return "", false
+	}
+	return string(v), true
+}
+
+func (b *boltKeyspace) hset(key string, field string, v string) {
+	if n := b.nested(hashesBucket, key, true); n != nil {
+		b.fail(n.Put([]byte(field), []byte(v)))
+	}
+}
+
+func (b *boltKeyspace) hdel(key string, field string) {
+	if n := b.nested(hashesBucket, key, false); n != nil {
+		b.fail(n.Delete([]byte(field)))
+	}
+}
+
+func (b *boltKeyspace) hlen(key string) int {
+	n := b.nested(hashesBucket, key, false)
+	if n == nil {
+		return 0
+	}
+	count := 0
+	c := n.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+	return count
+}
+
+func (b *boltKeyspace) members(key string) []string {
+	n := b.nested(setsBucket, key, false)
+	if n == nil {
+		return nil
+	}
+	var out []string
+	b.fail(n.ForEach(func(m, _ []byte) error {
+		out = append(out, string(m))
+		return nil
+	}))
+	return out
+}
+
+func (b *boltKeyspace) sadd(key string, member string) {
+	if n := b.nested(setsBucket, key, true); n != nil {
+		b.fail(n.Put([]byte(member), []byte{}))
+	}
+}
+
+func (b *boltKeyspace) expiry(key string) (time.Time, bool) {
+	v := b.tx.Bucket(expiresBucket).Get([]byte(key))
+	if v == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))), true
+}
+
+func (b *boltKeyspace) expire(key string, at time.Time) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(at.UnixNano()))
+	b.fail(b.tx.Bucket(expiresBucket).Put([]byte(key), buf))
+}
+
+func (b *boltKeyspace) del(key string) {
+	k := []byte(key)
+	b.fail(b.tx.Bucket(countersBucket).Delete(k))
+	b.fail(b.tx.Bucket(logsBucket).Delete(k))
+	b.fail(b.tx.Bucket(expiresBucket).Delete(k))
+	for _, parent := range [][]byte{sortedBucket, hashesBucket, setsBucket} {
+		if p := b.tx.Bucket(parent); p.Bucket(k) != nil {
+			b.fail(p.DeleteBucket(k))
+		}
+	}
+}
+
+func (b *boltKeyspace) expiring() []string {
+	var out []string
+	b.fail(b.tx.Bucket(expiresBucket).ForEach(func(k, _ []byte) error {
+		out = append(out, string(k))
+		return nil
+	}))
+	return out
+}
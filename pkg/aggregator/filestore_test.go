@@ -0,0 +1,104 @@
+package aggregator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileStore", func() {
+	ctx := context.Background()
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "filestore")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	apply := func(s *FileStore, key string, member string) {
+		_, err := s.Apply(ctx, []*Update{{Increments: []Increment{
+			{Key: key, Delta: 1},
+			{Key: "uniq_" + key, Value: member},
+			{Key: "top_" + key, Member: member, Delta: 1, Size: 10},
+		}}})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	expectCounts := func(s *FileStore, key string, n int64) {
+		counters, err := s.Counters(ctx, []string{key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters[key]).To(Equal(n))
+		distinct, err := s.Distinct(ctx, [][]string{{"uniq_" + key}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(distinct).Should(Equal([]int64{n}))
+		top, err := s.Top(ctx, "top_"+key, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(top).Should(HaveLen(int(n)))
+	}
+
+	It("keeps its counters when closed and reopened", func() {
+		s, err := OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		apply(s, "pleiades_total", "Foo")
+		apply(s, "pleiades_total", "Bar")
+		Expect(s.Close()).To(Succeed())
+
+		s, err = OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		expectCounts(s, "pleiades_total", 2)
+	})
+
+	It("expires counters by their TTL across reopening", func() {
+		now := time.Date(2020, 8, 10, 10, 50, 38, 0, time.UTC)
+		s, err := OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		s.now = func() time.Time { return now }
+		_, err = s.Apply(ctx, []*Update{{Increments: []Increment{
+			{Key: "pleiades_total", Delta: 1, TTL: time.Hour},
+			{Key: "pleiades_edits", Delta: 1},
+		}}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Close()).To(Succeed())
+
+		s, err = OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		s.now = func() time.Time { return now.Add(2 * time.Hour) }
+		counters, err := s.Counters(ctx, []string{"pleiades_total", "pleiades_edits"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).To(Equal(map[string]int64{"pleiades_edits": 1}))
+	})
+
+	It("cannot be opened twice at once", func() {
+		s, err := OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		_, err = OpenFileStore(dir, time.Hour)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("open in another process"))
+	})
+
+	It("is not served by a separate frontend", func() {
+		_, err := OpenReadOnlyStore(StoreFile, nil, dir)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(ErrUnsupportedByStore.Error()))
+	})
+
+	It("can be closed more than once", func() {
+		s, err := OpenFileStore(dir, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		apply(s, "pleiades_total", "Foo")
+		Expect(s.Close()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+	})
+})
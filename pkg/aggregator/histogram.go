@@ -0,0 +1,57 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	// HistogramPrefix prefixes the names of histograms, which are kept as hashes of bins
+	HistogramPrefix = "hist_"
+	// DefaultHistogramBase is the factor between the bounds of consecutive histogram bins unless a rule sets one
+	DefaultHistogramBase = 2
+	// DefaultHistogramMax is the largest finite bound of histogram bins unless a rule sets one
+	DefaultHistogramMax = 1 << 20
+)
+
+// LogBounds returns the upper bounds of log-scale histogram bins for values of either sign
+// The positive bounds are the powers of base from 1 up to the first one of at least max, mirrored for negative
+// values and separated by a bin for zero. Values below the lowest bound fall into the lowest bin, values above
+// the highest one into an additional +Inf bin.
+func LogBounds(base float64, max float64) ([]float64, error) {
+	if base <= 1 {
+		return nil, fmt.Errorf("histogram base must be greater than 1, got %v", base)
+	}
+	if max < 1 {
+		return nil, fmt.Errorf("histogram max must be at least 1, got %v", max)
+	}
+	var pos []float64
+	for b := 1.0; ; b *= base {
+		pos = append(pos, b)
+		if b >= max {
+			break
+		}
+	}
+	out := make([]float64, 0, 2*len(pos)+1)
+	for i := len(pos) - 1; i >= 0; i-- {
+		out = append(out, -pos[i])
+	}
+	out = append(out, 0)
+	return append(out, pos...), nil
+}
+
+// histogramBin returns the name of the bin v falls into, i.e. its upper bound
+func histogramBin(bounds []float64, v float64) string {
+	for _, b := range bounds {
+		if v <= b {
+			return FormatBound(b)
+		}
+	}
+	return FormatBound(math.Inf(1))
+}
+
+// FormatBound returns the name of the histogram bin with the given upper bound
+func FormatBound(b float64) string {
+	return strconv.FormatFloat(b, 'f', -1, 64)
+}
@@ -0,0 +1,37 @@
+package aggregator
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Histograms", func() {
+
+	It("derives log-scale bounds for values of either sign", func() {
+		bounds, err := LogBounds(10, 500)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bounds).Should(Equal([]float64{-1000, -100, -10, -1, 0, 1, 10, 100, 1000}))
+		_, err = LogBounds(1, 500)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("puts values into the bin of the next bound up", func() {
+		bounds, _ := LogBounds(10, 1000)
+		Expect(histogramBin(bounds, 0)).Should(Equal("0"))
+		Expect(histogramBin(bounds, 15)).Should(Equal("100"))
+		Expect(histogramBin(bounds, -15)).Should(Equal("-10"))
+		Expect(histogramBin(bounds, -5000)).Should(Equal("-1000"))
+		Expect(histogramBin(bounds, 5000)).Should(Equal("+Inf"))
+	})
+
+	It("counts events into histogram rules", func() {
+		rs, err := ParseRules([]byte(`{"counters": [{"name": "size", "dimension": "wiki", "histogram": "length.new - length.old", "base": 10, "max": 1000}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		incs, err := rs.Evaluate(parseEvent(`{"wiki":"enwiki","length":{"old":100,"new":50}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(Equal([]Increment{{Key: "hist_size_enwiki", Delta: 1, Field: "-10", Size: 10}}))
+
+		_, err = ParseRules([]byte(`{"counters": [{"name": "size", "histogram": "length.new", "sum": "length.old"}]}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
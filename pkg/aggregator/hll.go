@@ -0,0 +1,212 @@
+package aggregator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	// hllPrecision is the number of hash bits selecting a register, as in Redis
+	hllPrecision = 14
+	// hllRegisters is the number of registers of a dense hyperLogLog
+	hllRegisters = 1 << hllPrecision
+	// hllQ is the number of hash bits left to count the run of zeros in after selecting a register
+	hllQ = 64 - hllPrecision
+	// hllSparseMax is the number of registers a hyperLogLog holds sparsely before it becomes dense
+	hllSparseMax = 3000
+	// hllSeed is the seed Redis hashes values with
+	hllSeed = 0xadc83b19
+	// hllAlphaInf is the bias correction of the estimator Redis uses
+	hllAlphaInf = 0.721347520444481703680
+
+	// hllSparse and hllDense mark the encoding of a hyperLogLog written by MarshalBinary
+	hllSparse = 's'
+	hllDense  = 'd'
+)
+
+// hyperLogLog estimates the number of distinct values added to it, exactly like the HyperLogLogs of Redis
+// Values are hashed and assigned to registers as PFADD does, and counted with the estimator of PFCOUNT, so both give
+// the same counts for the same values. Registers are kept in a map while few of them are set, then in a slice
+// holding all of them.
+type hyperLogLog struct {
+	Sparse map[uint16]uint8
+	Dense  []uint8
+}
+
+// newHyperLogLog returns an empty hyperLogLog
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{Sparse: make(map[uint16]uint8)}
+}
+
+// murmurHash64A is the 64-bit MurmurHash2 of Austin Appleby, which Redis hashes the values of HyperLogLogs with
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(data)) * m)
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// Add adds values to the hyperLogLog
+// The low bits of the hash of a value select its register, which is raised to the position of the lowest set bit
+// among the others.
+func (h *hyperLogLog) Add(values ...string) {
+	for _, v := range values {
+		x := murmurHash64A([]byte(v), hllSeed)
+		reg := uint16(x & (hllRegisters - 1))
+		x = x>>hllPrecision | 1<<hllQ
+		rank := uint8(1)
+		for x&1 == 0 {
+			rank++
+			x >>= 1
+		}
+		h.set(reg, rank)
+	}
+}
+
+// set raises a register to rank, unless it is higher already
+func (h *hyperLogLog) set(reg uint16, rank uint8) {
+	if h.Dense != nil {
+		if h.Dense[reg] < rank {
+			h.Dense[reg] = rank
+		}
+		return
+	}
+	if h.Sparse == nil {
+		h.Sparse = make(map[uint16]uint8)
+	}
+	if h.Sparse[reg] >= rank {
+		return
+	}
+	h.Sparse[reg] = rank
+	if len(h.Sparse) > hllSparseMax {
+		h.Dense = make([]uint8, hllRegisters)
+		for r, v := range h.Sparse {
+			h.Dense[r] = v
+		}
+		h.Sparse = nil
+	}
+}
+
+// Merge adds the values added to other to the hyperLogLog
+func (h *hyperLogLog) Merge(other *hyperLogLog) {
+	if other.Dense != nil {
+		for r, v := range other.Dense {
+			if v > 0 {
+				h.set(uint16(r), v)
+			}
+		}
+		return
+	}
+	for r, v := range other.Sparse {
+		h.set(r, v)
+	}
+}
+
+// Count estimates the number of distinct values added, with the estimator of Otmar Ertl that PFCOUNT uses
+func (h *hyperLogLog) Count() int64 {
+	var histogram [hllQ + 2]int
+	if h.Dense != nil {
+		for _, v := range h.Dense {
+			histogram[v]++
+		}
+	} else {
+		for _, v := range h.Sparse {
+			histogram[v]++
+		}
+		histogram[0] += hllRegisters - len(h.Sparse)
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return int64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// hllSigma is the correction for empty registers of the estimator of Count
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// hllTau is the correction for saturated registers of the estimator of Count
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// MarshalBinary encodes the hyperLogLog as its set registers and their values while sparse, or all registers once dense
+func (h *hyperLogLog) MarshalBinary() ([]byte, error) {
+	if h.Dense != nil {
+		return append([]byte{hllDense}, h.Dense...), nil
+	}
+	out := make([]byte, 1, 1+3*len(h.Sparse))
+	out[0] = hllSparse
+	for r, v := range h.Sparse {
+		out = append(out, byte(r>>8), byte(r), v)
+	}
+	return out, nil
+}
+
+// UnmarshalBinary decodes a hyperLogLog encoded by MarshalBinary
+func (h *hyperLogLog) UnmarshalBinary(data []byte) error {
+	switch {
+	case len(data) == 1+hllRegisters && data[0] == hllDense:
+		h.Sparse = nil
+		h.Dense = append([]uint8(nil), data[1:]...)
+	case len(data) > 0 && (len(data)-1)%3 == 0 && data[0] == hllSparse:
+		h.Dense = nil
+		h.Sparse = make(map[uint16]uint8, (len(data)-1)/3)
+		for i := 1; i < len(data); i += 3 {
+			h.Sparse[uint16(data[i])<<8|uint16(data[i+1])] = data[i+2]
+		}
+	default:
+		return fmt.Errorf("invalid hyperLogLog of %d bytes", len(data))
+	}
+	return nil
+}
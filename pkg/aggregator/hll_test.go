@@ -0,0 +1,58 @@
+package aggregator
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HyperLogLog", func() {
+	It("counts small cardinalities exactly", func() {
+		h := newHyperLogLog()
+		Expect(h.Count()).To(Equal(int64(0)))
+		h.Add("a", "b", "c", "a")
+		Expect(h.Count()).To(Equal(int64(3)))
+	})
+
+	It("estimates large cardinalities within a few percent", func() {
+		h := newHyperLogLog()
+		for i := 0; i < 100000; i++ {
+			h.Add(strconv.Itoa(i))
+		}
+		Expect(h.Dense).NotTo(BeNil())
+		Expect(h.Count()).To(BeNumerically("~", 100000, 2000))
+	})
+
+	It("hashes values into the same registers as Redis", func() {
+		h := newHyperLogLog()
+		h.Add("hello")
+		Expect(h.Sparse).To(HaveLen(1))
+		x := murmurHash64A([]byte("hello"), hllSeed)
+		Expect(h.Sparse).To(HaveKey(uint16(x & (hllRegisters - 1))))
+	})
+
+	It("keeps its registers when encoded and decoded", func() {
+		for _, n := range []int{10, 10000} {
+			h := newHyperLogLog()
+			for i := 0; i < n; i++ {
+				h.Add(strconv.Itoa(i))
+			}
+			data, err := h.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			decoded := &hyperLogLog{}
+			Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+			Expect(decoded).To(Equal(h))
+		}
+	})
+
+	It("merges into the union of both", func() {
+		a, b := newHyperLogLog(), newHyperLogLog()
+		for i := 0; i < 1000; i++ {
+			a.Add(strconv.Itoa(i))
+			b.Add(strconv.Itoa(i + 500))
+		}
+		a.Merge(b)
+		Expect(a.Count()).To(BeNumerically("~", 1500, 30))
+	})
+})
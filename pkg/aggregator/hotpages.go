@@ -0,0 +1,141 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// HotPageEditWar flags a page on which at least two users keep reverting each other
+	HotPageEditWar = "edit_war"
+	// HotPageBusy flags a page receiving many edits from few users
+	HotPageBusy = "hot"
+
+	// HotPagesKey is the sorted set of flagged pages, scored by the time they were last flagged
+	HotPagesKey = "hot_pages"
+	// HotPagesInfoKey is the hash holding the latest HotPage of each flagged page as JSON
+	HotPagesInfoKey = "hot_pages_info"
+)
+
+// DefaultHotPageConfig is the hot page detection used unless configured otherwise
+var DefaultHotPageConfig = HotPageConfig{
+	Window:     time.Hour,
+	MinEdits:   10,
+	MaxUsers:   2,
+	MinReverts: 3,
+	MaxPages:   100000,
+}
+
+var (
+	hotPagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_hot_pages_total",
+			Help: "Number of pages flagged as hot or as the subject of an edit war",
+		},
+		[]string{"reason"},
+	)
+
+	hotPagesTracked = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_hot_pages_tracked_pages",
+			Help: "Number of pages whose recent edits are tracked for hot page detection",
+		},
+	)
+)
+
+// NewHotPages returns a HotPages detector recognising reverts with the given signals, or DefaultSignals if nil
+// It is not safe for concurrent use, and only sees the events of the aggregator it runs in.
+func NewHotPages(cfg HotPageConfig, s *Signals) *HotPages {
+	if s == nil {
+		s = defaultSignals
+	}
+	return &HotPages{cfg: cfg, signals: s, pages: make(map[string]*pageHistory)}
+}
+
+// Observe records an event that occurred at t and returns the page it flags, if any
+// A page is only flagged again once the window has passed since it was last flagged, unless it escalates
+// from hot to an edit war.
+func (h *HotPages) Observe(event map[string]interface{}, t time.Time) *HotPage {
+	if event["type"] != "edit" && event["type"] != "new" {
+		return nil
+	}
+	wiki, title := eventWiki(event), toString(event["title"])
+	if wiki == "" || title == "" {
+		return nil
+	}
+	key := wiki + ":" + title
+	p := h.pages[key]
+	if p == nil {
+		if len(h.pages) >= h.cfg.MaxPages {
+			h.prune(t)
+		}
+		if len(h.pages) >= h.cfg.MaxPages {
+			return nil
+		}
+		p = &pageHistory{}
+		h.pages[key] = p
+		hotPagesTracked.Set(float64(len(h.pages)))
+	}
+	p.expire(t.Add(-h.cfg.Window))
+	p.edits = append(p.edits, pageEdit{
+		t:      t,
+		user:   toString(event["user"]),
+		revert: h.signals.reverted(event),
+	})
+
+	hp := &HotPage{Page: key, Wiki: wiki, Title: title, Edits: len(p.edits), Time: t.Unix()}
+	users := make(map[string]bool)
+	reverters := make(map[string]bool)
+	alternating := 0
+	last := ""
+	for _, e := range p.edits {
+		users[e.user] = true
+		if !e.revert {
+			continue
+		}
+		hp.Reverts++
+		reverters[e.user] = true
+		if e.user != last {
+			alternating++
+		}
+		last = e.user
+	}
+	hp.Users = len(users)
+	switch {
+	case alternating >= h.cfg.MinReverts && len(reverters) >= 2:
+		hp.Reason = HotPageEditWar
+	case hp.Edits >= h.cfg.MinEdits && hp.Users <= h.cfg.MaxUsers:
+		hp.Reason = HotPageBusy
+	default:
+		return nil
+	}
+	if !p.flagged.IsZero() && t.Sub(p.flagged) < h.cfg.Window && (p.reason == hp.Reason || p.reason == HotPageEditWar) {
+		return nil
+	}
+	p.flagged, p.reason = t, hp.Reason
+	hotPagesTotal.WithLabelValues(hp.Reason).Inc()
+	return hp
+}
+
+// prune forgets the pages not edited within the window before t
+func (h *HotPages) prune(t time.Time) {
+	cutoff := t.Add(-h.cfg.Window)
+	for k, p := range h.pages {
+		p.expire(cutoff)
+		if len(p.edits) == 0 {
+			delete(h.pages, k)
+		}
+	}
+	hotPagesTracked.Set(float64(len(h.pages)))
+}
+
+// expire drops the edits made before cutoff
+func (p *pageHistory) expire(cutoff time.Time) {
+	i := 0
+	for i < len(p.edits) && p.edits[i].t.Before(cutoff) {
+		i++
+	}
+	p.edits = p.edits[i:]
+}
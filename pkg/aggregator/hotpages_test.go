@@ -0,0 +1,90 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hot pages", func() {
+	start := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+	cfg := HotPageConfig{Window: time.Hour, MinEdits: 5, MaxUsers: 2, MinReverts: 3, MaxPages: 10}
+
+	edit := func(title string, user string, comment string) map[string]interface{} {
+		return parseEvent(fmt.Sprintf(`{"wiki":"enwiki","type":"edit","title":%q,"user":%q,"comment":%q}`, title, user, comment))
+	}
+
+	It("flags pages edited often by few users once per window", func() {
+		h := NewHotPages(cfg, nil)
+		for i := 0; i < 4; i++ {
+			Expect(h.Observe(edit("Foo", "Alice", "copyedit"), start.Add(time.Duration(i)*time.Minute))).To(BeNil())
+		}
+		p := h.Observe(edit("Foo", "Bob", "typo"), start.Add(5*time.Minute))
+		Expect(p).NotTo(BeNil())
+		Expect(*p).Should(Equal(HotPage{Page: "enwiki:Foo", Wiki: "enwiki", Title: "Foo", Reason: HotPageBusy, Edits: 5, Users: 2, Time: start.Add(5 * time.Minute).Unix()}))
+		Expect(h.Observe(edit("Foo", "Alice", "more"), start.Add(6*time.Minute))).To(BeNil())
+	})
+
+	It("does not flag busy pages edited by many users or edits outside the window", func() {
+		h := NewHotPages(cfg, nil)
+		for i := 0; i < 5; i++ {
+			Expect(h.Observe(edit("Foo", fmt.Sprintf("User%d", i), ""), start.Add(time.Duration(i)*time.Minute))).To(BeNil())
+		}
+		for i := 0; i < 5; i++ {
+			Expect(h.Observe(edit("Bar", "Alice", ""), start.Add(time.Duration(i)*20*time.Minute))).To(BeNil())
+		}
+	})
+
+	It("flags alternating reverts as an edit war, escalating from a hot page", func() {
+		h := NewHotPages(HotPageConfig{Window: time.Hour, MinEdits: 2, MaxUsers: 2, MinReverts: 3, MaxPages: 10}, nil)
+		Expect(h.Observe(edit("Foo", "Alice", "Reverted edits by Bob"), start)).To(BeNil())
+		p := h.Observe(edit("Foo", "Bob", "Undid revision 1 by Alice"), start.Add(time.Minute))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Reason).Should(Equal(HotPageBusy))
+		p = h.Observe(edit("Foo", "Alice", "Undid revision 2 by Bob"), start.Add(2*time.Minute))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Reason).Should(Equal(HotPageEditWar))
+		Expect(p.Reverts).Should(Equal(3))
+		Expect(h.Observe(edit("Foo", "Bob", "Undid revision 3 by Alice"), start.Add(3*time.Minute))).To(BeNil())
+	})
+
+	It("recognises reverts marked by the ingester after their comments were dropped", func() {
+		h := NewHotPages(HotPageConfig{Window: time.Hour, MinEdits: 2, MaxUsers: 2, MinReverts: 3, MaxPages: 10}, nil)
+		marked := func(user string) map[string]interface{} {
+			return parseEvent(fmt.Sprintf(`{"wiki":"enwiki","type":"edit","title":"Foo","user":%q,"revert":true}`, user))
+		}
+		h.Observe(marked("Alice"), start)
+		h.Observe(marked("Bob"), start.Add(time.Minute))
+		p := h.Observe(marked("Alice"), start.Add(2*time.Minute))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Reason).Should(Equal(HotPageEditWar))
+	})
+
+	It("does not count reverts by a single user as an edit war", func() {
+		h := NewHotPages(cfg, nil)
+		for i := 0; i < 3; i++ {
+			Expect(h.Observe(edit(fmt.Sprintf("Page%d", i), "Patroller", "rv vandalism"), start)).To(BeNil())
+			Expect(h.Observe(edit("Foo", "Patroller", "rv vandalism"), start.Add(time.Duration(i)*time.Minute))).To(BeNil())
+		}
+	})
+
+	It("forgets idle pages once it tracks too many", func() {
+		h := NewHotPages(HotPageConfig{Window: time.Hour, MinEdits: 5, MaxUsers: 2, MinReverts: 3, MaxPages: 2}, nil)
+		h.Observe(edit("Foo", "Alice", ""), start)
+		h.Observe(edit("Bar", "Alice", ""), start)
+		h.Observe(edit("Baz", "Alice", ""), start)
+		Expect(h.pages).Should(HaveLen(2))
+		h.Observe(edit("Baz", "Alice", ""), start.Add(2*time.Hour))
+		Expect(h.pages).Should(HaveLen(1))
+		Expect(h.pages).Should(HaveKey("enwiki:Baz"))
+	})
+
+	It("ignores log events and events without a title", func() {
+		h := NewHotPages(HotPageConfig{Window: time.Hour, MinEdits: 1, MaxUsers: 2, MinReverts: 3, MaxPages: 10}, nil)
+		Expect(h.Observe(parseEvent(`{"wiki":"enwiki","type":"log","title":"Foo"}`), start)).To(BeNil())
+		Expect(h.Observe(parseEvent(`{"wiki":"enwiki","type":"edit"}`), start)).To(BeNil())
+		Expect(h.pages).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,209 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/go-redis/redis/v8"
+)
+
+// add records that the bucket holds counters with the given names
+func (ix bucketIndex) add(b bucket.Bucket, names ...string) {
+	ix.addPrefixed("", b, names...)
+}
+
+// addPrefixed records that the copy of the bucket whose keys carry prefix, e.g. latePrefix, holds counters with the given names
+func (ix bucketIndex) addPrefixed(prefix string, b bucket.Bucket, names ...string) {
+	e, ok := ix[prefix+b.IndexKey()]
+	if !ok {
+		e = &indexedBucket{bucket: b, prefix: prefix, names: make(map[string]bool)}
+		ix[prefix+b.IndexKey()] = e
+	}
+	for _, n := range names {
+		e.names[n] = true
+	}
+}
+
+// addKeys records the bucket keys among keys, which may carry a staging prefix, in the bucket of the family they belong to
+func (ix bucketIndex) addKeys(families []*bucket.Resolution, prefix string, keys []string) {
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, prefix)
+		for _, res := range families {
+			if b, ok := res.FromKey(k); ok {
+				ix.add(b, strings.TrimPrefix(k, b.Prefix()))
+				break
+			}
+		}
+	}
+}
+
+// indexUpdates returns the index of the buckets the updates count towards
+func indexUpdates(updates []*Update) bucketIndex {
+	ix := make(bucketIndex)
+	for _, u := range updates {
+		if len(u.buckets) == 0 && len(u.lateBuckets) == 0 {
+			continue
+		}
+		names := make([]string, u.allTime)
+		for i, inc := range u.Increments[:u.allTime] {
+			names[i] = inc.Key
+		}
+		for _, b := range u.buckets {
+			ix.add(b, names...)
+		}
+		for _, b := range u.lateBuckets {
+			ix.addPrefixed(latePrefix, b, names...)
+		}
+	}
+	return ix
+}
+
+// sorted returns the indexed buckets, sorted by their IndexKey
+func (ix bucketIndex) sorted() []*indexedBucket {
+	keys := make([]string, 0, len(ix))
+	for k := range ix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*indexedBucket, len(keys))
+	for i, k := range keys {
+		out[i] = ix[k]
+	}
+	return out
+}
+
+// sortedNames returns the names of the counters in the bucket, sorted
+func (e *indexedBucket) sortedNames() []string {
+	out := make([]string, 0, len(e.names))
+	for n := range e.names {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cutoff returns the ID of the oldest bucket of a resolution whose counters have not expired at now, or an
+// empty string if they never expire
+func cutoff(res *bucket.Resolution, now time.Time) string {
+	if res.TTL <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(res.At(now.Add(-res.TTL)).ID, 10)
+}
+
+// entries returns the indexed buckets as they are recorded at now, sorted by their IndexKey
+func (ix bucketIndex) entries(now time.Time) []indexEntry {
+	out := make([]indexEntry, 0, len(ix))
+	for _, e := range ix.sorted() {
+		res := e.bucket.Resolution
+		out = append(out, indexEntry{
+			Buckets:  e.prefix + res.IndexKey(),
+			Counters: e.prefix + e.bucket.IndexKey(),
+			ID:       e.bucket.ID,
+			TTL:      res.TTL,
+			Cutoff:   cutoff(res, now),
+			Names:    e.sortedNames(),
+		})
+	}
+	return out
+}
+
+// args returns the index section of the arguments of applyScript, declaring the keys it touches in keys
+// Each bucket is given as the positions in KEYS of the IndexKey of its resolution and of its own IndexKey, its ID, the TTL
+// of its resolution in seconds, the cutoff below which buckets are dropped from the index, and the number and names of
+// its counters.
+func (ix bucketIndex) args(now time.Time, keys *scriptKeys) []interface{} {
+	var out []interface{}
+	for _, e := range ix.entries(now) {
+		out = append(out, keys.add(e.Buckets), keys.add(e.Counters), e.ID, int64(e.TTL.Seconds()), e.Cutoff, len(e.Names))
+		for _, n := range e.Names {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// write queues the commands recording the indexed buckets and their counters on a pipeline
+func (ix bucketIndex) write(ctx context.Context, pipe redis.Pipeliner, now time.Time) {
+	for _, e := range ix.sorted() {
+		res := e.bucket.Resolution
+		pipe.ZAdd(ctx, e.prefix+res.IndexKey(), &redis.Z{Score: float64(e.bucket.ID), Member: strconv.FormatInt(e.bucket.ID, 10)})
+		names := e.sortedNames()
+		members := make([]interface{}, len(names))
+		for i, n := range names {
+			members[i] = n
+		}
+		if len(members) > 0 {
+			pipe.SAdd(ctx, e.prefix+e.bucket.IndexKey(), members...)
+		}
+		if c := cutoff(res, now); c != "" {
+			pipe.Expire(ctx, e.prefix+e.bucket.IndexKey(), res.TTL)
+			pipe.ZRemRangeByScore(ctx, e.prefix+res.IndexKey(), "-inf", "("+c)
+		}
+	}
+}
+
+// unindex queues the commands removing a bucket, or its copy whose keys carry prefix, from the index on a pipeline
+func unindex(ctx context.Context, pipe redis.Pipeliner, prefix string, b bucket.Bucket) {
+	pipe.ZRem(ctx, prefix+b.Resolution.IndexKey(), strconv.FormatInt(b.ID, 10))
+	pipe.Del(ctx, prefix+b.IndexKey())
+}
+
+// scanKeys returns all keys matching a pattern, without blocking Redis like KEYS does
+func scanKeys(ctx context.Context, r *redis.Client, pattern string) ([]string, error) {
+	var out []string
+	var cursor uint64
+	for {
+		keys, next, err := r.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, keys...)
+		if next == 0 {
+			return out, nil
+		}
+		cursor = next
+	}
+}
+
+// Reindex builds the bucket index from the existing bucket keys of every resolution and zone, and from their late_
+// copies, scanning them with SCAN
+// It only adds to the index, so it is safe to run while aggregators are writing. It returns the number of buckets indexed.
+func Reindex(ctx context.Context, r *redis.Client, bk *Bucketing) (int, error) {
+	if bk == nil {
+		bk = DefaultBucketing()
+	}
+	total := 0
+	for _, res := range bk.Families() {
+		for _, prefix := range []string{"", latePrefix} {
+			keys, err := scanKeys(ctx, r, prefix+res.KeyPattern())
+			if err != nil {
+				return total, fmt.Errorf("failed to list %s%s buckets: %v", prefix, res.Tag(), err)
+			}
+			ix := make(bucketIndex)
+			for _, k := range keys {
+				if b, ok := res.FromKey(strings.TrimPrefix(k, prefix)); ok {
+					ix.addPrefixed(prefix, b, strings.TrimPrefix(k, prefix+b.Prefix()))
+				}
+			}
+			if len(ix) == 0 {
+				continue
+			}
+			_, err = r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				ix.write(ctx, pipe, time.Now())
+				return nil
+			})
+			if err != nil {
+				return total, fmt.Errorf("failed to index %s%s buckets: %v", prefix, res.Tag(), err)
+			}
+			logger.Infof("Indexed %d %s%s buckets holding %d keys", len(ix), prefix, res.Tag(), len(keys))
+			total += len(ix)
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,61 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bucket index", func() {
+	ts := time.Date(2020, 8, 10, 10, 50, 38, 0, time.UTC)
+	bk := &Bucketing{Resolutions: []*bucket.Resolution{bucket.Hour, bucket.Day}, Zones: []*bucket.Zone{bucket.UTC}}
+
+	It("indexes the buckets and counters of updates", func() {
+		rs, err := ParseRules([]byte(`{"counters": [{"name": "pleiades_total"}, {"name": "users", "distinct": "user"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		u, err := Aggregate(rs, bk, &transport.Message{
+			ID:   `[{"timestamp":1597056638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit","user":"Foo"}`),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		keys := newScriptKeys(offsetsKey)
+		args := indexUpdates([]*Update{u, u}).args(ts, keys)
+		Expect(keys.keys).Should(Equal([]string{offsetsKey, "index_day", "index_day_18484", "index_hour", "index_hour_443626"}))
+		Expect(args).Should(Equal([]interface{}{
+			2, 3, int64(18484), int64(0), "", 2, "pleiades_total", "uniq_users",
+			4, 5, int64(443626), int64(bucket.Hour.TTL.Seconds()), "442906", 2, "pleiades_total", "uniq_users",
+		}))
+	})
+
+	It("indexes the late copies of buckets separately", func() {
+		rs, err := ParseRules([]byte(`{"counters": [{"name": "pleiades_total"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		u, err := Aggregate(rs, bk, &transport.Message{ID: `[{"timestamp":1597056638001}]`, Data: []byte(`{}`)})
+		Expect(err).NotTo(HaveOccurred())
+		u.late(LateBucket)
+		ix := indexUpdates([]*Update{u})
+		Expect(ix).Should(HaveLen(2))
+		Expect(ix).ShouldNot(HaveKey("index_day_18484"))
+		Expect(ix["late_index_day_18484"].sortedNames()).Should(Equal([]string{"pleiades_total"}))
+		entries := ix.entries(time.Unix(1597056638, 0))
+		Expect(entries[0].Buckets).Should(Equal("late_index_day"))
+		Expect(entries[0].Counters).Should(Equal("late_index_day_18484"))
+
+		u, err = Aggregate(rs, bk, &transport.Message{ID: `[{"timestamp":1597056638001}]`, Data: []byte(`{}`)})
+		Expect(err).NotTo(HaveOccurred())
+		u.late(LateDrop)
+		Expect(indexUpdates([]*Update{u})).Should(BeEmpty())
+	})
+
+	It("indexes bucket keys, ignoring others", func() {
+		ix := make(bucketIndex)
+		ix.addKeys(bk.Aligned(), "staged_", []string{"staged_day_18484_pleiades_total", "staged_hour_443626_top_pages", "staged_pleiades_total", "staged_late_day_18484_pleiades_total"})
+		Expect(ix).Should(HaveLen(2))
+		Expect(ix["index_day_18484"].sortedNames()).Should(Equal([]string{"pleiades_total"}))
+		Expect(ix["index_hour_443626"].sortedNames()).Should(Equal([]string{"top_pages"}))
+	})
+})
@@ -0,0 +1,482 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+)
+
+// sweepInterval is the number of writes after which a keyStore drops all expired keys
+// Expired keys are ignored by reads and replaced by writes in between.
+const sweepInterval = 1000
+
+// newKeyStore returns a keyStore keeping counters in the keyspace of keys
+// Event IDs are remembered for replayWindow to detect replays of events without a partition offset. Zero disables this.
+func newKeyStore(keys keyspaceDB, replayWindow time.Duration) *keyStore {
+	return &keyStore{keys: keys, replayWindow: replayWindow, now: time.Now}
+}
+
+// update runs fn on the keyspace in a single write, dropping all expired keys first every sweepInterval writes
+func (s *keyStore) update(fn func(ks keyspace, now time.Time)) error {
+	return s.keys.update(func(ks keyspace) {
+		now := s.now()
+		s.writes++
+		if s.writes%sweepInterval == 0 {
+			for _, k := range ks.expiring() {
+				touch(ks, k, now)
+			}
+		}
+		fn(ks, now)
+	})
+}
+
+// view runs fn on the keyspace in a read
+func (s *keyStore) view(fn func(ks keyspace, now time.Time)) error {
+	return s.keys.view(func(ks keyspace) {
+		fn(ks, s.now())
+	})
+}
+
+// Apply increments each key by its delta, like Store.Apply
+func (s *keyStore) Apply(ctx context.Context, updates []*Update) (int, error) {
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	suppressed := 0
+	err := s.update(func(ks keyspace, now time.Time) {
+		suppressed = applyUpdates(ks, updates, indexUpdates(updates).entries(now), s.replayWindow, now)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to apply %d counter updates: %v", len(updates), err)
+	}
+	return suppressed, nil
+}
+
+// SetAppliedOffsets overwrites the offsets recorded as applied for the given partitions
+func (s *keyStore) SetAppliedOffsets(ctx context.Context, offsets map[string]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	err := s.update(func(ks keyspace, now time.Time) {
+		for p, o := range offsets {
+			ks.hset(offsetsKey, p, strconv.FormatInt(o, 10))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set applied offsets: %v", err)
+	}
+	return nil
+}
+
+// Finalize records the watermark and marks the given buckets as finalized
+// The watermark is never moved backwards.
+func (s *keyStore) Finalize(ctx context.Context, watermark time.Time, buckets []bucket.Bucket) error {
+	ms := watermark.UnixNano() / int64(time.Millisecond)
+	err := s.update(func(ks keyspace, now time.Time) {
+		if current, ok := ks.counter(watermarkKey); !ok || current < ms {
+			ks.setCounter(watermarkKey, ms)
+		}
+		for _, b := range buckets {
+			ks.zadd(b.Resolution.FinalizedKey(), strconv.FormatInt(b.ID, 10), float64(b.ID))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to finalize %d buckets: %v", len(buckets), err)
+	}
+	return nil
+}
+
+// Watermark returns the watermark last recorded by Finalize, or the zero time if there is none
+func (s *keyStore) Watermark(ctx context.Context) (time.Time, error) {
+	var ms int64
+	var ok bool
+	err := s.view(func(ks keyspace, now time.Time) {
+		ms, ok = ks.counter(watermarkKey)
+	})
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return EventTime(ms), nil
+}
+
+// FlagHotPages records flagged pages for window after the latest of them was flagged
+func (s *keyStore) FlagHotPages(ctx context.Context, pages []*HotPage, window time.Duration) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	data := make([]string, len(pages))
+	var latest int64
+	for i, p := range pages {
+		d, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("failed to encode hot page %s: %v", p.Page, err)
+		}
+		data[i] = string(d)
+		if p.Time > latest {
+			latest = p.Time
+		}
+	}
+	err := s.update(func(ks keyspace, now time.Time) {
+		touch(ks, HotPagesKey, now)
+		touch(ks, HotPagesInfoKey, now)
+		for i, p := range pages {
+			ks.zadd(HotPagesKey, p.Page, float64(p.Time))
+			ks.hset(HotPagesInfoKey, p.Page, data[i])
+		}
+		for _, page := range zremBelow(ks, HotPagesKey, float64(latest-int64(window.Seconds()))) {
+			ks.hdel(HotPagesInfoKey, page)
+		}
+		expire(ks, HotPagesKey, window, now)
+		expire(ks, HotPagesInfoKey, window, now)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %d hot pages: %v", len(pages), err)
+	}
+	return nil
+}
+
+// SetAnomalies replaces the active anomalies, which are kept for ttl unless replaced again
+func (s *keyStore) SetAnomalies(ctx context.Context, anomalies []*Anomaly, ttl time.Duration) error {
+	data := make(map[string]string, len(anomalies))
+	for _, a := range anomalies {
+		d, err := json.Marshal(a)
+		if err != nil {
+			return fmt.Errorf("failed to encode anomaly of %s: %v", a.Series, err)
+		}
+		data[a.Series] = string(d)
+	}
+	err := s.update(func(ks keyspace, now time.Time) {
+		ks.del(AnomaliesKey)
+		for series, d := range data {
+			ks.hset(AnomaliesKey, series, d)
+		}
+		if len(data) > 0 {
+			expire(ks, AnomaliesKey, ttl, now)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record %d anomalies: %v", len(anomalies), err)
+	}
+	return nil
+}
+
+// Counters returns the values of the counters at keys, leaving out those that do not exist
+func (s *keyStore) Counters(ctx context.Context, keys []string) (map[string]int64, error) {
+	out := make(map[string]int64, len(keys))
+	err := s.view(func(ks keyspace, now time.Time) {
+		for _, k := range keys {
+			if v, ok := ks.counter(k); ok && alive(ks, k, now) {
+				out[k] = v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Distinct estimates the number of distinct values added to the HyperLogLogs of each set of keys taken together
+// The estimates are those PFCOUNT gives for the same keys in Redis.
+func (s *keyStore) Distinct(ctx context.Context, keys [][]string) ([]int64, error) {
+	out := make([]int64, len(keys))
+	err := s.view(func(ks keyspace, now time.Time) {
+		for i, set := range keys {
+			union := newHyperLogLog()
+			for _, k := range set {
+				if h := ks.log(k); h != nil && alive(ks, k, now) {
+					union.Merge(h)
+				}
+			}
+			out[i] = union.Count()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Top returns up to limit members of the sorted set at key by descending score, or all of them if limit is not positive
+// Members with equal scores are ordered by descending member, as Redis does.
+func (s *keyStore) Top(ctx context.Context, key string, limit int) ([]Scored, error) {
+	var out []Scored
+	err := s.view(func(ks keyspace, now time.Time) {
+		if alive(ks, key, now) {
+			out = ranked(ks, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// Hashes returns the fields of the hash at each key, which are empty if it does not exist
+func (s *keyStore) Hashes(ctx context.Context, keys []string) ([]map[string]string, error) {
+	out := make([]map[string]string, len(keys))
+	err := s.view(func(ks keyspace, now time.Time) {
+		for i, k := range keys {
+			out[i] = make(map[string]string)
+			if !alive(ks, k, now) {
+				continue
+			}
+			for f, v := range ks.hash(k) {
+				out[i][f] = v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Buckets returns the IDs of the buckets of a resolution in the bucket index, sorted
+func (s *keyStore) Buckets(ctx context.Context, res *bucket.Resolution) ([]int64, error) {
+	return s.ids(res.IndexKey())
+}
+
+// Names returns the names of the counters of a bucket in the bucket index, in no particular order
+func (s *keyStore) Names(ctx context.Context, b bucket.Bucket) ([]string, error) {
+	var out []string
+	err := s.view(func(ks keyspace, now time.Time) {
+		if key := b.IndexKey(); alive(ks, key, now) {
+			out = ks.members(key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Finalized returns the IDs of the finalized buckets of a resolution
+func (s *keyStore) Finalized(ctx context.Context, res *bucket.Resolution) (map[int64]bool, error) {
+	ids, err := s.ids(res.FinalizedKey())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		out[id] = true
+	}
+	return out, nil
+}
+
+// IsFinalized reports whether a bucket has been marked as finalized
+func (s *keyStore) IsFinalized(ctx context.Context, b bucket.Bucket) (bool, error) {
+	var ok bool
+	err := s.view(func(ks keyspace, now time.Time) {
+		_, ok = ks.zscore(b.Resolution.FinalizedKey(), strconv.FormatInt(b.ID, 10))
+	})
+	return ok, err
+}
+
+// ids returns the members of the sorted set at key as bucket IDs, by ascending score
+func (s *keyStore) ids(key string) ([]int64, error) {
+	var members []Scored
+	err := s.view(func(ks keyspace, now time.Time) {
+		if alive(ks, key, now) {
+			members = ranked(ks, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int64, len(members))
+	for i, z := range members {
+		id, err := strconv.ParseInt(z.Member, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket ID %s in %s: %v", z.Member, key, err)
+		}
+		out[i] = id
+	}
+	return out, nil
+}
+
+// alive reports whether the key has not expired at now
+func alive(ks keyspace, key string, now time.Time) bool {
+	exp, ok := ks.expiry(key)
+	return !ok || now.Before(exp)
+}
+
+// touch deletes the key if it has expired at now, so it can be written afresh
+func touch(ks keyspace, key string, now time.Time) {
+	if !alive(ks, key, now) {
+		ks.del(key)
+	}
+}
+
+// expire sets the key to expire ttl after now, if ttl is positive
+func expire(ks keyspace, key string, ttl time.Duration, now time.Time) {
+	if ttl > 0 {
+		ks.expire(key, now.Add(ttl))
+	}
+}
+
+// expireNew sets the key to expire ttl after now, unless it expires already
+func expireNew(ks keyspace, key string, ttl time.Duration, now time.Time) {
+	if _, ok := ks.expiry(key); !ok {
+		expire(ks, key, ttl, now)
+	}
+}
+
+// ranked returns the members of the sorted set at key by ascending score, and members with equal scores by member
+func ranked(ks keyspace, key string) []Scored {
+	members := ks.sorted(key)
+	out := make([]Scored, 0, len(members))
+	for m, score := range members {
+		out = append(out, Scored{Member: m, Score: score})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score < out[j].Score
+		}
+		return out[i].Member < out[j].Member
+	})
+	return out
+}
+
+// zremBelow removes the members of the sorted set at key scoring below min, and returns them
+func zremBelow(ks keyspace, key string, min float64) []string {
+	var out []string
+	for m, score := range ks.sorted(key) {
+		if score < min {
+			out = append(out, m)
+		}
+	}
+	for _, m := range out {
+		ks.zrem(key, m)
+	}
+	return out
+}
+
+// applyUpdates applies the increments of the updates that have not been applied before, then records the index
+// entries, following applyScript, and returns the number of updates skipped
+// Like there, sorted sets are trimmed and new hash fields checked against the size of their hash only once all
+// increments have been summed.
+func applyUpdates(ks keyspace, updates []*Update, index []indexEntry, replayWindow time.Duration, now time.Time) int {
+	suppressed := 0
+	sizes := make(map[string]int)
+	fields := make(map[string]map[string]int64)
+	logs := make(map[string]*hyperLogLog)
+	for _, u := range updates {
+		if !fresh(ks, u, replayWindow, now) {
+			suppressed++
+			continue
+		}
+		for _, inc := range u.Increments {
+			k := inc.Key
+			touch(ks, k, now)
+			switch {
+			case inc.Value != "":
+				h, ok := logs[k]
+				if !ok {
+					h = ks.log(k)
+					if h == nil {
+						h = newHyperLogLog()
+					}
+					logs[k] = h
+				}
+				h.Add(inc.Value)
+			case inc.Member != "":
+				score, _ := ks.zscore(k, inc.Member)
+				ks.zadd(k, inc.Member, score+float64(inc.Delta))
+				sizes[k] = inc.Size
+			case inc.Field != "":
+				if fields[k] == nil {
+					fields[k] = make(map[string]int64)
+				}
+				fields[k][inc.Field] += inc.Delta
+				sizes[k] = inc.Size
+			default:
+				if inc.Delta == 0 {
+					continue
+				}
+				v, _ := ks.counter(k)
+				ks.setCounter(k, v+inc.Delta)
+			}
+			expireNew(ks, k, inc.TTL, now)
+		}
+	}
+	for k, h := range logs {
+		ks.setLog(k, h)
+	}
+	for k, size := range sizes {
+		if _, ok := fields[k]; ok {
+			continue
+		}
+		members := ranked(ks, k)
+		for i := 0; i < len(members)-size; i++ {
+			ks.zrem(k, members[i].Member)
+		}
+	}
+	for k, fs := range fields {
+		names := make([]string, 0, len(fs))
+		for f := range fs {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		for _, f := range names {
+			field := f
+			if _, ok := ks.hget(k, f); !ok && ks.hlen(k) >= sizes[k] {
+				field = CrosstabOther
+			}
+			current, _ := ks.hget(k, field)
+			v, _ := strconv.ParseInt(current, 10, 64)
+			ks.hset(k, field, strconv.FormatInt(v+fs[f], 10))
+		}
+	}
+	for _, e := range index {
+		touch(ks, e.Buckets, now)
+		touch(ks, e.Counters, now)
+		ks.zadd(e.Buckets, strconv.FormatInt(e.ID, 10), float64(e.ID))
+		for _, n := range e.Names {
+			ks.sadd(e.Counters, n)
+		}
+		if e.TTL > 0 {
+			expire(ks, e.Counters, e.TTL, now)
+			cutoff, err := strconv.ParseInt(e.Cutoff, 10, 64)
+			if err == nil {
+				zremBelow(ks, e.Buckets, float64(cutoff))
+			}
+		}
+	}
+	return suppressed
+}
+
+// fresh reports whether an update has not been applied before, and records that it has now been
+func fresh(ks keyspace, u *Update, replayWindow time.Duration, now time.Time) bool {
+	if u.Partition != "" {
+		current, _ := ks.hget(offsetsKey, u.Partition)
+		applied, err := strconv.ParseInt(current, 10, 64)
+		if err == nil && applied >= u.Offset {
+			return false
+		}
+		ks.hset(offsetsKey, u.Partition, strconv.FormatInt(u.Offset, 10))
+		return true
+	}
+	if u.EventID == "" || replayWindow <= 0 {
+		return true
+	}
+	key := eventMarkerPrefix + u.EventID
+	touch(ks, key, now)
+	if _, ok := ks.counter(key); ok {
+		return false
+	}
+	ks.setCounter(key, 1)
+	expire(ks, key, replayWindow, now)
+	return true
+}
@@ -0,0 +1,143 @@
+package aggregator
+
+import (
+	"time"
+)
+
+// NewMemoryStore returns an empty MemoryStore
+// Event IDs are remembered for replayWindow to detect replays of events without a partition offset. Zero disables this.
+func NewMemoryStore(replayWindow time.Duration) *MemoryStore {
+	s := &MemoryStore{data: &memoryKeyspace{
+		counters: make(map[string]int64),
+		logs:     make(map[string]*hyperLogLog),
+		zsets:    make(map[string]map[string]float64),
+		hashes:   make(map[string]map[string]string),
+		sets:     make(map[string]map[string]bool),
+		expires:  make(map[string]time.Time),
+	}}
+	s.keyStore = newKeyStore(s, replayWindow)
+	return s
+}
+
+// view runs fn on the maps of the store, alongside other reads
+func (s *MemoryStore) view(fn func(ks keyspace)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(s.data)
+	return nil
+}
+
+// update runs fn on the maps of the store, alone
+func (s *MemoryStore) update(fn func(ks keyspace)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.data)
+	return nil
+}
+
+// Close does nothing, as there is nothing to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryKeyspace) counter(key string) (int64, bool) {
+	v, ok := m.counters[key]
+	return v, ok
+}
+
+func (m *memoryKeyspace) setCounter(key string, v int64) {
+	m.counters[key] = v
+}
+
+func (m *memoryKeyspace) log(key string) *hyperLogLog {
+	return m.logs[key]
+}
+
+func (m *memoryKeyspace) setLog(key string, h *hyperLogLog) {
+	m.logs[key] = h
+}
+
+func (m *memoryKeyspace) sorted(key string) map[string]float64 {
+	return m.zsets[key]
+}
+
+func (m *memoryKeyspace) zscore(key string, member string) (float64, bool) {
+	score, ok := m.zsets[key][member]
+	return score, ok
+}
+
+func (m *memoryKeyspace) zadd(key string, member string, score float64) {
+	if m.zsets[key] == nil {
+		m.zsets[key] = make(map[string]float64)
+	}
+	m.zsets[key][member] = score
+}
+
+func (m *memoryKeyspace) zrem(key string, member string) {
+	delete(m.zsets[key], member)
+}
+
+func (m *memoryKeyspace) hash(key string) map[string]string {
+	return m.hashes[key]
+}
+
+func (m *memoryKeyspace) hget(key string, field string) (string, bool) {
+	v, ok := m.hashes[key][field]
+	return v, ok
+}
+
+func (m *memoryKeyspace) hset(key string, field string, v string) {
+	if m.hashes[key] == nil {
+		m.hashes[key] = make(map[string]string)
+	}
+	m.hashes[key][field] = v
+}
+
+func (m *memoryKeyspace) hdel(key string, field string) {
+	delete(m.hashes[key], field)
+}
+
+func (m *memoryKeyspace) hlen(key string) int {
+	return len(m.hashes[key])
+}
+
+func (m *memoryKeyspace) members(key string) []string {
+	out := make([]string, 0, len(m.sets[key]))
+	for n := range m.sets[key] {
+		out = append(out, n)
+	}
+	return out
+}
+
+func (m *memoryKeyspace) sadd(key string, member string) {
+	if m.sets[key] == nil {
+		m.sets[key] = make(map[string]bool)
+	}
+	m.sets[key][member] = true
+}
+
+func (m *memoryKeyspace) expiry(key string) (time.Time, bool) {
+	exp, ok := m.expires[key]
+	return exp, ok
+}
+
+func (m *memoryKeyspace) expire(key string, at time.Time) {
+	m.expires[key] = at
+}
+
+func (m *memoryKeyspace) del(key string) {
+	delete(m.counters, key)
+	delete(m.logs, key)
+	delete(m.zsets, key)
+	delete(m.hashes, key)
+	delete(m.sets, key)
+	delete(m.expires, key)
+}
+
+func (m *memoryKeyspace) expiring() []string {
+	out := make([]string, 0, len(m.expires))
+	for k := range m.expires {
+		out = append(out, k)
+	}
+	return out
+}
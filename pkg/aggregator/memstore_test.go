@@ -0,0 +1,126 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryStore", func() {
+	ctx := context.Background()
+	bk := &Bucketing{Resolutions: []*bucket.Resolution{bucket.Hour, bucket.Day}, Zones: []*bucket.Zone{bucket.UTC}}
+	var now time.Time
+	var s *MemoryStore
+
+	BeforeEach(func() {
+		now = time.Date(2020, 8, 10, 10, 50, 38, 0, time.UTC)
+		s = NewMemoryStore(time.Hour)
+		s.now = func() time.Time { return now }
+	})
+
+	It("counts events once and indexes their buckets", func() {
+		rs, err := ParseRules([]byte(`{"counters": [{"name": "pleiades_total"}, {"name": "users", "distinct": "user"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		u, err := Aggregate(rs, bk, &transport.Message{
+			ID:   `[{"timestamp":1597056638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit","user":"Foo"}`),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		u.EventID = "e1"
+		n, err := s.Apply(ctx, []*Update{u, u})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(1))
+
+		counters, err := s.Counters(ctx, []string{"pleiades_total", "day_18484_pleiades_total", "day_18483_pleiades_total"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).Should(Equal(map[string]int64{"pleiades_total": 1, "day_18484_pleiades_total": 1}))
+		distinct, err := s.Distinct(ctx, [][]string{{"day_18484_uniq_users", "hour_443626_uniq_users"}, {"day_18483_uniq_users"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(distinct).Should(Equal([]int64{1, 0}))
+
+		ids, err := s.Buckets(ctx, bucket.Day)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).Should(Equal([]int64{18484}))
+		names, err := s.Names(ctx, bucket.Day.Bucket(18484))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).Should(ConsistOf("pleiades_total", "uniq_users"))
+	})
+
+	It("skips offsets already applied", func() {
+		inc := []Increment{{Key: "pleiades_total", Delta: 1}}
+		n, err := s.Apply(ctx, []*Update{{Partition: "0", Offset: 5, Increments: inc}, {Partition: "0", Offset: 5, Increments: inc}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(1))
+		Expect(s.SetAppliedOffsets(ctx, map[string]int64{"0": 4})).To(Succeed())
+		n, err = s.Apply(ctx, []*Update{{Partition: "0", Offset: 5, Increments: inc}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(0))
+		counters, err := s.Counters(ctx, []string{"pleiades_total"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters["pleiades_total"]).To(Equal(int64(2)))
+	})
+
+	It("expires keys after their TTL", func() {
+		_, err := s.Apply(ctx, []*Update{{Increments: []Increment{{Key: "minute_1_pleiades_total", Delta: 1, TTL: time.Minute}}}})
+		Expect(err).NotTo(HaveOccurred())
+		now = now.Add(time.Minute)
+		counters, err := s.Counters(ctx, []string{"minute_1_pleiades_total"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).Should(BeEmpty())
+		_, err = s.Apply(ctx, []*Update{{Increments: []Increment{{Key: "minute_1_pleiades_total", Delta: 2, TTL: time.Minute}}}})
+		Expect(err).NotTo(HaveOccurred())
+		counters, err = s.Counters(ctx, []string{"minute_1_pleiades_total"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters["minute_1_pleiades_total"]).To(Equal(int64(2)))
+	})
+
+	It("trims sorted sets and overflows hashes", func() {
+		_, err := s.Apply(ctx, []*Update{{Increments: []Increment{
+			{Key: "top_pages", Member: "a", Delta: 3, Size: 2},
+			{Key: "top_pages", Member: "b", Delta: 1, Size: 2},
+			{Key: "top_pages", Member: "c", Delta: 2, Size: 2},
+			{Key: "xtab_events", Field: "enwiki", Delta: 1, Size: 1},
+			{Key: "xtab_events", Field: "dewiki", Delta: 1, Size: 1},
+		}}})
+		Expect(err).NotTo(HaveOccurred())
+		top, err := s.Top(ctx, "top_pages", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(top).Should(Equal([]Scored{{Member: "a", Score: 3}, {Member: "c", Score: 2}}))
+		hashes, err := s.Hashes(ctx, []string{"xtab_events", "xtab_none"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hashes).Should(Equal([]map[string]string{{"dewiki": "1", CrosstabOther: "1"}, {}}))
+	})
+
+	It("records the watermark and finalized buckets", func() {
+		Expect(s.Finalize(ctx, now, []bucket.Bucket{bucket.Day.Bucket(18483)})).To(Succeed())
+		Expect(s.Finalize(ctx, now.Add(-time.Hour), nil)).To(Succeed())
+		wm, err := s.Watermark(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wm.Equal(now)).To(BeTrue())
+		ok, err := s.IsFinalized(ctx, bucket.Day.Bucket(18483))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		finalized, err := s.Finalized(ctx, bucket.Day)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(finalized).Should(Equal(map[int64]bool{18483: true}))
+	})
+
+	It("forgets hot pages flagged before the window", func() {
+		window := time.Hour
+		Expect(s.FlagHotPages(ctx, []*HotPage{{Page: "enwiki:A", Time: now.Unix() - 7200}}, window)).To(Succeed())
+		Expect(s.FlagHotPages(ctx, []*HotPage{{Page: "enwiki:B", Time: now.Unix()}}, window)).To(Succeed())
+		top, err := s.Top(ctx, HotPagesKey, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(top).Should(HaveLen(1))
+		Expect(top[0].Member).To(Equal("enwiki:B"))
+		hashes, err := s.Hashes(ctx, []string{HotPagesInfoKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hashes[0]).Should(HaveKey("enwiki:B"))
+		Expect(hashes[0]).ShouldNot(HaveKey("enwiki:A"))
+	})
+})
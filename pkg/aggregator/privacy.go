@@ -0,0 +1,24 @@
+package aggregator
+
+import (
+	"github.com/gargath/pleiades/pkg/privacy"
+)
+
+// UsePrivacy makes the rule set store only what is left of events after applying the given policy, which may be nil
+// Conditions and signals still see the whole event, so that e.g. reverts are counted although their comment is dropped.
+func (rs *RuleSet) UsePrivacy(p *privacy.Policy) {
+	rs.privacy = p
+}
+
+// private returns a copy of an event with the privacy policy of the rule set applied, or the event itself if it has none
+func (rs *RuleSet) private(event map[string]interface{}) map[string]interface{} {
+	if rs.privacy == nil {
+		return event
+	}
+	out := make(map[string]interface{}, len(event))
+	for k, v := range event {
+		out[k] = v
+	}
+	rs.privacy.Apply(out)
+	return out
+}
@@ -0,0 +1,388 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// reaggregateBatchSize is the number of events whose updates are written to the staging namespace together
+	reaggregateBatchSize = 1000
+	// maxZoneOffset is the largest difference between UTC and the time of any time zone
+	maxZoneOffset = 14 * time.Hour
+)
+
+// NewReaggregation prepares rebuilding the counters of the days from to to (inclusive) with the given rules
+// Only buckets lying entirely within these days are rebuilt, e.g. a week bucket is only rebuilt if all its days are.
+// Calendar buckets are rebuilt for the days in their own time zone, including those aligned to wikis' home time zones.
+func NewReaggregation(r *redis.Client, rs *RuleSet, bk *Bucketing, from int64, to int64) *Reaggregation {
+	prefix := fmt.Sprintf("reaggregate_%d_", time.Now().UnixNano())
+	if bk == nil {
+		bk = DefaultBucketing()
+	}
+	g := &Reaggregation{
+		from:    bucket.Day.Bucket(from).Start(),
+		to:      bucket.Day.Bucket(to).End(),
+		rules:   rs,
+		buckets: bk,
+		r:       r,
+		prefix:  prefix,
+		staging: NewStore(r, 0).Staged(prefix),
+	}
+	g.start, g.end = g.from, g.to
+	for _, z := range bk.Zones {
+		day := bucket.Day.In(z)
+		if start := day.Bucket(from).Start(); start.Before(g.start) {
+			g.start = start
+		}
+		if end := day.Bucket(to).End(); end.After(g.end) {
+			g.end = end
+		}
+	}
+	if bk.Home != nil {
+		g.start, g.end = g.from.Add(-maxZoneOffset), g.to.Add(maxZoneOffset)
+	}
+	return g
+}
+
+// Window returns the time range covered by the days being rebuilt in any of the time zones buckets are aligned to,
+// from the beginning of the first day up to the beginning of the day following the last one
+func (g *Reaggregation) Window() (time.Time, time.Time) {
+	return g.start, g.end
+}
+
+// Covered reports whether events were read from before the beginning of the window until after its end, so none of
+// the days rebuilt is missing events the source no longer retains
+func (g *Reaggregation) Covered() bool {
+	return !g.first.IsZero() && !g.first.After(g.start) && !g.last.Before(g.end)
+}
+
+// families returns the bucket families being rebuilt, including those aligned to wikis' home time zones
+func (g *Reaggregation) families() []*bucket.Resolution {
+	out := g.buckets.Aligned()
+	if g.buckets.Home != nil {
+		for _, r := range g.buckets.Resolutions {
+			if r.Calendar() {
+				out = append(out, r.In(homeUTC))
+			}
+		}
+	}
+	return out
+}
+
+// rebuilds reports whether a bucket lies entirely within the days being rebuilt
+// Calendar buckets are compared by their dates, as their IDs number the days of their own time zone.
+func (g *Reaggregation) rebuilds(b bucket.Bucket) bool {
+	if b.Resolution.Calendar() {
+		b = b.Resolution.In(bucket.UTC).Bucket(b.ID)
+	}
+	return b.Within(g.from, g.to)
+}
+
+// Events returns the number of events counted so far
+func (g *Reaggregation) Events() int {
+	return g.events
+}
+
+// Add counts a single message if it belongs to one of the days being rebuilt
+// Messages that cannot be aggregated are logged and skipped.
+func (g *Reaggregation) Add(ctx context.Context, msg *transport.Message) error {
+	ts, err := ParseTimestamp(msg.ID)
+	if err != nil {
+		logger.Warningf("Skipping message without timestamp: %s", msg.ID)
+		return nil
+	}
+	t := EventTime(ts)
+	if g.first.IsZero() || t.Before(g.first) {
+		g.first = t
+	}
+	if t.After(g.last) {
+		g.last = t
+	}
+	if t.Before(g.start) || !t.Before(g.end) {
+		return nil
+	}
+	event, err := decodeEvent(msg.Data)
+	if err != nil {
+		logger.Warningf("Skipping message %s: %v", msg.ID, err)
+		return nil
+	}
+	var buckets []bucket.Bucket
+	for _, b := range g.buckets.Buckets(t, eventWiki(event)) {
+		if g.rebuilds(b) {
+			buckets = append(buckets, b)
+		}
+	}
+	g.pending = append(g.pending, &Update{Increments: Bucketed(countersFromEvent(g.rules, event), buckets)})
+	g.events++
+	if len(g.pending) >= reaggregateBatchSize {
+		return g.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the pending updates to the staging namespace
+func (g *Reaggregation) Flush(ctx context.Context) error {
+	_, err := g.staging.Apply(ctx, g.pending)
+	if err != nil {
+		return err
+	}
+	g.pending = nil
+	return nil
+}
+
+// Diff compares the rebuilt counters with the live ones and returns those that differ, sorted by key and member
+// Leaderboards, cross-tabs and histograms are compared by each of their members, fields and bins.
+func (g *Reaggregation) Diff(ctx context.Context) ([]CounterDiff, error) {
+	live, err := g.values(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	staged, err := g.values(ctx, g.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var out []CounterDiff
+	for k, v := range staged {
+		if live[k] != v {
+			out = append(out, CounterDiff{Key: k.key, Member: k.member, Old: live[k], New: v})
+		}
+	}
+	for k, v := range live {
+		if _, ok := staged[k]; !ok {
+			out = append(out, CounterDiff{Key: k.key, Member: k.member, Old: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Key != out[j].Key {
+			return out[i].Key < out[j].Key
+		}
+		return out[i].Member < out[j].Member
+	})
+	return out, nil
+}
+
+// keys returns the keys of all counters in the rebuilt buckets, live ones for an empty prefix or staged ones for the staging prefix
+// Live keys are listed from the bucket index and staged ones, which are not indexed, with SCAN, so Redis is never blocked.
+func (g *Reaggregation) keys(ctx context.Context, prefix string) ([]string, error) {
+	if prefix == "" {
+		return g.indexedKeys(ctx)
+	}
+	var out []string
+	for _, res := range g.families() {
+		keys, err := scanKeys(ctx, g.r, prefix+res.KeyPattern())
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			b, ok := res.FromKey(strings.TrimPrefix(k, prefix))
+			if ok && g.rebuilds(b) {
+				out = append(out, k)
+			}
+		}
+	}
+	return out, nil
+}
+
+// indexedKeys returns the keys of all live counters in the rebuilt buckets as recorded in the bucket index
+func (g *Reaggregation) indexedKeys(ctx context.Context) ([]string, error) {
+	var buckets []bucket.Bucket
+	for _, res := range g.families() {
+		ids, err := g.r.ZRange(ctx, res.IndexKey(), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ids {
+			id, err := strconv.ParseInt(m, 10, 64)
+			if err != nil {
+				continue
+			}
+			if b := res.Bucket(id); g.rebuilds(b) {
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	names := make([]*redis.StringSliceCmd, len(buckets))
+	_, err := g.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, b := range buckets {
+			names[i] = pipe.SMembers(ctx, b.IndexKey())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for i, b := range buckets {
+		for _, n := range names[i].Val() {
+			out = append(out, b.Prefix()+n)
+		}
+	}
+	return out, nil
+}
+
+// values returns the values of all counters in the rebuilt buckets, keyed by their name without the staging prefix
+// Counters of distinct values are represented by their estimated cardinality, and leaderboards, cross-tabs and
+// histograms by the value of each of their members.
+func (g *Reaggregation) values(ctx context.Context, prefix string) (map[counterMember]int64, error) {
+	keys, err := g.keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[counterMember]int64)
+	var counters []string
+	distinct := make(map[string]*redis.IntCmd)
+	ranked := make(map[string]*redis.ZSliceCmd)
+	hashes := make(map[string]*redis.StringStringMapCmd)
+	_, err = g.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			switch counterKind(strings.TrimPrefix(k, prefix)) {
+			case DistinctPrefix:
+				distinct[k] = pipe.PFCount(ctx, k)
+			case TopPrefix:
+				ranked[k] = pipe.ZRangeWithScores(ctx, k, 0, -1)
+			case CrosstabPrefix, HistogramPrefix:
+				hashes[k] = pipe.HGetAll(ctx, k)
+			default:
+				counters = append(counters, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k, cmd := range distinct {
+		out[counterMember{key: strings.TrimPrefix(k, prefix)}] = cmd.Val()
+	}
+	for k, cmd := range ranked {
+		for _, z := range cmd.Val() {
+			out[counterMember{key: strings.TrimPrefix(k, prefix), member: fmt.Sprint(z.Member)}] = int64(z.Score)
+		}
+	}
+	for k, cmd := range hashes {
+		for f, s := range cmd.Val() {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of %s is not an integer: %v", f, k, err)
+			}
+			out[counterMember{key: strings.TrimPrefix(k, prefix), member: f}] = v
+		}
+	}
+	for _, chunk := range chunks(counters, compactionChunk) {
+		vals, err := g.r.MGet(ctx, chunk...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, k := range chunk {
+			s, ok := vals[i].(string)
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("counter %s is not an integer: %v", k, err)
+			}
+			out[counterMember{key: strings.TrimPrefix(k, prefix)}] = v
+		}
+	}
+	return out, nil
+}
+
+// counterKind returns the prefix of the name of the counter a bucket key holds, which determines its Redis type, or an
+// empty string for plain counters
+func counterKind(key string) string {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	for _, p := range []string{DistinctPrefix, TopPrefix, CrosstabPrefix, HistogramPrefix} {
+		if strings.HasPrefix(parts[2], p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Commit replaces the live counters of the rebuilt buckets with the staged ones
+// Each bucket is swapped in its own transaction along with its entry in the bucket index, so readers see either the
+// old or the new counters of a bucket and Redis is never blocked for longer than one bucket takes. Nothing is replaced
+// unless the events read cover the whole window, as the source may no longer retain some of them.
+func (g *Reaggregation) Commit(ctx context.Context) error {
+	if !g.Covered() {
+		return fmt.Errorf("%w: read events from %s to %s, but need %s to %s", ErrIncompleteSource,
+			g.first.Format(time.RFC3339), g.last.Format(time.RFC3339), g.start.Format(time.RFC3339), g.end.Format(time.RFC3339))
+	}
+	err := g.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	live, err := g.keys(ctx, "")
+	if err != nil {
+		return err
+	}
+	staged, err := g.keys(ctx, g.prefix)
+	if err != nil {
+		return err
+	}
+	liveIndex, stagedIndex := make(bucketIndex), make(bucketIndex)
+	liveIndex.addKeys(g.families(), "", live)
+	stagedIndex.addKeys(g.families(), g.prefix, staged)
+	buckets := make(bucketIndex)
+	for k, e := range liveIndex {
+		buckets[k] = e
+	}
+	for k, e := range stagedIndex {
+		buckets[k] = e
+	}
+	now := time.Now()
+	for _, b := range buckets.sorted() {
+		k := b.bucket.IndexKey()
+		_, err = g.r.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if e, ok := liveIndex[k]; ok {
+				for _, n := range e.sortedNames() {
+					pipe.Del(ctx, e.bucket.Prefix()+n)
+				}
+				unindex(ctx, pipe, "", e.bucket)
+			}
+			if e, ok := stagedIndex[k]; ok {
+				for _, n := range e.sortedNames() {
+					pipe.Rename(ctx, g.prefix+e.bucket.Prefix()+n, e.bucket.Prefix()+n)
+				}
+				bucketIndex{k: e}.write(ctx, pipe, now)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to swap in rebuilt counters of %s: %v", k, err)
+		}
+	}
+	logger.Infof("Replaced %d counters with %d rebuilt ones in %d buckets", len(live), len(staged), len(buckets))
+	return nil
+}
+
+// Discard deletes the staged counters, listing them with SCAN and deleting them a chunk at a time
+func (g *Reaggregation) Discard(ctx context.Context) error {
+	keys, err := scanKeys(ctx, g.r, g.prefix+"*")
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks(keys, compactionChunk) {
+		err = g.r.Del(ctx, chunk...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reaggregation", func() {
+
+	It("covers whole days", func() {
+		g := NewReaggregation(nil, nil, nil, 18484, 18485)
+		from, to := g.Window()
+		Expect(from).Should(Equal(time.Date(2020, 8, 10, 0, 0, 0, 0, time.UTC)))
+		Expect(to).Should(Equal(time.Date(2020, 8, 12, 0, 0, 0, 0, time.UTC)))
+	})
+
+	It("only counts buckets lying within the days being rebuilt", func() {
+		rs, _ := LoadRules("")
+		g := NewReaggregation(nil, rs, &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Hour, bucket.Day, bucket.Week},
+			Zones:       []*bucket.Zone{bucket.UTC},
+		}, 18484, 18484)
+		ctx := context.Background()
+		Expect(g.Add(ctx, &transport.Message{
+			ID:   `[{"timestamp":1597056638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit"}`),
+		})).To(Succeed())
+		Expect(g.Add(ctx, &transport.Message{
+			ID:   `[{"timestamp":1597156638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit"}`),
+		})).To(Succeed())
+		Expect(g.Add(ctx, &transport.Message{ID: "garbage", Data: []byte(`{}`)})).To(Succeed())
+		Expect(g.Events()).Should(Equal(1))
+		Expect(g.pending[0].Increments).Should(ContainElement(Increment{Key: "day_18484_pleiades_total", Delta: 1}))
+		Expect(g.pending[0].Increments).Should(ContainElement(Increment{Key: "hour_443626_pleiades_total", Delta: 1, TTL: bucket.Hour.TTL}))
+		Expect(g.pending[0].Increments).ShouldNot(ContainElement(Increment{Key: "pleiades_total", Delta: 1}))
+		Expect(g.pending[0].Increments).ShouldNot(ContainElement(Increment{Key: "week_202033_pleiades_total", Delta: 1}))
+	})
+	It("rebuilds the days of every time zone", func() {
+		berlin, err := bucket.LoadZone("Europe/Berlin")
+		Expect(err).NotTo(HaveOccurred())
+		home, err := LoadHomeZones("")
+		Expect(err).NotTo(HaveOccurred())
+		rs, _ := LoadRules("")
+		g := NewReaggregation(nil, rs, &Bucketing{
+			Resolutions: []*bucket.Resolution{bucket.Day},
+			Zones:       []*bucket.Zone{bucket.UTC, berlin},
+			Home:        home,
+		}, 18484, 18484)
+		from, to := g.Window()
+		Expect(from).Should(Equal(time.Date(2020, 8, 9, 10, 0, 0, 0, time.UTC)))
+		Expect(to).Should(Equal(time.Date(2020, 8, 11, 14, 0, 0, 0, time.UTC)))
+		Expect(g.Add(context.Background(), &transport.Message{
+			ID:   `[{"timestamp":1597100400000}]`,
+			Data: []byte(`{"wiki":"dewiki","type":"edit"}`),
+		})).To(Succeed())
+		Expect(g.pending[0].Increments).Should(ContainElement(Increment{Key: "day_18484_pleiades_total", Delta: 1}))
+		Expect(g.pending[0].Increments).ShouldNot(ContainElement(Increment{Key: "day.Europe/Berlin_18485_pleiades_total", Delta: 1}))
+		Expect(g.pending[0].Increments).ShouldNot(ContainElement(Increment{Key: "day.home_18485_pleiades_total", Delta: 1}))
+		Expect(g.Add(context.Background(), &transport.Message{
+			ID:   `[{"timestamp":1597012200000}]`,
+			Data: []byte(`{"wiki":"dewiki","type":"edit"}`),
+		})).To(Succeed())
+		Expect(g.pending[1].Increments).Should(ContainElement(Increment{Key: "day.Europe/Berlin_18484_pleiades_total", Delta: 1}))
+		Expect(g.pending[1].Increments).Should(ContainElement(Increment{Key: "day.home_18484_pleiades_total", Delta: 1}))
+	})
+
+	It("is only covered by events from before the first day until after the last", func() {
+		rs, _ := LoadRules("")
+		g := NewReaggregation(nil, rs, nil, 18484, 18484)
+		ctx := context.Background()
+		Expect(g.Covered()).Should(BeFalse())
+		Expect(g.Add(ctx, &transport.Message{ID: `[{"timestamp":1597056638001}]`, Data: []byte(`{}`)})).To(Succeed())
+		Expect(g.Add(ctx, &transport.Message{ID: `[{"timestamp":1597190400000}]`, Data: []byte(`{}`)})).To(Succeed())
+		Expect(g.Covered()).Should(BeFalse())
+		err := g.Commit(ctx)
+		Expect(errors.Is(err, ErrIncompleteSource)).Should(BeTrue())
+		Expect(g.Add(ctx, &transport.Message{ID: `[{"timestamp":1597010000000}]`, Data: []byte(`{}`)})).To(Succeed())
+		Expect(g.Covered()).Should(BeTrue())
+	})
+	It("compares every kind of counter", func() {
+		Expect(counterKind("day_18484_pleiades_total")).Should(Equal(""))
+		Expect(counterKind("day_18484_uniq_users")).Should(Equal(DistinctPrefix))
+		Expect(counterKind("day_18484_top_pages")).Should(Equal(TopPrefix))
+		Expect(counterKind("day_18484_xtab_wiki_type")).Should(Equal(CrosstabPrefix))
+		Expect(counterKind("hour_443616_hist_length")).Should(Equal(HistogramPrefix))
+		Expect(counterKind("pleiades_total")).Should(Equal(""))
+	})
+})
@@ -0,0 +1,384 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/sitematrix"
+)
+
+// DefaultRules is the rule set used when no rules file is configured
+// It produces the counters Pleiades has always maintained, plus namespace, log, family and language breakdowns, unique counts, leaderboards, cross-tabs of wiki, type and bot and of family, language, type and bot, a histogram of edit sizes
+// and counters and leaderboards of the revert, blanking, anonymous removal and new user signals.
+const DefaultRules = `{
+  "counters": [
+    {"name": "pleiades_total"},
+    {"name": "pleiades_wiki", "dimension": "wiki"},
+    {"name": "pleiades_type", "dimension": "type"},
+    {"name": "pleiades_bot", "when": "bot"},
+    {"name": "pleiades_minor", "when": "minor"},
+    {"name": "pleiades_length_inc", "when": "length && length.old < length.new"},
+    {"name": "pleiades_length_dec", "when": "length && length.old >= length.new"},
+    {"name": "pleiades_growth", "sum": "length.new - length.old"},
+    {"name": "pleiades_namespace", "dimension": "nsname(namespace)"},
+    {"name": "pleiades_log", "when": "type == \"log\"", "dimension": "log_type"},
+    {"name": "pleiades_family", "dimension": "family"},
+    {"name": "pleiades_language", "dimension": "language"},
+    {"name": "pleiades_log_action", "when": "type == \"log\" && log_type && log_action", "dimension": "log_type + \"/\" + log_action"},
+    {"name": "users", "distinct": "user"},
+    {"name": "wiki_users", "dimension": "wiki", "distinct": "user"},
+    {"name": "pages", "when": "title", "distinct": "wiki + \":\" + title"},
+    {"name": "wiki_pages", "dimension": "wiki", "distinct": "title"},
+    {"name": "pages", "when": "title", "top": "wiki + \":\" + title"},
+    {"name": "users", "top": "user"},
+    {"name": "human_users", "when": "!bot", "top": "user"},
+    {"name": "growth", "when": "title", "top": "wiki + \":\" + title", "sum": "length.new - length.old"},
+    {"name": "wikis", "top": "wiki"},
+    {"name": "events", "dimensions": ["wiki", "type", "bot"]},
+    {"name": "sites", "when": "family", "dimensions": ["family", "language", "type", "bot"]},
+    {"name": "growth", "when": "length", "histogram": "length.new - length.old"},
+    {"name": "pleiades_signal_revert", "when": "revert"},
+    {"name": "pleiades_signal_revert_wiki", "when": "revert", "dimension": "wiki"},
+    {"name": "revert_pages", "when": "title && revert", "top": "wiki + \":\" + title"},
+    {"name": "pleiades_signal_blanking", "when": "type == \"edit\" && length && is_blanking(length.old, length.new)"},
+    {"name": "pleiades_signal_blanking_wiki", "when": "type == \"edit\" && length && is_blanking(length.old, length.new)", "dimension": "wiki"},
+    {"name": "blanking_pages", "when": "title && type == \"edit\" && length && is_blanking(length.old, length.new)", "top": "wiki + \":\" + title"},
+    {"name": "pleiades_signal_ip_removal", "when": "length && is_ip(user) && is_large_removal(length.old, length.new)"},
+    {"name": "pleiades_signal_ip_removal_wiki", "when": "length && is_ip(user) && is_large_removal(length.old, length.new)", "dimension": "wiki"},
+    {"name": "ip_removal_pages", "when": "title && length && is_ip(user) && is_large_removal(length.old, length.new)", "top": "wiki + \":\" + title"},
+    {"name": "pleiades_signal_new_user", "when": "type == \"edit\" && is_new_user(user, timestamp)"},
+    {"name": "pleiades_signal_new_user_wiki", "when": "type == \"edit\" && is_new_user(user, timestamp)", "dimension": "wiki"},
+    {"name": "new_user_pages", "when": "title && type == \"edit\" && is_new_user(user, timestamp)", "top": "wiki + \":\" + title"}
+  ]
+}`
+
+const (
+	// DistinctPrefix prefixes the names of counters of distinct values, which are kept as HyperLogLogs
+	DistinctPrefix = "uniq_"
+	// TopPrefix prefixes the names of leaderboards, which are kept as sorted sets
+	TopPrefix = "top_"
+	// DefaultTopSize is the number of entries leaderboards are trimmed to unless their rule sets a size
+	DefaultTopSize = 100
+	// CrosstabPrefix prefixes the names of cross-tabs, which are kept as hashes
+	CrosstabPrefix = "xtab_"
+	// DefaultCrosstabSize is the number of fields cross-tabs are capped at unless their rule sets a size
+	DefaultCrosstabSize = 10000
+	// CrosstabOther is the cross-tab field events are counted in once a cross-tab has reached its size
+	CrosstabOther = "_other"
+)
+
+// crosstabEscaper replaces the characters separating cross-tab dimensions and their values in field names
+var crosstabEscaper = strings.NewReplacer("|", "_", "=", "_")
+
+// RuleSpec is the declarative form of a counter rule as found in a rules file
+//
+// A rule increments the counter Name by one for every event matching When. If Dimension is set, its value
+// is appended to the counter name, creating one counter per distinct value. If Sum is set, the counter is
+// incremented by its value instead of by one. If Distinct is set, the counter instead estimates the number
+// of distinct values it takes, and its name is prefixed with DistinctPrefix. If Top is set, the rule instead
+// maintains a leaderboard prefixed with TopPrefix, ranking the values of Top by how often (or by how much,
+// with Sum) they were counted. Leaderboards are trimmed to their Size highest ranking entries.
+// If Dimensions are set, the rule maintains a cross-tab prefixed with CrosstabPrefix instead, counting
+// events by the combination of the values of all Dimensions. Cross-tabs are capped at Size combinations,
+// after which events with new combinations are counted in CrosstabOther.
+// If Histogram is set, the rule maintains a histogram prefixed with HistogramPrefix instead, counting events
+// by the log-scale bin the value of Histogram falls into. The bins' bounds are the powers of Base up to Max.
+type RuleSpec struct {
+	Name       string   `json:"name"`
+	When       string   `json:"when,omitempty"`
+	Dimension  string   `json:"dimension,omitempty"`
+	Sum        string   `json:"sum,omitempty"`
+	Distinct   string   `json:"distinct,omitempty"`
+	Top        string   `json:"top,omitempty"`
+	Dimensions []string `json:"dimensions,omitempty"`
+	Size       int      `json:"size,omitempty"`
+	Histogram  string   `json:"histogram,omitempty"`
+	Base       float64  `json:"base,omitempty"`
+	Max        float64  `json:"max,omitempty"`
+}
+
+// RulesFile is the top-level structure of a rules file
+type RulesFile struct {
+	Counters []RuleSpec `json:"counters"`
+}
+
+// Rule is a compiled counter rule
+type Rule struct {
+	Name      string
+	When      Expr
+	Dimension Expr
+	Sum       Expr
+	Distinct  Expr
+	Top       Expr
+	// Dimensions of a cross-tab, with the names they are stored under
+	Dimensions     []Expr
+	DimensionNames []string
+	Size           int
+	Histogram      Expr
+	// Bounds are the upper bounds of the histogram's bins
+	Bounds []float64
+}
+
+// RuleSet is a compiled set of counter rules
+type RuleSet struct {
+	Rules   []*Rule
+	signals *signalState
+	sites   *sitematrix.Matrix
+	privacy *privacy.Policy
+}
+
+// Increment is a change to be applied to a single counter
+type Increment struct {
+	Key   string
+	Delta int64
+	// TTL is set for counters that expire some time after they were first incremented
+	TTL time.Duration
+	// Value, if set, is added to the HyperLogLog at Key instead of incrementing it by Delta
+	Value string
+	// Member, if set, has its score in the sorted set at Key incremented by Delta instead, after which
+	// the set is trimmed to its Size highest scoring members
+	Member string
+	// Field, if set, is incremented by Delta in the hash at Key instead. If the hash already has Size fields,
+	// CrosstabOther is incremented instead of adding a new one
+	Field string
+	Size  int
+}
+
+// ParseRules compiles a rule set from its JSON representation
+func ParseRules(data []byte) (*RuleSet, error) {
+	var f RulesFile
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %v", err)
+	}
+	rs := &RuleSet{signals: newSignalState(defaultSignals), sites: defaultSites}
+	funcs := rs.funcs()
+	for i, spec := range f.Counters {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		r := &Rule{Name: spec.Name}
+		if r.When, err = parseOptionalExpr(spec.When, funcs); err != nil {
+			return nil, fmt.Errorf("invalid condition in rule %s: %v", spec.Name, err)
+		}
+		if r.Dimension, err = parseOptionalExpr(spec.Dimension, funcs); err != nil {
+			return nil, fmt.Errorf("invalid dimension in rule %s: %v", spec.Name, err)
+		}
+		if r.Sum, err = parseOptionalExpr(spec.Sum, funcs); err != nil {
+			return nil, fmt.Errorf("invalid sum in rule %s: %v", spec.Name, err)
+		}
+		if r.Distinct, err = parseOptionalExpr(spec.Distinct, funcs); err != nil {
+			return nil, fmt.Errorf("invalid distinct value in rule %s: %v", spec.Name, err)
+		}
+		if r.Top, err = parseOptionalExpr(spec.Top, funcs); err != nil {
+			return nil, fmt.Errorf("invalid top value in rule %s: %v", spec.Name, err)
+		}
+		if r.Sum != nil && r.Distinct != nil {
+			return nil, fmt.Errorf("rule %s cannot have both a sum and a distinct value", spec.Name)
+		}
+		if r.Distinct != nil && r.Top != nil {
+			return nil, fmt.Errorf("rule %s cannot have both a distinct and a top value", spec.Name)
+		}
+		for _, d := range spec.Dimensions {
+			if strings.ContainsAny(d, "|=") {
+				return nil, fmt.Errorf("invalid dimension %s in rule %s: cross-tab dimensions must not contain | or =", d, spec.Name)
+			}
+			e, err := parseExpr(d, funcs)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dimension in rule %s: %v", spec.Name, err)
+			}
+			r.Dimensions = append(r.Dimensions, e)
+			r.DimensionNames = append(r.DimensionNames, strings.TrimSpace(d))
+		}
+		if len(r.Dimensions) > 0 && (r.Distinct != nil || r.Top != nil) {
+			return nil, fmt.Errorf("rule %s cannot have both dimensions and a distinct or top value", spec.Name)
+		}
+		if spec.Size < 0 {
+			return nil, fmt.Errorf("rule %s has a negative size", spec.Name)
+		}
+		r.Size = spec.Size
+		if r.Size == 0 && len(r.Dimensions) > 0 {
+			r.Size = DefaultCrosstabSize
+		} else if r.Size == 0 {
+			r.Size = DefaultTopSize
+		}
+		if r.Histogram, err = parseOptionalExpr(spec.Histogram, funcs); err != nil {
+			return nil, fmt.Errorf("invalid histogram value in rule %s: %v", spec.Name, err)
+		}
+		if r.Histogram != nil {
+			if r.Sum != nil || r.Distinct != nil || r.Top != nil || len(r.Dimensions) > 0 {
+				return nil, fmt.Errorf("rule %s cannot have a histogram together with a sum, distinct or top value or dimensions", spec.Name)
+			}
+			base, max := spec.Base, spec.Max
+			if base == 0 {
+				base = DefaultHistogramBase
+			}
+			if max == 0 {
+				max = DefaultHistogramMax
+			}
+			if r.Bounds, err = LogBounds(base, max); err != nil {
+				return nil, fmt.Errorf("invalid histogram in rule %s: %v", spec.Name, err)
+			}
+			r.Size = len(r.Bounds) + 1
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+	return rs, nil
+}
+
+// LoadRules compiles the rule set in the given file, or the default rule set if path is empty
+func LoadRules(path string) (*RuleSet, error) {
+	if path == "" {
+		return ParseRules([]byte(DefaultRules))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %v", path, err)
+	}
+	return ParseRules(data)
+}
+
+func parseOptionalExpr(src string, funcs map[string]ExprFunc) (Expr, error) {
+	if src == "" {
+		return nil, nil
+	}
+	return parseExpr(src, funcs)
+}
+
+// funcs returns the functions available to the rule expressions of the rule set
+// Its signal functions use the signals of the rule set in effect when they are called.
+func (rs *RuleSet) funcs() map[string]ExprFunc {
+	out := make(map[string]ExprFunc, len(ExprFuncs))
+	for name, fn := range ExprFuncs {
+		out[name] = fn
+	}
+	for name, fn := range signalFuncs(func() *signalState { return rs.signals }) {
+		out[name] = fn
+	}
+	return out
+}
+
+// UseSignals makes the rule set use the given signal heuristics, starting out without any observations
+func (rs *RuleSet) UseSignals(s *Signals) {
+	rs.signals = newSignalState(s)
+}
+
+// UseSites makes the rule set enrich events from the given sitematrix
+func (rs *RuleSet) UseSites(m *sitematrix.Matrix) {
+	rs.sites = m
+}
+
+// Evaluate applies all rules to a parsed event and returns the resulting counter increments
+// A rule that fails to evaluate is skipped and reported in the returned error, the other rules still apply.
+// Conditions are evaluated on the event as is, everything stored on the event with the privacy policy applied.
+func (rs *RuleSet) Evaluate(event map[string]interface{}) ([]Increment, error) {
+	var out []Increment
+	var errs []error
+	stored := rs.private(event)
+	for _, r := range rs.Rules {
+		inc, ok, err := r.evaluate(event, stored)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			out = append(out, inc)
+		}
+	}
+	if len(errs) > 0 {
+		return out, fmt.Errorf("failed to evaluate %d rules: %v", len(errs), errs)
+	}
+	return out, nil
+}
+
+func (r *Rule) evaluate(event map[string]interface{}, stored map[string]interface{}) (Increment, bool, error) {
+	inc := Increment{Key: r.Name, Delta: 1}
+	if r.When != nil {
+		v, err := r.When.Eval(event)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		if !Truthy(v) {
+			return inc, false, nil
+		}
+	}
+	if r.Dimension != nil {
+		v, err := r.Dimension.Eval(stored)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		dim := toString(v)
+		if dim == "" {
+			logger.Debugf("Encountered event without %s: %+v", r.Dimension, stored)
+			return inc, false, nil
+		}
+		inc.Key = r.Name + "_" + dim
+	}
+	if r.Sum != nil {
+		v, err := r.Sum.Eval(stored)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		inc.Delta = int64(math.Round(toNumber(v)))
+		if inc.Delta == 0 {
+			return inc, false, nil
+		}
+	}
+	if r.Distinct != nil {
+		v, err := r.Distinct.Eval(stored)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		inc.Value = toString(v)
+		if inc.Value == "" {
+			return inc, false, nil
+		}
+		inc.Key = DistinctPrefix + inc.Key
+		inc.Delta = 0
+	}
+	if r.Top != nil {
+		v, err := r.Top.Eval(stored)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		inc.Member = toString(v)
+		if inc.Member == "" {
+			return inc, false, nil
+		}
+		inc.Key = TopPrefix + inc.Key
+		inc.Size = r.Size
+	}
+	if len(r.Dimensions) > 0 {
+		fields := make([]string, len(r.Dimensions))
+		for i, d := range r.Dimensions {
+			v, err := d.Eval(stored)
+			if err != nil {
+				return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+			fields[i] = r.DimensionNames[i] + "=" + crosstabEscaper.Replace(toString(v))
+		}
+		inc.Key = CrosstabPrefix + inc.Key
+		inc.Field = strings.Join(fields, "|")
+		inc.Size = r.Size
+	}
+	if r.Histogram != nil {
+		v, err := r.Histogram.Eval(stored)
+		if err != nil {
+			return inc, false, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		inc.Key = HistogramPrefix + inc.Key
+		inc.Field = histogramBin(r.Bounds, toNumber(v))
+		inc.Size = r.Size
+	}
+	return inc, true, nil
+}
+
+// counter reports whether the increment applies to a plain counter rather than a HyperLogLog, leaderboard or cross-tab
+func (inc Increment) counter() bool {
+	return inc.Value == "" && inc.Member == "" && inc.Field == ""
+}
@@ -0,0 +1,240 @@
+package aggregator
+
+import (
+	"encoding/json"
+
+	"github.com/gargath/pleiades/pkg/sitematrix"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func parseEvent(data string) map[string]interface{} {
+	var event map[string]interface{}
+	err := json.Unmarshal([]byte(data), &event)
+	Expect(err).NotTo(HaveOccurred())
+	return event
+}
+
+func eval(src string, event map[string]interface{}) interface{} {
+	e, err := ParseExpr(src)
+	Expect(err).NotTo(HaveOccurred())
+	v, err := e.Eval(event)
+	Expect(err).NotTo(HaveOccurred())
+	return v
+}
+
+var _ = Describe("Rule Expressions", func() {
+
+	event := parseEvent(`{"wiki":"enwiki","type":"edit","bot":true,"namespace":0,"length":{"old":100,"new":250}}`)
+
+	It("looks up fields", func() {
+		Expect(eval("wiki", event)).Should(Equal("enwiki"))
+		Expect(eval("length.new", event)).Should(Equal(float64(250)))
+		Expect(eval("length.missing", event)).Should(BeNil())
+		Expect(eval("wiki.nested", event)).Should(BeNil())
+	})
+
+	It("evaluates conditions", func() {
+		Expect(eval(`bot && type == "edit"`, event)).Should(Equal(true))
+		Expect(eval(`bot && type != "edit"`, event)).Should(Equal(false))
+		Expect(eval(`!minor || namespace > 0`, event)).Should(Equal(true))
+		Expect(eval(`length.old < length.new`, event)).Should(Equal(true))
+		Expect(eval(`namespace == 0`, event)).Should(Equal(true))
+		Expect(eval(`missing == 0`, event)).Should(Equal(false))
+		Expect(eval(`missing == null`, event)).Should(Equal(true))
+	})
+
+	It("evaluates arithmetic with operator precedence", func() {
+		Expect(eval(`length.new - length.old`, event)).Should(Equal(float64(150)))
+		Expect(eval(`1 + 2 * 3`, event)).Should(Equal(float64(7)))
+		Expect(eval(`(1 + 2) * 3`, event)).Should(Equal(float64(9)))
+		Expect(eval(`-length.old + missing`, event)).Should(Equal(float64(-100)))
+	})
+
+	It("calls functions", func() {
+		Expect(eval(`len(wiki)`, event)).Should(Equal(float64(6)))
+		Expect(eval(`matches(wiki, "^en")`, event)).Should(Equal(true))
+		Expect(eval(`abs(length.old - length.new)`, event)).Should(Equal(float64(150)))
+		Expect(eval(`nsname(namespace)`, event)).Should(Equal("Main"))
+		Expect(eval(`nsname(14)`, event)).Should(Equal("Category"))
+		Expect(eval(`nsname(4711)`, event)).Should(Equal("4711"))
+		Expect(eval(`nsname(missing)`, event)).Should(BeNil())
+	})
+
+	It("handles non-ASCII string literals and field names", func() {
+		e := parseEvent(`{"title":"Zürich – Straße","wiki":"zh_yuewiki","größe":3}`)
+		Expect(eval(`title == "Zürich – Straße"`, e)).Should(Equal(true))
+		Expect(eval(`matches(title, "^Zürich")`, e)).Should(Equal(true))
+		Expect(eval(`größe * 2`, e)).Should(Equal(float64(6)))
+		_, err := ParseExpr(`title == « »`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`'«'`))
+	})
+
+	It("rejects malformed expressions", func() {
+		for _, src := range []string{`bot &&`, `(bot`, `"open`, `nosuchfunc(bot)`, `bot # type`, `len(wiki`} {
+			_, err := ParseExpr(src)
+			Expect(err).To(HaveOccurred(), src)
+		}
+	})
+})
+
+var _ = Describe("Counter Rules", func() {
+
+	It("reproduces the built-in counters with the default rules", func() {
+		rs, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+
+		incs, err := CountersFromEventData(rs, []byte(`{"wiki":"dewiki","type":"edit","bot":true,"minor":false,"length":{"old":300,"new":120}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ConsistOf(
+			Increment{Key: "pleiades_total", Delta: 1},
+			Increment{Key: "pleiades_wiki_dewiki", Delta: 1},
+			Increment{Key: "pleiades_type_edit", Delta: 1},
+			Increment{Key: "pleiades_bot", Delta: 1},
+			Increment{Key: "pleiades_length_dec", Delta: 1},
+			Increment{Key: "pleiades_growth", Delta: -180},
+			Increment{Key: "top_wikis", Delta: 1, Member: "dewiki", Size: DefaultTopSize},
+			Increment{Key: "pleiades_family_wikipedia", Delta: 1},
+			Increment{Key: "pleiades_language_de", Delta: 1},
+			Increment{Key: "xtab_events", Delta: 1, Field: "wiki=dewiki|type=edit|bot=true", Size: DefaultCrosstabSize},
+			Increment{Key: "xtab_sites", Delta: 1, Field: "family=wikipedia|language=de|type=edit|bot=true", Size: DefaultCrosstabSize},
+			Increment{Key: "hist_growth", Delta: 1, Field: "-128", Size: 44},
+		))
+
+		incs, err = CountersFromEventData(rs, []byte(`{"wiki":"enwiki","type":"new","minor":true,"length":{"new":42}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ConsistOf(
+			Increment{Key: "pleiades_total", Delta: 1},
+			Increment{Key: "pleiades_wiki_enwiki", Delta: 1},
+			Increment{Key: "pleiades_type_new", Delta: 1},
+			Increment{Key: "pleiades_minor", Delta: 1},
+			Increment{Key: "pleiades_length_inc", Delta: 1},
+			Increment{Key: "pleiades_growth", Delta: 42},
+			Increment{Key: "top_wikis", Delta: 1, Member: "enwiki", Size: DefaultTopSize},
+			Increment{Key: "pleiades_family_wikipedia", Delta: 1},
+			Increment{Key: "pleiades_language_en", Delta: 1},
+			Increment{Key: "xtab_events", Delta: 1, Field: "wiki=enwiki|type=new|bot=", Size: DefaultCrosstabSize},
+			Increment{Key: "xtab_sites", Delta: 1, Field: "family=wikipedia|language=en|type=new|bot=", Size: DefaultCrosstabSize},
+			Increment{Key: "hist_growth", Delta: 1, Field: "64", Size: 44},
+		))
+
+		incs, err = CountersFromEventData(rs, []byte(`{"type":"log"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ConsistOf(
+			Increment{Key: "pleiades_total", Delta: 1},
+			Increment{Key: "pleiades_type_log", Delta: 1},
+			Increment{Key: "xtab_events", Delta: 1, Field: "wiki=|type=log|bot=", Size: DefaultCrosstabSize},
+		))
+	})
+
+	It("supports dimensions, conditions and sums in custom rules", func() {
+		rs, err := ParseRules([]byte(`{"counters": [
+			{"name": "ns", "dimension": "namespace"},
+			{"name": "bot_edits", "when": "bot && type == \"edit\""},
+			{"name": "bot_bytes", "when": "bot", "sum": "length.new - length.old"}
+		]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		incs, err := rs.Evaluate(parseEvent(`{"type":"edit","bot":true,"namespace":4,"length":{"old":10,"new":15}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ConsistOf(
+			Increment{Key: "ns_4", Delta: 1},
+			Increment{Key: "bot_edits", Delta: 1},
+			Increment{Key: "bot_bytes", Delta: 5},
+		))
+	})
+
+	It("enriches events with the family and language of their wiki", func() {
+		rs, _ := LoadRules("")
+		incs, err := CountersFromEventData(rs, []byte(`{"wiki":"commonswiki","type":"edit"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_family_commons", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "xtab_sites", Delta: 1, Field: "family=commons|language=|type=edit|bot=", Size: DefaultCrosstabSize}))
+		incs, err = CountersFromEventData(rs, []byte(`{"server_name":"de.wiktionary.org","type":"edit"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_family_wiktionary", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_language_de", Delta: 1}))
+		_, err = LoadSites("/does/not/exist")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("enriches events from the sitematrix of its own rule set", func() {
+		rs, _ := LoadRules("")
+		other, _ := LoadRules("")
+		rs.UseSites(sitematrix.New(sitematrix.Site{DBName: "testwiki", Family: "test"}))
+		incs, err := CountersFromEventData(rs, []byte(`{"wiki":"testwiki","type":"edit"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_family_test", Delta: 1}))
+		incs, err = CountersFromEventData(other, []byte(`{"wiki":"testwiki","type":"edit"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).ShouldNot(ContainElement(Increment{Key: "pleiades_family_test", Delta: 1}))
+	})
+
+	It("counts distinct users and pages with the default rules", func() {
+		rs, _ := LoadRules("")
+		incs, err := CountersFromEventData(rs, []byte(`{"wiki":"enwiki","type":"edit","user":"Alice","title":"Main Page"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "uniq_users", Value: "Alice"}))
+		Expect(incs).Should(ContainElement(Increment{Key: "uniq_wiki_users_enwiki", Value: "Alice"}))
+		Expect(incs).Should(ContainElement(Increment{Key: "uniq_pages", Value: "enwiki:Main Page"}))
+		Expect(incs).Should(ContainElement(Increment{Key: "uniq_wiki_pages_enwiki", Value: "Main Page"}))
+	})
+
+	It("breaks events down by namespace and log action with the default rules", func() {
+		rs, _ := LoadRules("")
+		incs, err := CountersFromEventData(rs, []byte(`{"type":"edit","namespace":3}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_namespace_User_talk", Delta: 1}))
+
+		incs, err = CountersFromEventData(rs, []byte(`{"type":"log","namespace":2,"log_type":"block","log_action":"reblock"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_namespace_User", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_log_block", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_log_action_block/reblock", Delta: 1}))
+	})
+
+	It("ranks pages, users and wikis with the default rules", func() {
+		rs, _ := LoadRules("")
+		incs, err := CountersFromEventData(rs, []byte(`{"wiki":"enwiki","type":"edit","bot":true,"user":"Bot","title":"Main Page","length":{"old":10,"new":25}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "top_pages", Delta: 1, Member: "enwiki:Main Page", Size: DefaultTopSize}))
+		Expect(incs).Should(ContainElement(Increment{Key: "top_users", Delta: 1, Member: "Bot", Size: DefaultTopSize}))
+		Expect(incs).Should(ContainElement(Increment{Key: "top_growth", Delta: 15, Member: "enwiki:Main Page", Size: DefaultTopSize}))
+		Expect(incs).ShouldNot(ContainElement(Increment{Key: "top_human_users", Delta: 1, Member: "Bot", Size: DefaultTopSize}))
+	})
+
+	It("counts combinations of dimensions in a cross-tab", func() {
+		rs, err := ParseRules([]byte(`{"counters": [{"name": "edits", "dimensions": ["wiki", "nsname(namespace)", "bot"], "size": 50}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		incs, err := rs.Evaluate(parseEvent(`{"wiki":"enwiki","namespace":2,"bot":true}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(Equal([]Increment{{Key: "xtab_edits", Delta: 1, Field: "wiki=enwiki|nsname(namespace)=User|bot=true", Size: 50}}))
+
+		rs, _ = LoadRules("")
+		incs, _ = rs.Evaluate(parseEvent(`{"wiki":"dewiki","type":"edit"}`))
+		Expect(incs).Should(ContainElement(Increment{Key: "xtab_events", Delta: 1, Field: "wiki=dewiki|type=edit|bot=", Size: DefaultCrosstabSize}))
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := ParseRules([]byte(`{"counters": [{"when": "bot"}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRules([]byte(`{"counters": [{"name": "x", "sum": "length.new", "distinct": "user"}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRules([]byte(`{"counters": [{"name": "x", "top": "user", "size": -1}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRules([]byte(`{"counters": [{"name": "x", "dimensions": ["type == \"edit\""]}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRules([]byte(`{"counters": [{"name": "x", "when": "bot &&"}]}`))
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRules([]byte(`not json`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on unparseable events", func() {
+		rs, _ := LoadRules("")
+		_, err := CountersFromEventData(rs, []byte(`{"wiki":`))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,78 @@
+package aggregator
+
+import (
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ruleReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_rule_reloads_total",
+			Help: "Number of times the counter rules file was reloaded",
+		},
+		[]string{"result"},
+	)
+)
+
+// ruleSet returns the rule set currently in effect
+func (a *Aggregator) ruleSet() *RuleSet {
+	return a.rules.Load().(*RuleSet)
+}
+
+// loadRules compiles the configured rules file and puts it into effect
+// The new rules keep the signal state of the previous ones, e.g. the accounts seen being created.
+func (a *Aggregator) loadRules() error {
+	if a.Opts.RulesFile != "" {
+		fi, err := os.Stat(a.Opts.RulesFile)
+		if err != nil {
+			return err
+		}
+		a.rulesModTime = fi.ModTime()
+	}
+	rs, err := LoadRules(a.Opts.RulesFile)
+	if err != nil {
+		return err
+	}
+	rs.signals = a.signals
+	rs.UseSites(a.Opts.Sites)
+	rs.UsePrivacy(a.Opts.Privacy)
+	a.rules.Store(rs)
+	return nil
+}
+
+// watchRules reloads the rules file whenever its modification time changes
+// If the changed file does not compile, the previous rules stay in effect
+func (a *Aggregator) watchRules() {
+	if a.Opts.RulesFile == "" || a.Opts.RulesReloadInterval == 0 {
+		return
+	}
+	t := time.NewTicker(a.Opts.RulesReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-t.C:
+			fi, err := os.Stat(a.Opts.RulesFile)
+			if err != nil {
+				logger.Errorf("Failed to check rules file %s: %v", a.Opts.RulesFile, err)
+				continue
+			}
+			if fi.ModTime().Equal(a.rulesModTime) {
+				continue
+			}
+			logger.Infof("Rules file %s changed, reloading", a.Opts.RulesFile)
+			err = a.loadRules()
+			if err != nil {
+				ruleReloads.WithLabelValues("error").Inc()
+				logger.Errorf("Failed to reload rules, keeping previous rules: %v", err)
+				continue
+			}
+			ruleReloads.WithLabelValues("success").Inc()
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const maxRetries = 5
+
+var (
+	procTime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pleiades_aggregator_process_duration_milliseconds",
+			Help:    "Time taken to process an event",
+			Buckets: []float64{5, 10, 100, 500},
+		},
+		[]string{"transport"},
+	)
+
+	msgTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_event_count_total",
+			Help: "Number of events processed",
+		},
+	)
+
+	poisonTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_poison_events_total",
+			Help: "Number of events that could not be aggregated, by whether they were dead-lettered or dropped",
+		},
+		[]string{"result"},
+	)
+
+	replaysTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_replays_suppressed_total",
+			Help: "Number of events not counted because they had already been applied",
+		},
+	)
+)
+
+// NewAggregator returns an Aggregator reading from the transport Consumer and writing to its Store, or else to Redis
+func NewAggregator(redisOpts *util.RedisOpts, opts *Opts, c transport.Consumer) (*Aggregator, error) {
+	a := &Aggregator{
+		Redis: redisOpts,
+		Opts:  opts,
+		c:     c,
+		stop:  make(chan (bool)),
+	}
+	if a.Opts.BatchSize < 1 {
+		a.Opts.BatchSize = 1
+	}
+	if a.Opts.Buckets == nil {
+		a.Opts.Buckets = DefaultBucketing()
+	}
+	if a.Opts.Signals == nil {
+		a.Opts.Signals = defaultSignals
+	}
+	a.signals = newSignalState(a.Opts.Signals)
+	if a.Opts.Sites == nil {
+		a.Opts.Sites = defaultSites
+	}
+	err := a.loadRules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load counter rules: %v", err)
+	}
+
+	a.store = a.Opts.Store
+	if a.store == nil {
+		a.store, err = OpenStore(StoreRedis, redisOpts, "", a.Opts.ReplayWindow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.Opts.LatePolicy == "" {
+		a.Opts.LatePolicy = DefaultLatePolicy
+	}
+	err = ValidateLatePolicy(a.Opts.LatePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if a.Opts.AllowedLateness > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		wm, err := a.store.Watermark(ctx)
+		if err != nil {
+			return nil, err
+		}
+		a.watermark = NewWatermark(a.Opts.AllowedLateness, wm)
+	}
+	if a.Opts.HotPages != nil {
+		a.hotPages = NewHotPages(*a.Opts.HotPages, a.Opts.Signals)
+	}
+	if a.Opts.Rates != nil {
+		a.rates = NewRates(*a.Opts.Rates)
+	}
+	if a.Opts.Compaction != nil {
+		s, ok := a.store.(*Store)
+		if !ok {
+			return nil, fmt.Errorf("%w: buckets are only compacted in Redis", ErrUnsupportedByStore)
+		}
+		a.compactor = NewCompactor(s.r, a.Opts.Buckets, *a.Opts.Compaction)
+	}
+
+	return a, nil
+}
+
+// Start starts up the aggregation server
+func (a *Aggregator) Start() error {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case <-a.stop:
+				{
+					return
+				}
+			default:
+				err := a.run()
+				if err != nil {
+					a.retries = a.retries + 1
+					logger.Errorf("Aggregator exited with error: %v", err)
+				}
+				if a.retries > maxRetries {
+					logger.Fatalf("Bailing after %d failed restarts", maxRetries)
+				}
+				if a.retries > 0 {
+					select {
+					case <-a.stop:
+					case <-time.After(time.Duration(a.retries) * time.Second):
+					}
+				}
+			}
+		}
+	}()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.watchRules()
+	}()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.watchRates()
+	}()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.compact()
+	}()
+
+	if !util.IsTTY() {
+		logger.Info("Terminal is not a TTY, not displaying progress indicator")
+	} else {
+		a.spinner = util.NewSpinner("Processing... ")
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for {
+				select {
+				case <-a.stop:
+					return
+				default:
+					a.spinner.Tick()
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	a.wg.Wait()
+	return nil
+}
+
+// Stop shuts down the aggregation server and closes its transport and hot page publisher
+func (a *Aggregator) Stop() {
+	close(a.stop)
+	a.wg.Wait()
+	err := a.c.Close()
+	if err != nil {
+		logger.Errorf("Error closing %s transport: %v", a.Opts.Transport, err)
+	}
+	if a.Opts.HotPagePublisher != nil {
+		err = a.Opts.HotPagePublisher.Close()
+		if err != nil {
+			logger.Errorf("Error closing hot page publisher: %v", err)
+		}
+	}
+}
+
+// run fetches messages into the pending batch and flushes it whenever it is due
+// Errors returned are transient; a batch that failed to flush is kept and retried on the next run.
+func (a *Aggregator) run() error {
+	if a.pending == nil {
+		a.pending = newBatch()
+	}
+	for {
+		select {
+		case <-a.stop:
+			return a.flush()
+		default:
+			b := a.pending
+			if b.due(a.Opts.BatchSize, a.Opts.BatchInterval) {
+				err := a.flush()
+				if err != nil {
+					return err
+				}
+				a.retries = 0
+				continue
+			}
+			timeout := 5 * time.Second
+			if b.len() > 0 {
+				timeout = time.Until(b.deadline(a.Opts.BatchInterval))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			msg, err := a.c.Fetch(ctx)
+			cancel()
+			if err == context.DeadlineExceeded {
+				if b.len() == 0 {
+					logger.Debugf("No new messages on %s transport for 5 seconds. Will try again", a.Opts.Transport)
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error reading message from %s: %v", a.Opts.Transport, err)
+			}
+			u, hot, err := a.processEvent(msg)
+			if IsPoison(err) {
+				b.reject(msg, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			b.add(msg, u)
+			if hot != nil {
+				b.flag(hot)
+			}
+		}
+	}
+}
+
+// flush writes the pending batch to Redis and then commits its messages
+// Each step is only done once, so a flush that failed part-way can safely be retried.
+func (a *Aggregator) flush() error {
+	b := a.pending
+	if b.len() == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for len(b.poison) > 0 {
+		err := a.deadLetter(ctx, b.poison[0])
+		if err != nil {
+			return err
+		}
+		b.poison = b.poison[1:]
+	}
+	if !b.applied {
+		start := time.Now()
+		suppressed, err := a.store.Apply(ctx, b.updates)
+		if err != nil {
+			return err
+		}
+		if suppressed > 0 {
+			logger.Infof("Skipped %d events that had already been counted", suppressed)
+			replaysTotal.Add(float64(suppressed))
+		}
+		b.observe(time.Since(start), len(b.merged()))
+		b.applied = true
+	}
+	if !b.flagged {
+		err := a.flagHotPages(ctx, b.hotPages)
+		if err != nil {
+			return err
+		}
+		b.flagged = true
+	}
+	err := a.finalize(ctx)
+	if err != nil {
+		return err
+	}
+	err = a.c.Commit(ctx, b.msgs...)
+	if err != nil {
+		return fmt.Errorf("error committing %d messages: %v", b.len(), err)
+	}
+	msgTotal.Add(float64(b.len()))
+	a.pending = newBatch()
+	return nil
+}
+
+// finalize marks the calendar buckets that ended before the watermark as finalized
+// Under LateApply late events still change such buckets, so only the watermark is recorded.
+func (a *Aggregator) finalize(ctx context.Context) error {
+	if a.watermark == nil {
+		return nil
+	}
+	due := a.watermark.Due(a.Opts.Buckets.Aligned())
+	if len(due) == 0 {
+		return nil
+	}
+	finalized := due
+	if a.Opts.LatePolicy == LateApply {
+		finalized = nil
+	}
+	err := a.store.Finalize(ctx, a.watermark.Time(), finalized)
+	if err != nil {
+		return err
+	}
+	a.watermark.Finalized(due)
+	for _, b := range finalized {
+		logger.Infof("Finalized %s bucket %d", b.Resolution.Name, b.ID)
+	}
+	return nil
+}
+
+// flagHotPages records the pages flagged by a batch and publishes them if a publisher is configured
+// Failing to publish is logged, but does not hold up the batch.
+func (a *Aggregator) flagHotPages(ctx context.Context, pages []*HotPage) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	err := a.store.FlagHotPages(ctx, pages, a.Opts.HotPages.Window)
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		logger.Infof("Flagged %s as %s after %d edits by %d users with %d reverts", p.Page, p.Reason, p.Edits, p.Users, p.Reverts)
+		if a.Opts.HotPagePublisher == nil {
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err == nil {
+			err = a.Opts.HotPagePublisher.Publish(&transport.Message{ID: p.Page, Data: data})
+		}
+		if err != nil {
+			logger.Errorf("Failed to publish hot page %s: %v", p.Page, err)
+		}
+	}
+	return nil
+}
+
+// deadLetter hands a poison message to the consumer's dead-letter destination, or drops it if there is none
+func (a *Aggregator) deadLetter(ctx context.Context, p *poisoned) error {
+	dl, ok := a.c.(transport.DeadLetterer)
+	if ok {
+		err := dl.DeadLetter(ctx, p.msg, p.err)
+		if err == nil {
+			logger.Warningf("Moved message %s to dead-letter destination: %v", p.msg.ID, p.err)
+			poisonTotal.WithLabelValues("dead_lettered").Inc()
+			return nil
+		}
+		if !errors.Is(err, transport.ErrNoDeadLetter) {
+			return fmt.Errorf("failed to dead-letter message %s: %v", p.msg.ID, err)
+		}
+	}
+	logger.Errorf("Dropping message %s: %v", p.msg.ID, p.err)
+	poisonTotal.WithLabelValues("dropped").Inc()
+	return nil
+}
+
+// processEvent computes the update for a single message, along with the page it flags if hot page detection is enabled
+func (a *Aggregator) processEvent(msg *transport.Message) (*Update, *HotPage, error) {
+	defer func(start time.Time) {
+		procTime.WithLabelValues(a.Opts.Transport).Observe(float64(time.Since(start).Milliseconds()))
+	}(time.Now())
+
+	u, event, err := aggregate(a.ruleSet(), a.Opts.Buckets, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.watermark != nil && a.watermark.Observe(u.Time) {
+		logger.Debugf("Event %s at %s is older than watermark %s", msg.ID, u.Time, a.watermark.Time())
+		lateTotal.WithLabelValues(a.Opts.LatePolicy).Inc()
+		u.late(a.Opts.LatePolicy)
+	}
+	if a.rates != nil {
+		a.rates.Observe(event)
+	}
+	var hot *HotPage
+	if a.hotPages != nil {
+		hot = a.hotPages.Observe(event, u.Time)
+	}
+	RecordLag(msg.ID)
+	return u, hot, nil
+}
@@ -0,0 +1,192 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultSignals are the signal heuristics used when no signals file is configured
+var DefaultSignals = SignalConfig{
+	RevertPatterns: []string{
+		`(?i)^undid revision`,
+		`(?i)^reverted \d+ edits? by`,
+		`(?i)^reverted edits by`,
+		`(?i)^revert(ed)? to (the )?revision`,
+		`(?i)\brollback\b`,
+		`(?i)^rv[vd]?\b`,
+	},
+	BlankingMaxLength:  10,
+	BlankingMinRemoved: 100,
+	LargeRemovalBytes:  2000,
+	NewUserWindow:      "168h",
+	NewUserMaxTracked:  100000,
+}
+
+// defaultSignals are the compiled DefaultSignals
+var defaultSignals = mustCompileSignals(DefaultSignals)
+
+// builtinSignals are the signals of the functions in ExprFuncs. They never observe any events.
+var builtinSignals = newSignalState(defaultSignals)
+
+func init() {
+	for name, fn := range signalFuncs(func() *signalState { return builtinSignals }) {
+		ExprFuncs[name] = fn
+	}
+}
+
+func mustCompileSignals(c SignalConfig) *Signals {
+	s, err := compileSignals(c)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default signals: %v", err))
+	}
+	return s
+}
+
+// LoadSignals returns the signal heuristics configured in the given file, or DefaultSignals if path is empty
+// Settings missing from the file keep their default.
+func LoadSignals(path string) (*Signals, error) {
+	c := DefaultSignals
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signals file: %v", err)
+		}
+		err = json.Unmarshal(data, &c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signals file: %v", err)
+		}
+	}
+	return compileSignals(c)
+}
+
+func compileSignals(c SignalConfig) (*Signals, error) {
+	s := &Signals{
+		blankingMaxLength: float64(c.BlankingMaxLength),
+		blankingMinRemove: float64(c.BlankingMinRemoved),
+		largeRemoval:      float64(c.LargeRemovalBytes),
+		newUserMax:        c.NewUserMaxTracked,
+	}
+	for _, p := range c.RevertPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revert pattern %s: %v", p, err)
+		}
+		s.reverts = append(s.reverts, re)
+	}
+	var err error
+	s.newUserWindow, err = time.ParseDuration(c.NewUserWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid new user window %s: %v", c.NewUserWindow, err)
+	}
+	return s, nil
+}
+
+// newSignalState returns the state of the given signals before they have observed any events
+func newSignalState(s *Signals) *signalState {
+	return &signalState{Signals: s, newUsers: make(map[string]time.Time)}
+}
+
+// signalFuncs returns the functions of rule expressions that apply the signals returned by get
+func signalFuncs(get func() *signalState) map[string]ExprFunc {
+	return map[string]ExprFunc{
+		"is_revert": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("is_revert expects 1 argument, got %d", len(args))
+			}
+			return get().isRevert(toString(args[0])), nil
+		},
+		"is_blanking": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("is_blanking expects 2 arguments, got %d", len(args))
+			}
+			return get().isBlanking(toNumber(args[0]), toNumber(args[1])), nil
+		},
+		"is_large_removal": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("is_large_removal expects 2 arguments, got %d", len(args))
+			}
+			return toNumber(args[0])-toNumber(args[1]) >= get().largeRemoval, nil
+		},
+		"is_new_user": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("is_new_user expects 2 arguments, got %d", len(args))
+			}
+			return get().isNewUser(toString(args[0]), time.Unix(int64(toNumber(args[1])), 0)), nil
+		},
+	}
+}
+
+// Annotate sets the revert field of an event from its comment, so that the revert signal survives a privacy
+// policy dropping the comment later on. Events without a comment are left alone.
+func (s *Signals) Annotate(event map[string]interface{}) {
+	if comment, ok := event["comment"].(string); ok {
+		event["revert"] = s.isRevert(comment)
+	}
+}
+
+// reverted reports whether an event is a revert by its comment, or by its revert field if the comment was dropped
+func (s *Signals) reverted(event map[string]interface{}) bool {
+	if comment, ok := event["comment"].(string); ok {
+		return s.isRevert(comment)
+	}
+	return Truthy(event["revert"])
+}
+
+func (s *Signals) isRevert(comment string) bool {
+	for _, re := range s.reverts {
+		if re.MatchString(comment) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlanking reports whether an edit changing the length of a page from old to new bytes blanks the page
+func (s *Signals) isBlanking(old, new float64) bool {
+	return new <= s.blankingMaxLength && old-new >= s.blankingMinRemove
+}
+
+// isNewUser reports whether the account of user was seen being created less than the new user window before t
+func (s *signalState) isNewUser(user string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created, ok := s.newUsers[user]
+	return ok && !t.Before(created) && t.Sub(created) < s.newUserWindow
+}
+
+// observe remembers the accounts created by newusers log events
+// Once newUserMax accounts are remembered, those created before the new user window are forgotten, and if
+// that is not enough, the event is ignored.
+func (s *signalState) observe(event map[string]interface{}) {
+	if event["type"] != "log" || event["log_type"] != "newusers" {
+		return
+	}
+	user := toString(event["user"])
+	if event["log_action"] == "create2" || event["log_action"] == "byemail" {
+		title := toString(event["title"])
+		user = title[strings.Index(title, ":")+1:]
+	}
+	if user == "" {
+		return
+	}
+	t := time.Unix(int64(toNumber(event["timestamp"])), 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.newUsers[user]; ok {
+		return
+	}
+	if len(s.newUsers) >= s.newUserMax {
+		for u, created := range s.newUsers {
+			if t.Sub(created) >= s.newUserWindow {
+				delete(s.newUsers, u)
+			}
+		}
+	}
+	if len(s.newUsers) < s.newUserMax {
+		s.newUsers[user] = t
+	}
+}
@@ -0,0 +1,96 @@
+package aggregator
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/privacy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signals", func() {
+
+	It("recognises revert comments", func() {
+		s := defaultSignals
+		Expect(s.isRevert("Undid revision 12345 by [[Special:Contributions/1.2.3.4|1.2.3.4]]")).To(BeTrue())
+		Expect(s.isRevert("Reverted edits by [[Special:Contributions/Foo|Foo]] to last version by Bar")).To(BeTrue())
+		Expect(s.isRevert("Reverted 2 edits by Foo (talk): vandalism")).To(BeTrue())
+		Expect(s.isRevert("rv vandalism")).To(BeTrue())
+		Expect(s.isRevert("Added references")).To(BeFalse())
+		Expect(s.isRevert("rvalue semantics")).To(BeFalse())
+	})
+
+	It("counts default signals of a blanking by an IP user", func() {
+		rs, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+		incs, err := rs.Evaluate(parseEvent(`{"wiki":"enwiki","type":"edit","title":"Foo","user":"2001:db8::1","comment":"","length":{"old":5000,"new":0}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_signal_blanking", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_signal_blanking_wiki_enwiki", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "top_blanking_pages", Delta: 1, Member: "enwiki:Foo", Size: DefaultTopSize}))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_signal_ip_removal", Delta: 1}))
+		Expect(incs).ShouldNot(ContainElement(Increment{Key: "pleiades_signal_revert", Delta: 1}))
+	})
+
+	It("counts reverts although the privacy policy drops their comments", func() {
+		rs, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+		pp, err := privacy.New(privacy.DefaultConfig)
+		Expect(err).NotTo(HaveOccurred())
+		rs.UsePrivacy(pp)
+		event := parseEvent(`{"wiki":"enwiki","type":"edit","title":"Foo","user":"192.0.2.15","comment":"Undid revision 12345 by Bar"}`)
+		incs := countersFromEvent(rs, event)
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_signal_revert", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "uniq_users", Value: "192.0.2.0"}))
+		Expect(incs).ShouldNot(ContainElement(Increment{Key: "uniq_users", Value: "192.0.2.15"}))
+		Expect(event).Should(HaveKeyWithValue("comment", "Undid revision 12345 by Bar"))
+
+		// The ingester marks reverts before dropping the comment
+		incs = countersFromEvent(rs, parseEvent(`{"wiki":"enwiki","type":"edit","title":"Foo","user":"192.0.2.0","revert":true}`))
+		Expect(incs).Should(ContainElement(Increment{Key: "pleiades_signal_revert", Delta: 1}))
+		Expect(incs).Should(ContainElement(Increment{Key: "top_revert_pages", Delta: 1, Member: "enwiki:Foo", Size: DefaultTopSize}))
+	})
+
+	It("flags edits by recently created accounts", func() {
+		created := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+		s := newSignalState(defaultSignals)
+		s.observe(parseEvent(`{"type":"log","log_type":"newusers","log_action":"create","user":"Newbie","timestamp":1597060800}`))
+		s.observe(parseEvent(`{"type":"log","log_type":"newusers","log_action":"create2","user":"Admin","title":"User:Other","timestamp":1597060800}`))
+		Expect(s.isNewUser("Newbie", created.Add(time.Hour))).To(BeTrue())
+		Expect(s.isNewUser("Other", created.Add(time.Hour))).To(BeTrue())
+		Expect(s.isNewUser("Admin", created.Add(time.Hour))).To(BeFalse())
+		Expect(s.isNewUser("Newbie", created.Add(8*24*time.Hour))).To(BeFalse())
+	})
+
+	It("loads signal settings from a file", func() {
+		f, err := ioutil.TempFile("", "signals")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(`{"revert_patterns": ["^revert"], "large_removal_bytes": 10}`)
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+
+		s, err := LoadSignals(f.Name())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.isRevert("revert spam")).To(BeTrue())
+		Expect(s.isRevert("Undid revision 12345")).To(BeFalse())
+		Expect(s.largeRemoval).Should(Equal(float64(10)))
+		Expect(s.blankingMaxLength).Should(Equal(float64(DefaultSignals.BlankingMaxLength)))
+
+		_, err = LoadSignals("/does/not/exist")
+		Expect(err).To(HaveOccurred())
+	})
+	It("keeps the accounts seen being created per rule set", func() {
+		newbie := `{"type":"log","log_type":"newusers","log_action":"create","user":"Newbie","timestamp":1597060800}`
+		edit := `{"wiki":"enwiki","type":"edit","title":"Foo","user":"Newbie","timestamp":1597064400}`
+		rs, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+		other, err := LoadRules("")
+		Expect(err).NotTo(HaveOccurred())
+		countersFromEvent(rs, parseEvent(newbie))
+		Expect(countersFromEvent(rs, parseEvent(edit))).Should(ContainElement(Increment{Key: "pleiades_signal_new_user", Delta: 1}))
+		Expect(countersFromEvent(other, parseEvent(edit))).ShouldNot(ContainElement(Increment{Key: "pleiades_signal_new_user", Delta: 1}))
+	})
+})
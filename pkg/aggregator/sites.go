@@ -0,0 +1,29 @@
+package aggregator
+
+import (
+	"github.com/gargath/pleiades/pkg/sitematrix"
+)
+
+// defaultSites are the bundled sites rule sets enrich events from unless configured otherwise
+var defaultSites = sitematrix.New()
+
+// LoadSites reads the given sitematrix snapshot to enrich events from, or the bundled sites only if path is empty
+func LoadSites(path string) (*sitematrix.Matrix, error) {
+	return sitematrix.Load(path)
+}
+
+// enrich adds the family and language of an event's wiki to the event, so that rules can refer to them
+// Fields the event already has are left alone, as are wikis whose family is unknown.
+func enrich(sites *sitematrix.Matrix, event map[string]interface{}) {
+	if _, ok := event["family"]; ok {
+		return
+	}
+	site, ok := sites.Lookup(eventWiki(event), toString(event["server_name"]))
+	if !ok {
+		return
+	}
+	event["family"] = site.Family
+	if _, ok := event["language"]; !ok && site.Language != "" {
+		event["language"] = site.Language
+	}
+}
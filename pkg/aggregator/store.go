@@ -0,0 +1,547 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// offsetsKey is the Redis hash holding the highest offset applied per partition
+	offsetsKey = "aggregator_offsets"
+	// eventMarkerPrefix prefixes the Redis keys marking events applied by ID
+	eventMarkerPrefix = "aggregator_event_"
+	// watermarkKey holds the watermark in milliseconds since the epoch
+	watermarkKey = "aggregator_watermark"
+
+	// StoreRedis keeps counters in Redis, as a Store
+	StoreRedis = "redis"
+	// StoreMemory keeps counters in memory until the process exits, as a MemoryStore
+	StoreMemory = "memory"
+	// StoreFile keeps counters in a bbolt database in a directory on disk, as a FileStore
+	StoreFile = "file"
+)
+
+// StoreKinds are the names of all counter stores
+var StoreKinds = []string{StoreRedis, StoreMemory, StoreFile}
+
+// applyScript applies the pre-aggregated increments of a list of events, unless some of them have been applied before
+// KEYS are the offsets hash followed by every other key the script touches, which ARGV refers to by their position in KEYS.
+// ARGV holds the replay window in seconds, the cross-tab overflow field, the position in ARGV of the index section and
+// the number of events, then for each event its partition, offset and the key marking its ID (0 if it has none), then
+// the merged increments as key/delta/TTL/value/member/field/size tuples, then the index section (see bucketIndex.args).
+// If any event has been applied before, or appears twice, nothing is written and the positions of those events are
+// returned, so the caller can merge the increments of the others and try again. Otherwise the offsets and markers of the
+// events are recorded, the increments applied and an empty list returned.
+// Increments with a value add it to the HyperLogLog at their key instead. Increments with a member add the delta
+// to its score in the sorted set at their key, which is then trimmed to the size highest scoring members.
+// Increments with a field add the delta to it in the hash at their key, or to the overflow field (ARGV[2]) if
+// the field is new and the hash already has size fields.
+// Keys with a TTL get it set when they are created.
+// Each bucket of the index section is added to the sorted set indexing the buckets of its resolution and its counters
+// to the set indexing the names of its counters. For resolutions with a TTL, the set expires along with the counters
+// and buckets below the cutoff are dropped from the index.
+var applyScript = redis.NewScript(`
+local ttl = tonumber(ARGV[1])
+local index = tonumber(ARGV[3])
+local events = tonumber(ARGV[4])
+local offsets = {}
+local applied = {}
+local markers = {}
+local stale = {}
+for e = 1, events do
+	local i = 2 + 3 * e
+	local partition, offset, marker = ARGV[i], tonumber(ARGV[i+1]), tonumber(ARGV[i+2])
+	if partition ~= "" then
+		local last = applied[partition] or tonumber(redis.call("HGET", KEYS[1], partition))
+		if last and last >= offset then
+			table.insert(stale, e)
+		else
+			applied[partition] = offset
+			offsets[partition] = ARGV[i+1]
+		end
+	elseif marker > 0 then
+		if markers[marker] or redis.call("EXISTS", KEYS[marker]) == 1 then
+			table.insert(stale, e)
+		else
+			markers[marker] = true
+		end
+	end
+end
+if #stale > 0 then
+	return stale
+end
+for partition, offset in pairs(offsets) do
+	redis.call("HSET", KEYS[1], partition, offset)
+end
+for marker in pairs(markers) do
+	redis.call("SET", KEYS[marker], 1, "EX", ttl)
+end
+local trimmed = {}
+local i = 5 + 3 * events
+while i < index do
+	local k, d, t, v, m, f, size = KEYS[tonumber(ARGV[i])], tonumber(ARGV[i+1]), tonumber(ARGV[i+2]), ARGV[i+3], ARGV[i+4], ARGV[i+5], tonumber(ARGV[i+6])
+	local created
+	if v ~= "" then
+		redis.call("PFADD", k, v)
+		created = redis.call("TTL", k) == -1
+	elseif m ~= "" then
+		redis.call("ZINCRBY", k, d, m)
+		trimmed[k] = size
+		created = redis.call("TTL", k) == -1
+	elseif f ~= "" then
+		local field = f
+		if redis.call("HEXISTS", k, f) == 0 and redis.call("HLEN", k) >= size then
+			field = ARGV[2]
+		end
+		redis.call("HINCRBY", k, field, d)
+		created = redis.call("TTL", k) == -1
+	else
+		redis.call("INCRBY", k, d)
+		created = redis.call("TTL", k) == -1
+	end
+	if created and t > 0 then
+		redis.call("EXPIRE", k, t)
+	end
+	i = i + 7
+end
+for k, size in pairs(trimmed) do
+	redis.call("ZREMRANGEBYRANK", k, 0, -size - 1)
+end
+while i <= #ARGV do
+	local buckets, counters, id, ttl, cutoff, n = KEYS[tonumber(ARGV[i])], KEYS[tonumber(ARGV[i+1])], ARGV[i+2], tonumber(ARGV[i+3]), ARGV[i+4], tonumber(ARGV[i+5])
+	redis.call("ZADD", buckets, id, id)
+	for j = i + 6, i + 5 + n, 1000 do
+		redis.call("SADD", counters, unpack(ARGV, j, math.min(j + 999, i + 5 + n)))
+	end
+	if ttl > 0 then
+		redis.call("EXPIRE", counters, ttl)
+		redis.call("ZREMRANGEBYSCORE", buckets, "-inf", "(" .. cutoff)
+	end
+	i = i + 6 + n
+end
+return {}
+`)
+
+// finalizeScript advances the watermark and marks buckets as finalized
+// KEYS are the watermark key followed by the finalized set of each bucket. ARGV holds the watermark in
+// milliseconds, followed by the ID of each bucket. The watermark is never moved backwards.
+var finalizeScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]))
+if not current or current < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+for i = 2, #KEYS do
+	redis.call("ZADD", KEYS[i], ARGV[i], ARGV[i])
+end
+return 0
+`)
+
+// flagScript records flagged pages and forgets those flagged before a cutoff
+// KEYS are HotPagesKey and HotPagesInfoKey. ARGV holds the cutoff in seconds since the epoch, the TTL of both keys,
+// then the time, page and JSON of each flagged page.
+var flagScript = redis.NewScript(`
+for i = 3, #ARGV, 3 do
+	redis.call("ZADD", KEYS[1], ARGV[i], ARGV[i+1])
+	redis.call("HSET", KEYS[2], ARGV[i+1], ARGV[i+2])
+end
+local cutoff = "(" .. ARGV[1]
+for _, page in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", cutoff)) do
+	redis.call("HDEL", KEYS[2], page)
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", cutoff)
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+redis.call("EXPIRE", KEYS[2], ARGV[2])
+return 0
+`)
+
+// anomaliesScript replaces the active anomalies
+// KEYS is AnomaliesKey. ARGV holds its TTL in seconds, then the series and JSON of each anomaly.
+var anomaliesScript = redis.NewScript(`
+redis.call("DEL", KEYS[1])
+for i = 2, #ARGV, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i+1])
+end
+if #ARGV > 1 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Store applies key increments to Redis
+// It is the single place aggregated data is written, regardless of the transport events arrive through.
+type Store struct {
+	r            *redis.Client
+	replayWindow time.Duration
+	prefix       string
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// NewStore returns a Store writing to the given Redis client
+// Event IDs are remembered for replayWindow to detect replays of events without a partition offset. Zero disables this.
+func NewStore(r *redis.Client, replayWindow time.Duration) *Store {
+	return &Store{r: r, replayWindow: replayWindow}
+}
+
+// OpenStore opens a counter store of the given kind
+// Redis stores connect to the server of redisOpts, and file stores keep their counters in the directory at path.
+// Event IDs are remembered for replayWindow to detect replays of events without a partition offset. Zero disables this.
+func OpenStore(kind string, redisOpts *util.RedisOpts, path string, replayWindow time.Duration) (CounterStore, error) {
+	switch kind {
+	case StoreRedis:
+		r, err := util.NewValidatedRedisClient(redisOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Redis at %s: %v", redisOpts.RedisAddr, err)
+		}
+		return NewStore(r, replayWindow), nil
+	case StoreMemory:
+		return NewMemoryStore(replayWindow), nil
+	case StoreFile:
+		return OpenFileStore(path, replayWindow)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownStore, kind)
+}
+
+// OpenReadOnlyStore opens a counter store of the given kind to read the counters another process aggregates
+// Only Redis stores can be shared this way. Memory stores live within their process, and file stores can only be opened
+// by one process at a time, so both are rejected.
+func OpenReadOnlyStore(kind string, redisOpts *util.RedisOpts, path string) (CounterStore, error) {
+	switch kind {
+	case StoreRedis:
+		return OpenStore(kind, redisOpts, path, 0)
+	case StoreMemory:
+		return nil, fmt.Errorf("%w: the %s store only holds counters within the process aggregating them", ErrUnsupportedByStore, kind)
+	case StoreFile:
+		return nil, fmt.Errorf("%w: the %s store can only be opened by the process aggregating into it, serve it with the all command", ErrUnsupportedByStore, kind)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownStore, kind)
+}
+
+// Staged returns a Store writing to the same Redis with every key prefixed by prefix
+// It does not detect replays, as staged data is rebuilt from scratch.
+func (s *Store) Staged(prefix string) *Store {
+	return &Store{r: s.r, prefix: prefix}
+}
+
+// Apply increments each key by its delta
+// The increments of the updates are pre-aggregated and applied in a single atomic script together with the markers
+// that identify their events, so an update that has been applied before is skipped. Apply returns the number of
+// updates skipped. The buckets counted in are recorded in the bucket index, unless the Store is staged.
+func (s *Store) Apply(ctx context.Context, updates []*Update) (int, error) {
+	suppressed := 0
+	for len(updates) > 0 {
+		stale, err := s.apply(ctx, updates)
+		if err != nil {
+			return suppressed, fmt.Errorf("failed to apply %d Redis counter updates: %v", len(updates), err)
+		}
+		if len(stale) == 0 {
+			break
+		}
+		suppressed += len(stale)
+		updates = without(updates, stale)
+	}
+	return suppressed, nil
+}
+
+// apply runs applyScript for the updates and returns the positions of those applied before, in which case it wrote nothing
+func (s *Store) apply(ctx context.Context, updates []*Update) (map[int]bool, error) {
+	keys := newScriptKeys(offsetsKey)
+	args := []interface{}{expirySeconds(s.replayWindow), CrosstabOther, 0, len(updates)}
+	for _, u := range updates {
+		marker := 0
+		if u.Partition == "" && u.EventID != "" && s.replayWindow > 0 {
+			marker = keys.add(eventMarkerPrefix + u.EventID)
+		}
+		args = append(args, u.Partition, strconv.FormatInt(u.Offset, 10), marker)
+	}
+	for _, inc := range mergeIncrements(updates) {
+		args = append(args, keys.add(s.prefix+inc.Key), inc.Delta, expirySeconds(inc.TTL), inc.Value, inc.Member, inc.Field, inc.Size)
+	}
+	args[2] = len(args) + 1
+	if s.prefix == "" {
+		args = append(args, indexUpdates(updates).args(time.Now(), keys)...)
+	}
+	result, err := applyScript.Run(ctx, s.r, keys.keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	positions, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected result %v", result)
+	}
+	stale := make(map[int]bool, len(positions))
+	for _, p := range positions {
+		pos, ok := p.(int64)
+		if !ok || pos < 1 || int(pos) > len(updates) {
+			return nil, fmt.Errorf("unexpected position %v", p)
+		}
+		stale[int(pos)-1] = true
+	}
+	return stale, nil
+}
+
+// newScriptKeys returns scriptKeys holding the given keys
+func newScriptKeys(keys ...string) *scriptKeys {
+	sk := &scriptKeys{pos: make(map[string]int)}
+	for _, k := range keys {
+		sk.add(k)
+	}
+	return sk
+}
+
+// add declares a key, unless it has been declared before, and returns its position in KEYS
+func (sk *scriptKeys) add(key string) int {
+	if p, ok := sk.pos[key]; ok {
+		return p
+	}
+	sk.keys = append(sk.keys, key)
+	sk.pos[key] = len(sk.keys)
+	return sk.pos[key]
+}
+
+// without returns the updates except those at the given positions
+func without(updates []*Update, positions map[int]bool) []*Update {
+	out := make([]*Update, 0, len(updates)-len(positions))
+	for i, u := range updates {
+		if !positions[i] {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// SetAppliedOffsets overwrites the offsets recorded as applied for the given partitions
+// Events after these offsets are counted when they are next consumed, even if they were counted before.
+func (s *Store) SetAppliedOffsets(ctx context.Context, offsets map[string]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	values := make([]interface{}, 0, 2*len(offsets))
+	for p, o := range offsets {
+		values = append(values, p, o)
+	}
+	err := s.r.HSet(ctx, offsetsKey, values...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set applied offsets: %v", err)
+	}
+	return nil
+}
+
+// Finalize records the watermark and marks the given buckets as finalized
+func (s *Store) Finalize(ctx context.Context, watermark time.Time, buckets []bucket.Bucket) error {
+	keys := []string{watermarkKey}
+	args := []interface{}{watermark.UnixNano() / int64(time.Millisecond)}
+	for _, b := range buckets {
+		keys = append(keys, b.Resolution.FinalizedKey())
+		args = append(args, b.ID)
+	}
+	err := finalizeScript.Run(ctx, s.r, keys, args...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to finalize %d buckets: %v", len(buckets), err)
+	}
+	return nil
+}
+
+// Watermark returns the watermark last recorded by Finalize, or the zero time if there is none
+func (s *Store) Watermark(ctx context.Context) (time.Time, error) {
+	ms, err := s.r.Get(ctx, watermarkKey).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read watermark: %v", err)
+	}
+	return EventTime(ms), nil
+}
+
+// FlagHotPages records flagged pages for window after the latest of them was flagged
+func (s *Store) FlagHotPages(ctx context.Context, pages []*HotPage, window time.Duration) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	var latest int64
+	args := []interface{}{0, int64(window.Seconds())}
+	for _, p := range pages {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("failed to encode hot page %s: %v", p.Page, err)
+		}
+		args = append(args, p.Time, p.Page, string(data))
+		if p.Time > latest {
+			latest = p.Time
+		}
+	}
+	args[0] = latest - int64(window.Seconds())
+	err := flagScript.Run(ctx, s.r, []string{s.prefix + HotPagesKey, s.prefix + HotPagesInfoKey}, args...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to record %d hot pages: %v", len(pages), err)
+	}
+	return nil
+}
+
+// SetAnomalies replaces the active anomalies, which are kept for ttl unless replaced again
+func (s *Store) SetAnomalies(ctx context.Context, anomalies []*Anomaly, ttl time.Duration) error {
+	args := []interface{}{int64(ttl.Seconds())}
+	for _, a := range anomalies {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return fmt.Errorf("failed to encode anomaly of %s: %v", a.Series, err)
+		}
+		args = append(args, a.Series, string(data))
+	}
+	err := anomaliesScript.Run(ctx, s.r, []string{s.prefix + AnomaliesKey}, args...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to record %d anomalies: %v", len(anomalies), err)
+	}
+	return nil
+}
+
+// Counters returns the values of the counters at keys, leaving out those that do not exist
+func (s *Store) Counters(ctx context.Context, keys []string) (map[string]int64, error) {
+	out := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+	result, err := s.r.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		if result[i] == nil {
+			continue
+		}
+		val, ok := result[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid non-string type in Redis counter %s: %v ", k, result[i])
+		}
+		out[k], err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis value not parsable as number: %s - %v", val, err)
+		}
+	}
+	return out, nil
+}
+
+// Distinct estimates the number of distinct values added to the HyperLogLogs of each set of keys taken together
+func (s *Store) Distinct(ctx context.Context, keys [][]string) ([]int64, error) {
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := s.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, ks := range keys {
+			cmds[i] = pipe.PFCount(ctx, ks...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int64, len(keys))
+	for i, cmd := range cmds {
+		out[i] = cmd.Val()
+	}
+	return out, nil
+}
+
+// Top returns up to limit members of the sorted set at key by descending score, or all of them if limit is not positive
+func (s *Store) Top(ctx context.Context, key string, limit int) ([]Scored, error) {
+	stop := int64(limit - 1)
+	if limit <= 0 {
+		stop = -1
+	}
+	zs, err := s.r.ZRevRangeWithScores(ctx, key, 0, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Scored, len(zs))
+	for i, z := range zs {
+		out[i] = Scored{Member: fmt.Sprint(z.Member), Score: z.Score}
+	}
+	return out, nil
+}
+
+// Hashes returns the fields of the hash at each key, which are empty if it does not exist
+func (s *Store) Hashes(ctx context.Context, keys []string) ([]map[string]string, error) {
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err := s.r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.HGetAll(ctx, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]string, len(keys))
+	for i, cmd := range cmds {
+		out[i] = cmd.Val()
+	}
+	return out, nil
+}
+
+// Buckets returns the IDs of the buckets of a resolution in the bucket index, sorted
+func (s *Store) Buckets(ctx context.Context, res *bucket.Resolution) ([]int64, error) {
+	return s.ids(ctx, res.IndexKey())
+}
+
+// Names returns the names of the counters of a bucket in the bucket index, in no particular order
+func (s *Store) Names(ctx context.Context, b bucket.Bucket) ([]string, error) {
+	return s.r.SMembers(ctx, b.IndexKey()).Result()
+}
+
+// Finalized returns the IDs of the finalized buckets of a resolution
+func (s *Store) Finalized(ctx context.Context, res *bucket.Resolution) (map[int64]bool, error) {
+	ids, err := s.ids(ctx, res.FinalizedKey())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		out[id] = true
+	}
+	return out, nil
+}
+
+// IsFinalized reports whether a bucket has been marked as finalized
+func (s *Store) IsFinalized(ctx context.Context, b bucket.Bucket) (bool, error) {
+	err := s.r.ZScore(ctx, b.Resolution.FinalizedKey(), strconv.FormatInt(b.ID, 10)).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Close closes the Redis client
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.r.Close()
+	})
+	return s.closeErr
+}
+
+// expirySeconds returns d in whole seconds for EXPIRE, rounded up so that positive durations never expire at once
+func expirySeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// ids returns the members of the sorted set at key as bucket IDs, by ascending score
+func (s *Store) ids(ctx context.Context, key string) ([]int64, error) {
+	members, err := s.r.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int64, len(members))
+	for i, m := range members {
+		out[i], err = strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket ID %s in %s: %v", m, key, err)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,19 @@
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+
+	It("rounds expiries up to whole seconds", func() {
+		Expect(expirySeconds(0)).Should(Equal(int64(0)))
+		Expect(expirySeconds(time.Millisecond)).Should(Equal(int64(1)))
+		Expect(expirySeconds(time.Second)).Should(Equal(int64(1)))
+		Expect(expirySeconds(1500 * time.Millisecond)).Should(Equal(int64(2)))
+		Expect(expirySeconds(24 * time.Hour)).Should(Equal(int64(86400)))
+	})
+})
@@ -1,6 +1,23 @@
 package aggregator
 
-// Server consumes events from filesystem or kafka, then calculates aggregate stats and stores them in redis
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/sitematrix"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/gargath/pleiades/pkg/util"
+	"github.com/go-redis/redis/v8"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Server consumes events from a transport, then calculates aggregate stats and stores them in redis
 type Server interface {
 	Start() error
 	Stop()
@@ -61,3 +78,466 @@ type Revision struct {
 	New interface{} `json:"new,omitempty"`
 	Old interface{} `json:"old,omitempty"`
 }
+
+// Aggregator consumes events from a transport and increments Redis counters for each
+type Aggregator struct {
+	Redis        *util.RedisOpts
+	Opts         *Opts
+	c            transport.Consumer
+	store        CounterStore
+	watermark    *Watermark
+	signals      *signalState
+	hotPages     *HotPages
+	rates        *Rates
+	compactor    *Compactor
+	pending      *batch
+	rules        atomic.Value
+	rulesModTime time.Time
+	stop         chan (bool)
+	wg           sync.WaitGroup
+	retries      int
+	spinner      *util.Spinner
+}
+
+// Opts hold configuration for the Aggregator
+type Opts struct {
+	// Transport is the name of the transport events are consumed from
+	Transport string
+	// RulesFile is the path of the counter rules file. If empty, DefaultRules are used
+	RulesFile string
+	// RulesReloadInterval is how often the rules file is checked for changes. Zero disables reloading
+	RulesReloadInterval time.Duration
+	// BatchSize is the maximum number of events whose increments are written to Redis together
+	BatchSize int
+	// BatchInterval is the maximum time an event waits in a batch before it is written to Redis
+	BatchInterval time.Duration
+	// Buckets are the time buckets counters are kept in besides the all-time counters. Defaults to UTC days only
+	Buckets *Bucketing
+	// AllowedLateness is how far behind the latest event seen an event may be before it is late. Zero disables
+	// late event handling and bucket finalization
+	AllowedLateness time.Duration
+	// LatePolicy is what to do with late events: LateDrop, LateBucket or LateApply. Defaults to LateBucket, so
+	// finalized buckets no longer change
+	LatePolicy string
+	// ReplayWindow is how long the IDs of applied events are remembered to suppress replays
+	// Events read with a partition offset are deduplicated by offset instead and are not affected. Zero disables it.
+	ReplayWindow time.Duration
+	// Signals configures the signal heuristics of rule expressions and hot page detection. Defaults to DefaultSignals
+	Signals *Signals
+	// Sites is the sitematrix events are enriched with the family and language of their wiki from. Defaults to the
+	// bundled sites
+	Sites *sitematrix.Matrix
+	// Privacy is applied to what is stored of events, after conditions and signals have seen them whole. Nil stores
+	// events unchanged
+	Privacy *privacy.Policy
+	// HotPages configures the detection of hot pages and edit wars. Nil disables it
+	HotPages *HotPageConfig
+	// HotPagePublisher, if set, is sent each flagged HotPage as JSON, with the page as message ID
+	HotPagePublisher transport.Producer
+	// Rates configures the detection of anomalous event rates. Nil disables it
+	Rates *RateConfig
+	// Compaction configures the rollup and deletion of old buckets. Nil disables it
+	// Buckets are only compacted in Redis; with other stores it must be nil and they rely on the TTLs of the buckets.
+	Compaction *CompactionConfig
+	// Store is where counters are written. If nil, they are written to the Redis server of the Aggregator
+	Store CounterStore
+}
+
+// Update holds the key increments of a single event along with what identifies it for replay detection
+type Update struct {
+	// Partition and Offset locate the event in an ordered log. Partition is empty if the transport has none
+	Partition string
+	Offset    int64
+	// EventID is the upstream ID of the event, used to detect replays if there is no Partition
+	EventID string
+	// Time is when the event occurred
+	Time       time.Time
+	Increments []Increment
+	// allTime is the number of leading Increments that are all-time counters rather than bucketed ones
+	allTime int
+	// buckets are the buckets the all-time counters are also counted in, to be recorded in the bucket index
+	buckets []bucket.Bucket
+	// lateBuckets are the buckets whose late_ prefixed copies a late event is counted in under the LateBucket policy
+	lateBuckets []bucket.Bucket
+}
+
+// Reaggregation rebuilds the daily counters of a range of days from historic events
+// Counters are computed into a staging namespace and only replace the live ones on Commit.
+type Reaggregation struct {
+	from    time.Time
+	to      time.Time
+	start   time.Time
+	end     time.Time
+	first   time.Time
+	last    time.Time
+	rules   *RuleSet
+	buckets *Bucketing
+	r       *redis.Client
+	prefix  string
+	staging *Store
+	pending []*Update
+	events  int
+}
+
+// CounterDiff is the difference between the live and the rebuilt value of a counter
+// Member is the member of a leaderboard, field of a cross-tab or bin of a histogram that differs, or empty for
+// other counters.
+type CounterDiff struct {
+	Key    string
+	Member string
+	Old    int64
+	New    int64
+}
+
+// counterMember identifies a counter, or a member of a leaderboard, cross-tab or histogram, when comparing counters
+type counterMember struct {
+	key    string
+	member string
+}
+
+// Bucketing describes the time buckets counters are kept in
+type Bucketing struct {
+	// Resolutions are the granularities of the buckets
+	Resolutions []*bucket.Resolution
+	// Zones are the time zones buckets of calendar resolutions are aligned to
+	Zones []*bucket.Zone
+	// Home, if set, additionally aligns calendar buckets to the home time zone of each event's wiki
+	Home *HomeZones
+}
+
+// HomeZones looks up the home time zone of wikis
+type HomeZones struct {
+	zones map[string]*bucket.Zone
+}
+
+// Watermark tracks how far event time has progressed
+// Events older than the watermark are late, and calendar buckets ending before it are finalized.
+type Watermark struct {
+	lateness  time.Duration
+	max       time.Time
+	start     time.Time
+	finalized map[string]int64
+}
+
+// ErrUnknownLatePolicy is returned when a late event policy is configured that does not exist
+var ErrUnknownLatePolicy = fmt.Errorf("Unknown late event policy")
+
+// SignalConfig configures the heuristics flagging events of interest to patrollers, as found in a signals file
+type SignalConfig struct {
+	// RevertPatterns are regular expressions matching the comments of reverts
+	RevertPatterns []string `json:"revert_patterns"`
+	// BlankingMaxLength is the largest page length after an edit that counts as blanking the page
+	BlankingMaxLength int64 `json:"blanking_max_length"`
+	// BlankingMinRemoved is the number of bytes an edit must remove to count as blanking the page
+	BlankingMinRemoved int64 `json:"blanking_min_removed"`
+	// LargeRemovalBytes is the number of bytes an edit must remove to count as a large removal
+	LargeRemovalBytes int64 `json:"large_removal_bytes"`
+	// NewUserWindow is how long after creating their account a user counts as new, e.g. 168h
+	NewUserWindow string `json:"new_user_window"`
+	// NewUserMaxTracked is the number of recently created accounts remembered
+	NewUserMaxTracked int `json:"new_user_max_tracked"`
+}
+
+// Signals is a compiled SignalConfig
+type Signals struct {
+	reverts           []*regexp.Regexp
+	blankingMaxLength float64
+	blankingMinRemove float64
+	largeRemoval      float64
+	newUserWindow     time.Duration
+	newUserMax        int
+}
+
+// signalState holds the Signals of a RuleSet along with what the heuristics observed, i.e. recently created accounts
+type signalState struct {
+	*Signals
+	mu       sync.Mutex
+	newUsers map[string]time.Time
+}
+
+// HotPageConfig configures the detection of hot pages and edit wars
+type HotPageConfig struct {
+	// Window is how far back edits to a page are considered
+	Window time.Duration
+	// MinEdits is the number of edits within the window that makes a page hot if they were made by at most MaxUsers users
+	MinEdits int
+	MaxUsers int
+	// MinReverts is the number of reverts within the window, alternating between at least two users, that makes an edit war
+	MinReverts int
+	// MaxPages is the number of pages whose recent edits are tracked
+	MaxPages int
+}
+
+// HotPages detects hot pages and edit wars from the recent edits of each page
+type HotPages struct {
+	cfg     HotPageConfig
+	signals *Signals
+	pages   map[string]*pageHistory
+}
+
+// pageHistory holds the edits to a page within the detection window
+type pageHistory struct {
+	edits   []pageEdit
+	flagged time.Time
+	reason  string
+}
+
+// pageEdit is a single edit remembered by HotPages
+type pageEdit struct {
+	t      time.Time
+	user   string
+	revert bool
+}
+
+// HotPage is a page flagged by HotPages
+type HotPage struct {
+	// Page is the wiki and title of the page, separated by a colon
+	Page  string `json:"page"`
+	Wiki  string `json:"wiki"`
+	Title string `json:"title"`
+	// Reason is HotPageEditWar or HotPageBusy
+	Reason string `json:"reason"`
+	// Edits, Users and Reverts are the number of edits, distinct users and reverts within the window
+	Edits   int `json:"edits"`
+	Users   int `json:"users"`
+	Reverts int `json:"reverts"`
+	// Time is the time of the edit that got the page flagged, in seconds since the epoch
+	Time int64 `json:"time"`
+}
+
+// RateConfig configures the detection of anomalous event rates
+type RateConfig struct {
+	// Interval is the length of the intervals events are counted in
+	Interval time.Duration
+	// Alpha is the weight of the latest interval in the exponentially weighted baseline of a series
+	Alpha float64
+	// Threshold is the number of standard deviations from its baseline at which the rate of a series is anomalous
+	Threshold float64
+	// MinRate is the number of events per interval below which neither rate nor baseline make a series anomalous
+	MinRate float64
+	// WarmUp is the number of intervals a series must have been tracked for before it can be anomalous
+	WarmUp int
+	// MaxSeries is the number of series tracked
+	MaxSeries int
+	// Webhook is a URL each new Anomaly is POSTed to as JSON. Empty disables it
+	Webhook string
+}
+
+// Rates counts events per interval in several series and flags intervals deviating from their baseline
+type Rates struct {
+	cfg    RateConfig
+	mu     sync.Mutex
+	counts map[string]float64
+	series map[string]*baseline
+	active map[string]*Anomaly
+}
+
+// baseline is the exponentially weighted mean and variance of the rate of a series
+type baseline struct {
+	mean     float64
+	variance float64
+	n        int
+}
+
+// Anomaly is a series whose rate deviates from its baseline
+type Anomaly struct {
+	// Series is total, or the dimension and value counted, e.g. wiki:enwiki
+	Series string `json:"series"`
+	// Kind is AnomalySpike, AnomalyDrop or AnomalyStall
+	Kind string `json:"kind"`
+	// Rate and Baseline are the number of events in the latest interval and the number expected
+	Rate     float64 `json:"rate"`
+	Baseline float64 `json:"baseline"`
+	// Score is the deviation of the rate from the baseline in standard deviations
+	Score float64 `json:"score"`
+	// Since is when the anomaly was first seen and Time the end of the latest interval, in seconds since the epoch
+	Since int64 `json:"since"`
+	Time  int64 `json:"time"`
+}
+
+// CompactionConfig configures the rollup and deletion of old buckets
+type CompactionConfig struct {
+	// Interval is how often buckets are compacted and their key counts and memory measured
+	Interval time.Duration
+	// RollupAfter is how long after it ends a day bucket is rolled up into the week and month buckets not kept
+	// by the aggregator and then deleted. Zero disables it
+	RollupAfter time.Duration
+	// Retention is how long after they end the buckets of each resolution are deleted, by resolution name
+	// Resolutions not listed are kept until their TTL expires, if any.
+	Retention map[string]time.Duration
+}
+
+// Compactor rolls up and deletes old buckets and measures the keys of each resolution
+type Compactor struct {
+	cfg     CompactionConfig
+	r       *redis.Client
+	buckets *Bucketing
+}
+
+// bucketIndex collects the names of the counters in buckets to be recorded in the bucket index, by the bucket's IndexKey
+// The index lets readers list buckets and their counters without scanning Redis keys.
+type bucketIndex map[string]*indexedBucket
+
+// indexedBucket is a bucket along with the names of the counters in it
+// Buckets whose keys carry a prefix, i.e. late_ copies, are indexed under keys with the same prefix.
+type indexedBucket struct {
+	bucket bucket.Bucket
+	prefix string
+	names  map[string]bool
+}
+
+// scriptKeys collects the keys a Redis script touches, so they are declared in KEYS and referred to by position in ARGV
+type scriptKeys struct {
+	keys []string
+	pos  map[string]int
+}
+
+// CounterStore keeps the counters written by aggregators and read by the frontend
+// Counters are addressed by the same keys in every store: Store keeps them in Redis, MemoryStore in memory and
+// FileStore in a bbolt database on disk.
+type CounterStore interface {
+	// Apply applies the increments of updates, skipping updates that have been applied before, and records the
+	// buckets counted in in the bucket index. It returns the number of updates skipped.
+	Apply(ctx context.Context, updates []*Update) (int, error)
+	// SetAppliedOffsets overwrites the offsets recorded as applied for the given partitions
+	SetAppliedOffsets(ctx context.Context, offsets map[string]int64) error
+	// Finalize records the watermark and marks the given buckets as finalized
+	Finalize(ctx context.Context, watermark time.Time, buckets []bucket.Bucket) error
+	// Watermark returns the watermark last recorded by Finalize, or the zero time if there is none
+	Watermark(ctx context.Context) (time.Time, error)
+	// FlagHotPages records flagged pages for window after the latest of them was flagged
+	FlagHotPages(ctx context.Context, pages []*HotPage, window time.Duration) error
+	// SetAnomalies replaces the active anomalies, which are kept for ttl unless replaced again
+	SetAnomalies(ctx context.Context, anomalies []*Anomaly, ttl time.Duration) error
+
+	// Counters returns the values of the counters at keys, leaving out those that do not exist
+	Counters(ctx context.Context, keys []string) (map[string]int64, error)
+	// Distinct estimates the number of distinct values added to the HyperLogLogs of each set of keys taken together
+	Distinct(ctx context.Context, keys [][]string) ([]int64, error)
+	// Top returns up to limit members of the sorted set at key by descending score, or all of them if limit is not positive
+	Top(ctx context.Context, key string, limit int) ([]Scored, error)
+	// Hashes returns the fields of the hash at each key, which are empty if it does not exist
+	Hashes(ctx context.Context, keys []string) ([]map[string]string, error)
+	// Buckets returns the IDs of the buckets of a resolution in the bucket index, sorted
+	Buckets(ctx context.Context, res *bucket.Resolution) ([]int64, error)
+	// Names returns the names of the counters of a bucket in the bucket index, in no particular order
+	Names(ctx context.Context, b bucket.Bucket) ([]string, error)
+	// Finalized returns the IDs of the finalized buckets of a resolution
+	Finalized(ctx context.Context, res *bucket.Resolution) (map[int64]bool, error)
+	// IsFinalized reports whether a bucket has been marked as finalized
+	IsFinalized(ctx context.Context, b bucket.Bucket) (bool, error)
+
+	// Close releases the store. Closing it again has no effect.
+	Close() error
+}
+
+// Scored is a member of a sorted set along with its score
+type Scored struct {
+	Member string
+	Score  float64
+}
+
+// ErrIncompleteSource is returned when committing a Reaggregation whose events do not span all the days rebuilt
+var ErrIncompleteSource = fmt.Errorf("Events do not cover the days being rebuilt")
+
+// ErrUnknownStore is returned when a counter store is configured that does not exist
+var ErrUnknownStore = fmt.Errorf("Unknown counter store")
+
+// ErrUnsupportedByStore is returned when an operation is requested that the configured counter store cannot perform
+var ErrUnsupportedByStore = fmt.Errorf("Not supported by the counter store")
+
+// keyspace holds counters by the keys a Store uses in Redis, for the stores that keep counters themselves
+// Reads of keys that do not exist return zero values. Writes that fail fail the read or write running them once it
+// ends, so the methods do not return errors.
+type keyspace interface {
+	// counter returns the value of the counter at key, and whether it exists
+	counter(key string) (int64, bool)
+	setCounter(key string, v int64)
+	// log returns the hyperLogLog at key, or nil if it does not exist. It may be changed and stored with setLog.
+	log(key string) *hyperLogLog
+	setLog(key string, h *hyperLogLog)
+
+	// sorted returns the members of the sorted set at key with their scores, which must not be changed
+	sorted(key string) map[string]float64
+	zscore(key string, member string) (float64, bool)
+	zadd(key string, member string, score float64)
+	zrem(key string, member string)
+
+	// hash returns the fields of the hash at key, which must not be changed
+	hash(key string) map[string]string
+	hget(key string, field string) (string, bool)
+	hset(key string, field string, v string)
+	hdel(key string, field string)
+	hlen(key string) int
+
+	// members returns the members of the set at key
+	members(key string) []string
+	sadd(key string, member string)
+
+	// expiry returns when the key expires, and whether it does
+	expiry(key string) (time.Time, bool)
+	expire(key string, at time.Time)
+	// del deletes the key, whatever its type, along with its expiry
+	del(key string)
+	// expiring returns all keys that expire
+	expiring() []string
+}
+
+// keyspaceDB runs reads and writes on a keyspace, each of which sees and leaves it consistent
+type keyspaceDB interface {
+	view(fn func(ks keyspace)) error
+	update(fn func(ks keyspace)) error
+}
+
+// keyStore is a CounterStore that keeps counters in a keyspace, changing them as the scripts of a Store do in Redis
+type keyStore struct {
+	keys         keyspaceDB
+	replayWindow time.Duration
+	now          func() time.Time
+	// writes counts the writes to the keyspace, to drop expired keys every sweepInterval writes
+	writes uint64
+}
+
+// MemoryStore keeps counters in maps in memory, by the keys a Store uses in Redis
+type MemoryStore struct {
+	*keyStore
+	mu   sync.RWMutex
+	data *memoryKeyspace
+}
+
+// memoryKeyspace is the keyspace of a MemoryStore
+type memoryKeyspace struct {
+	counters map[string]int64
+	logs     map[string]*hyperLogLog
+	zsets    map[string]map[string]float64
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+	expires  map[string]time.Time
+}
+
+// indexEntry is a bucket and the names of its counters as recorded in the bucket index
+type indexEntry struct {
+	// Buckets is the IndexKey of the bucket's resolution and Counters that of the bucket
+	Buckets  string
+	Counters string
+	ID       int64
+	TTL      time.Duration
+	// Cutoff is the ID below which buckets are dropped from the index of their resolution, or empty if none are
+	Cutoff string
+	Names  []string
+}
+
+// FileStore keeps counters in a bbolt database in a directory on disk, by the keys a Store uses in Redis, for
+// single-node deployments. Each write is a transaction synced to disk before it returns.
+type FileStore struct {
+	*keyStore
+	db *bolt.DB
+}
+
+// boltKeyspace is the keyspace of a FileStore within a bbolt transaction
+// Each type of key has a bucket of its own. Sorted sets, hashes and sets are buckets nested in theirs, holding their
+// members. The first error of a write is kept and rolls the transaction back.
+type boltKeyspace struct {
+	tx  *bolt.Tx
+	err error
+}
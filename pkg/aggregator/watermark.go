@@ -0,0 +1,133 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// LateDrop discards late events entirely
+	LateDrop = "drop"
+	// LateBucket counts late events in their all-time counters, and in late_ prefixed copies of their bucket counters
+	LateBucket = "late"
+	// LateApply counts late events like any other, even in finalized buckets
+	LateApply = "apply"
+	// DefaultLatePolicy is the late event policy used unless another is configured
+	DefaultLatePolicy = LateBucket
+
+	// latePrefix prefixes the bucket keys late events are counted in under the LateBucket policy
+	latePrefix = "late_"
+)
+
+// LatePolicies are the names of all late event policies
+var LatePolicies = []string{LateDrop, LateBucket, LateApply}
+
+var (
+	lateTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_aggregator_late_events_total",
+			Help: "Number of events older than the watermark, by the policy applied to them",
+		},
+		[]string{"policy"},
+	)
+
+	watermarkTime = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pleiades_aggregator_watermark_timestamp_seconds",
+			Help: "Event time before which events are considered late",
+		},
+	)
+)
+
+// ValidateLatePolicy returns an error if policy is not one of the LatePolicies
+func ValidateLatePolicy(policy string) error {
+	for _, p := range LatePolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownLatePolicy, policy)
+}
+
+// NewWatermark returns a Watermark allowing events to be up to lateness older than the latest event observed
+// If initial is not zero, the watermark starts out there rather than at the first event observed.
+func NewWatermark(lateness time.Duration, initial time.Time) *Watermark {
+	w := &Watermark{lateness: lateness, finalized: make(map[string]int64)}
+	if !initial.IsZero() {
+		w.max = initial.Add(lateness)
+		w.start = initial
+	}
+	return w
+}
+
+// Time returns the watermark, or the zero time if no event has been observed yet
+func (w *Watermark) Time() time.Time {
+	if w.max.IsZero() {
+		return time.Time{}
+	}
+	return w.max.Add(-w.lateness)
+}
+
+// Observe advances the watermark past an event that occurred at t and reports whether the event is late
+func (w *Watermark) Observe(t time.Time) bool {
+	late := t.Before(w.Time())
+	if t.After(w.max) {
+		w.max = t
+		if w.start.IsZero() {
+			w.start = w.Time()
+		}
+		watermarkTime.Set(float64(w.Time().Unix()))
+	}
+	return late
+}
+
+// Due returns every bucket of each calendar resolution that ended before the watermark and has not been marked
+// finalized yet, oldest first. Buckets of other resolutions are never finalized.
+// Before any bucket of a resolution has been marked finalized, buckets are due from the latest one that ended before
+// the watermark the Watermark started out at, as earlier ones were finalized before or predate the events seen.
+func (w *Watermark) Due(resolutions []*bucket.Resolution) []bucket.Bucket {
+	wm := w.Time()
+	if wm.IsZero() {
+		return nil
+	}
+	var out []bucket.Bucket
+	for _, r := range resolutions {
+		if !r.Calendar() {
+			continue
+		}
+		b := r.At(r.At(w.start).Start().Add(-time.Nanosecond))
+		if id, ok := w.finalized[r.FinalizedKey()]; ok {
+			b = r.At(r.Bucket(id).End())
+		}
+		for ; !b.End().After(wm); b = r.At(b.End()) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Finalized records that the given buckets have been marked finalized
+func (w *Watermark) Finalized(buckets []bucket.Bucket) {
+	for _, b := range buckets {
+		w.finalized[b.Resolution.FinalizedKey()] = b.ID
+	}
+}
+
+// late applies a late event policy to the update of a late event
+func (u *Update) late(policy string) {
+	switch policy {
+	case LateDrop:
+		u.Increments = nil
+		u.buckets = nil
+	case LateBucket:
+		for i := u.allTime; i < len(u.Increments); i++ {
+			u.Increments[i].Key = latePrefix + u.Increments[i].Key
+		}
+		u.lateBuckets = u.buckets
+		u.buckets = nil
+	}
+}
@@ -0,0 +1,90 @@
+package aggregator
+
+import (
+	"time"
+
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watermark", func() {
+
+	base := time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)
+
+	It("trails the latest event by the allowed lateness", func() {
+		w := NewWatermark(time.Hour, time.Time{})
+		Expect(w.Time().IsZero()).Should(BeTrue())
+		Expect(w.Observe(base)).Should(BeFalse())
+		Expect(w.Observe(base.Add(-30 * time.Minute))).Should(BeFalse())
+		Expect(w.Time()).Should(Equal(base.Add(-time.Hour)))
+		Expect(w.Observe(base.Add(-2 * time.Hour))).Should(BeTrue())
+		Expect(w.Time()).Should(Equal(base.Add(-time.Hour)))
+	})
+
+	It("resumes from a recorded watermark", func() {
+		w := NewWatermark(time.Hour, base)
+		Expect(w.Time()).Should(Equal(base))
+		Expect(w.Observe(base.Add(-time.Minute))).Should(BeTrue())
+	})
+
+	It("finalizes each calendar bucket once the watermark has passed it", func() {
+		w := NewWatermark(time.Hour, time.Time{})
+		res := []*bucket.Resolution{bucket.Hour, bucket.Day}
+		w.Observe(base)
+		due := w.Due(res)
+		Expect(due).Should(Equal([]bucket.Bucket{bucket.Day.Bucket(18483)}))
+		w.Finalized(due)
+		w.Observe(base.Add(6 * time.Hour))
+		Expect(w.Due(res)).Should(BeEmpty())
+		w.Observe(base.Add(13 * time.Hour))
+		Expect(w.Due(res)).Should(Equal([]bucket.Bucket{bucket.Day.Bucket(18484)}))
+	})
+
+	It("finalizes every bucket the watermark passed at once", func() {
+		w := NewWatermark(time.Hour, time.Time{})
+		res := []*bucket.Resolution{bucket.Day}
+		w.Observe(base)
+		w.Finalized(w.Due(res))
+		w.Observe(base.Add(72 * time.Hour))
+		Expect(w.Due(res)).Should(Equal([]bucket.Bucket{bucket.Day.Bucket(18484), bucket.Day.Bucket(18485), bucket.Day.Bucket(18486)}))
+	})
+
+	It("finalizes the buckets that ended while stopped when resuming", func() {
+		w := NewWatermark(time.Hour, base)
+		res := []*bucket.Resolution{bucket.Day}
+		w.Observe(base.Add(49 * time.Hour))
+		Expect(w.Due(res)).Should(Equal([]bucket.Bucket{bucket.Day.Bucket(18483), bucket.Day.Bucket(18484), bucket.Day.Bucket(18485)}))
+	})
+
+	It("rejects unknown policies", func() {
+		Expect(ValidateLatePolicy(LateBucket)).To(Succeed())
+		Expect(ValidateLatePolicy("ignore")).Should(MatchError(ErrUnknownLatePolicy))
+	})
+
+	Context("applying policies", func() {
+		rs, _ := LoadRules("")
+		msg := &transport.Message{
+			ID:   `[{"timestamp":1597056638001}]`,
+			Data: []byte(`{"wiki":"enwiki","type":"edit"}`),
+		}
+
+		It("drops late events entirely", func() {
+			u, err := Aggregate(rs, DefaultBucketing(), msg)
+			Expect(err).ShouldNot(HaveOccurred())
+			u.late(LateDrop)
+			Expect(u.Increments).Should(BeEmpty())
+		})
+
+		It("moves bucket counters of late events to late keys", func() {
+			u, err := Aggregate(rs, DefaultBucketing(), msg)
+			Expect(err).ShouldNot(HaveOccurred())
+			u.late(LateBucket)
+			Expect(u.Increments).Should(ContainElement(Increment{Key: "pleiades_total", Delta: 1}))
+			Expect(u.Increments).Should(ContainElement(Increment{Key: "late_day_18484_pleiades_total", Delta: 1}))
+			Expect(u.Increments).ShouldNot(ContainElement(Increment{Key: "day_18484_pleiades_total", Delta: 1}))
+		})
+	})
+})
@@ -0,0 +1,283 @@
+package bucket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Minute buckets are numbered by minutes since the epoch
+	Minute = &Resolution{
+		Name:  "minute",
+		TTL:   48 * time.Hour,
+		id:    func(t time.Time) int64 { return t.Unix() / 60 },
+		start: func(id int64, loc *time.Location) time.Time { return time.Unix(id*60, 0).In(loc) },
+		next:  func(start time.Time) time.Time { return start.Add(time.Minute) },
+	}
+	// Hour buckets are numbered by hours since the epoch
+	Hour = &Resolution{
+		Name:  "hour",
+		TTL:   30 * 24 * time.Hour,
+		id:    func(t time.Time) int64 { return t.Unix() / 3600 },
+		start: func(id int64, loc *time.Location) time.Time { return time.Unix(id*3600, 0).In(loc) },
+		next:  func(start time.Time) time.Time { return start.Add(time.Hour) },
+	}
+	// Day buckets are numbered by calendar days since the epoch
+	Day = &Resolution{
+		Name:     "day",
+		calendar: true,
+		id:       func(t time.Time) int64 { return civilDays(t.Date()) },
+		start: func(id int64, loc *time.Location) time.Time {
+			d := time.Unix(id*86400, 0).UTC()
+			return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+		},
+		next: func(start time.Time) time.Time { return start.AddDate(0, 0, 1) },
+	}
+	// Week buckets are ISO weeks, numbered as year * 100 + week
+	Week = &Resolution{
+		Name:     "week",
+		calendar: true,
+		id: func(t time.Time) int64 {
+			y, w := t.ISOWeek()
+			return int64(y*100 + w)
+		},
+		start: func(id int64, loc *time.Location) time.Time {
+			// January 4th is always in week 1
+			jan4 := time.Date(int(id/100), time.January, 4, 0, 0, 0, 0, loc)
+			monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+			return monday.AddDate(0, 0, 7*(int(id%100)-1))
+		},
+		next: func(start time.Time) time.Time { return start.AddDate(0, 0, 7) },
+	}
+	// Month buckets are calendar months, numbered as year * 100 + month
+	Month = &Resolution{
+		Name:     "month",
+		calendar: true,
+		id: func(t time.Time) int64 {
+			return int64(t.Year()*100 + int(t.Month()))
+		},
+		start: func(id int64, loc *time.Location) time.Time {
+			return time.Date(int(id/100), time.Month(id%100), 1, 0, 0, 0, 0, loc)
+		},
+		next: func(start time.Time) time.Time { return start.AddDate(0, 1, 0) },
+	}
+
+	all = []*Resolution{Minute, Hour, Day, Week, Month}
+
+	// UTC is the zone buckets are aligned to by default. Its buckets have no zone tag in their keys
+	UTC = &Zone{Location: time.UTC}
+)
+
+// HomeTag is the zone tag of buckets aligned to the home time zone of each event's wiki
+const HomeTag = "home"
+
+// civilDays returns the number of days between the epoch and the given date
+func civilDays(year int, month time.Month, day int) int64 {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+// LoadZone returns the zone for an IANA time zone name
+// Its tag is the name with underscores replaced, as they separate the parts of Redis keys.
+// The name HomeTag yields the zone of buckets aligned to wikis' home time zones, with UTC boundaries.
+func LoadZone(name string) (*Zone, error) {
+	if name == "" || name == "UTC" {
+		return UTC, nil
+	}
+	if name == HomeTag {
+		return &Zone{Tag: HomeTag, Location: time.UTC}, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s: %v", name, err)
+	}
+	return &Zone{Tag: strings.ReplaceAll(name, "_", "-"), Location: loc}, nil
+}
+
+// ParseZones returns the zones named in a comma-separated list
+func ParseZones(names string) ([]*Zone, error) {
+	var out []*Zone
+	for _, name := range strings.Split(names, ",") {
+		z, err := LoadZone(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, z)
+	}
+	return out, nil
+}
+
+// Lookup returns the resolution with the given name
+func Lookup(name string) (*Resolution, error) {
+	for _, r := range all {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownResolution, name)
+}
+
+// Names returns the names of all resolutions, from finest to coarsest
+func Names() []string {
+	out := make([]string, len(all))
+	for i, r := range all {
+		out[i] = r.Name
+	}
+	return out
+}
+
+// Parse returns the resolutions named in a comma-separated list
+// ttls optionally overrides their default TTLs as a comma-separated list of name=duration pairs.
+func Parse(names string, ttls string) ([]*Resolution, error) {
+	overrides, err := ParseDurations(ttls)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Resolution
+	for _, name := range strings.Split(names, ",") {
+		r, err := Lookup(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		c := *r
+		if d, ok := overrides[r.Name]; ok {
+			c.TTL = d
+		}
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+// ParseDurations returns the durations in a comma-separated list of name=duration pairs, by resolution name
+func ParseDurations(s string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	if s == "" {
+		return out, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bucket duration %s, expected name=duration", pair)
+		}
+		if _, err := Lookup(parts[0]); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket duration %s: %v", pair, err)
+		}
+		out[parts[0]] = d
+	}
+	return out, nil
+}
+
+// Calendar reports whether the boundaries of the resolution's buckets depend on the time zone
+func (r *Resolution) Calendar() bool {
+	return r.calendar
+}
+
+// In returns the resolution aligned to the given zone
+// Resolutions whose buckets do not depend on the time zone are returned unchanged.
+func (r *Resolution) In(z *Zone) *Resolution {
+	if !r.calendar || z == r.Zone || (z == UTC && r.Zone == nil) {
+		return r
+	}
+	c := *r
+	c.Zone = z
+	return &c
+}
+
+func (r *Resolution) location() *time.Location {
+	if r.Zone == nil {
+		return time.UTC
+	}
+	return r.Zone.Location
+}
+
+// Tag returns the name of the resolution including its zone tag, as used in Redis keys
+func (r *Resolution) Tag() string {
+	if r.Zone == nil || r.Zone.Tag == "" {
+		return r.Name
+	}
+	return r.Name + "." + r.Zone.Tag
+}
+
+// At returns the bucket containing t
+func (r *Resolution) At(t time.Time) Bucket {
+	return Bucket{Resolution: r, ID: r.id(t.In(r.location()))}
+}
+
+// Bucket returns the bucket with the given ID
+func (r *Resolution) Bucket(id int64) Bucket {
+	return Bucket{Resolution: r, ID: id}
+}
+
+// KeyPattern returns a Redis key pattern matching the keys of all buckets of this resolution
+func (r *Resolution) KeyPattern() string {
+	return r.Tag() + "_*"
+}
+
+// FinalizedKey returns the Redis sorted set holding the IDs of finalized buckets of this resolution
+// Counters in a finalized bucket no longer change.
+func (r *Resolution) FinalizedKey() string {
+	return "finalized_" + r.Tag()
+}
+
+// IndexKey returns the Redis sorted set indexing the IDs of the buckets of this resolution that hold counters
+func (r *Resolution) IndexKey() string {
+	return "index_" + r.Tag()
+}
+
+// FromKey returns the bucket a Redis key belongs to, if it has the prefix of a bucket of this resolution
+func (r *Resolution) FromKey(key string) (Bucket, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != r.Tag() {
+		return Bucket{}, false
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Bucket{}, false
+	}
+	return r.Bucket(id), true
+}
+
+// Prefix returns the prefix of the Redis keys of counters in the bucket
+func (b Bucket) Prefix() string {
+	return fmt.Sprintf("%s_%d_", b.Resolution.Tag(), b.ID)
+}
+
+// IndexKey returns the Redis set indexing the names of the counters in the bucket
+func (b Bucket) IndexKey() string {
+	return fmt.Sprintf("index_%s_%d", b.Resolution.Tag(), b.ID)
+}
+
+// Start returns the beginning of the bucket
+func (b Bucket) Start() time.Time {
+	return b.Resolution.start(b.ID, b.Resolution.location())
+}
+
+// End returns the beginning of the following bucket
+func (b Bucket) End() time.Time {
+	return b.Resolution.next(b.Start())
+}
+
+// Within reports whether the bucket lies entirely between from (inclusive) and to (exclusive)
+func (b Bucket) Within(from time.Time, to time.Time) bool {
+	return !b.Start().Before(from) && !b.End().After(to)
+}
+
+// ParseBucket returns the bucket identified by s, which is either a bucket ID, a date as YYYY-MM-DD
+// or an RFC3339 timestamp. Dates and timestamps identify the bucket containing them.
+func (r *Resolution) ParseBucket(s string) (Bucket, error) {
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return r.Bucket(id), nil
+	}
+	if d, err := time.ParseInLocation("2006-01-02", s, r.location()); err == nil {
+		return r.At(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return r.At(t), nil
+	}
+	return Bucket{}, fmt.Errorf("invalid %s bucket %s, expected a bucket ID, YYYY-MM-DD or an RFC3339 timestamp", r.Name, s)
+}
@@ -1,4 +1,4 @@
-package kafka
+package bucket
 
 import (
 	"testing"
@@ -8,8 +8,8 @@ import (
 	"github.com/op/go-logging"
 )
 
-func TestAggregator(t *testing.T) {
+func TestBucket(t *testing.T) {
 	logging.InitForTesting(logging.CRITICAL)
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "Kafka Aggregator Suite")
+	RunSpecs(t, "Bucket Suite")
 }
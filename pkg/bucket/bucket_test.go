@@ -0,0 +1,103 @@
+package bucket
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bucket Resolutions", func() {
+
+	ts := time.Date(2020, 8, 10, 10, 50, 38, 0, time.UTC)
+
+	It("numbers buckets", func() {
+		Expect(Minute.At(ts).Prefix()).Should(Equal("minute_26617610_"))
+		Expect(Hour.At(ts).Prefix()).Should(Equal("hour_443626_"))
+		Expect(Day.At(ts).Prefix()).Should(Equal("day_18484_"))
+		Expect(Week.At(ts).Prefix()).Should(Equal("week_202033_"))
+		Expect(Month.At(ts).Prefix()).Should(Equal("month_202008_"))
+		Expect(Day.IndexKey()).Should(Equal("index_day"))
+		Expect(Day.At(ts).IndexKey()).Should(Equal("index_day_18484"))
+	})
+
+	It("computes bucket boundaries", func() {
+		for _, r := range []*Resolution{Minute, Hour, Day, Week, Month} {
+			b := r.At(ts)
+			Expect(b.Start().After(ts)).To(BeFalse(), r.Name)
+			Expect(b.End().After(ts)).To(BeTrue(), r.Name)
+			Expect(r.At(b.Start())).Should(Equal(b), r.Name)
+			Expect(r.At(b.End().Add(-time.Nanosecond))).Should(Equal(b), r.Name)
+		}
+		Expect(Week.At(ts).Start()).Should(Equal(time.Date(2020, 8, 10, 0, 0, 0, 0, time.UTC)))
+		Expect(Week.Bucket(202101).Start()).Should(Equal(time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)))
+		Expect(Month.Bucket(202012).End()).Should(Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)))
+	})
+
+	It("recognizes the keys of its buckets", func() {
+		b, ok := Hour.FromKey("hour_443626_pleiades_total")
+		Expect(ok).To(BeTrue())
+		Expect(b.ID).Should(Equal(int64(443626)))
+		_, ok = Hour.FromKey("day_18484_pleiades_total")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("parses resolutions and TTL overrides", func() {
+		rs, err := Parse("minute,day", "minute=1h")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rs).Should(HaveLen(2))
+		Expect(rs[0].TTL).Should(Equal(time.Hour))
+		Expect(rs[1].TTL).Should(Equal(time.Duration(0)))
+		Expect(Minute.TTL).Should(Equal(48 * time.Hour))
+
+		_, err = Parse("fortnight", "")
+		Expect(errors.Is(err, ErrUnknownResolution)).To(BeTrue())
+		_, err = Parse("day", "day=forever")
+		Expect(err).To(HaveOccurred())
+
+		ds, err := ParseDurations("day=2160h,week=8760h")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds).Should(Equal(map[string]time.Duration{"day": 2160 * time.Hour, "week": 8760 * time.Hour}))
+	})
+
+	It("aligns calendar buckets to time zones", func() {
+		berlin, err := LoadZone("Europe/Berlin")
+		Expect(err).NotTo(HaveOccurred())
+		ny, err := LoadZone("America/New_York")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ny.Tag).Should(Equal("America/New-York"))
+
+		late := time.Date(2020, 8, 10, 23, 30, 0, 0, time.UTC)
+		Expect(Day.At(late).Prefix()).Should(Equal("day_18484_"))
+		Expect(Day.In(berlin).At(late).Prefix()).Should(Equal("day.Europe/Berlin_18485_"))
+		Expect(Day.In(ny).At(late).Prefix()).Should(Equal("day.America/New-York_18484_"))
+		Expect(Day.In(berlin).At(late).Start()).Should(Equal(time.Date(2020, 8, 11, 0, 0, 0, 0, berlin.Location)))
+		Expect(Hour.In(berlin)).Should(BeIdenticalTo(Hour))
+		Expect(Day.In(UTC)).Should(BeIdenticalTo(Day))
+
+		b, ok := Day.In(ny).FromKey("day.America/New-York_18484_pleiades_total")
+		Expect(ok).To(BeTrue())
+		Expect(b.ID).Should(Equal(int64(18484)))
+		_, ok = Day.FromKey("day.America/New-York_18484_pleiades_total")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("parses bucket IDs, dates and timestamps", func() {
+		berlin, _ := LoadZone("Europe/Berlin")
+		b, err := Day.ParseBucket("18484")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.ID).Should(Equal(int64(18484)))
+		b, err = Day.In(berlin).ParseBucket("2020-08-10")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.ID).Should(Equal(int64(18484)))
+		b, err = Week.ParseBucket("2020-08-12")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.ID).Should(Equal(int64(202033)))
+		b, err = Hour.ParseBucket("2020-08-10T10:50:38Z")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.ID).Should(Equal(int64(443626)))
+		_, err = Day.ParseBucket("yesterday")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,38 @@
+package bucket
+
+import (
+	"fmt"
+	"time"
+)
+
+// Resolution is a granularity at which counters are bucketed in time
+type Resolution struct {
+	// Name identifies the resolution in Redis key prefixes and API paths
+	Name string
+	// TTL is how long buckets of this resolution are kept. Zero keeps them forever
+	TTL time.Duration
+	// Zone is the time zone calendar buckets are aligned to. Nil means UTC
+	Zone *Zone
+
+	calendar bool
+	id       func(t time.Time) int64
+	start    func(id int64, loc *time.Location) time.Time
+	next     func(start time.Time) time.Time
+}
+
+// Zone is a time zone buckets can be aligned to
+type Zone struct {
+	// Tag identifies the zone in Redis keys
+	Tag string
+	// Location is used to find bucket boundaries
+	Location *time.Location
+}
+
+// Bucket is a single period of time at a given Resolution
+type Bucket struct {
+	Resolution *Resolution
+	ID         int64
+}
+
+// ErrUnknownResolution is returned when a resolution is requested that does not exist
+var ErrUnknownResolution = fmt.Errorf("Unknown bucket resolution")
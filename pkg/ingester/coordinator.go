@@ -5,10 +5,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/ingester/publisher"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
 	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -39,86 +39,48 @@ func (c *Coordinator) Start() (string, error) {
 	c.events = make(chan (*sse.Event))
 	var resumeID string
 
-	if c.File != nil {
-		f, err := file.NewPublisher(c.File, c.events)
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to initialize file publisher: %v", err)
-		}
-		if c.Resume {
-			resumeID = f.GetResumeID()
-			if resumeID != "" {
-				logger.Infof("Resume Event ID found: %s", resumeID)
-			} else {
-				logger.Info("No resume ID found")
-			}
-		}
-		wgSub.Add(1)
-		go func() {
-			defer wgSub.Done()
-			for {
-				for {
-					select {
-					case <-c.stop:
-						{
-							return
-						}
-					default:
-						count, err := f.ReadAndPublish()
-						if err != nil {
-							logger.Errorf("File Publisher exited with error after processing %d events: %s", count, err)
-						} else {
-							logger.Infof("File Publisher finished after processing %d events\n", count)
-						}
-						restarts.WithLabelValues("file_publisher").Inc()
-					}
-				}
-			}
-		}()
-		logger.Debug("file publisher is up")
+	prod, err := transport.NewProducer(c.Transport, c.TransportOpts)
+	if err != nil {
+		return lastEventID, fmt.Errorf("Failed to initialize %s transport: %v", c.Transport, err)
 	}
-
-	if c.Kafka != nil {
-		k, err := kafka.NewPublisher(c.Kafka, c.events)
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to initialize kafka publisher: %v", err)
-		}
-		err = k.ValidateConnection()
-		if err != nil {
-			return lastEventID, fmt.Errorf("Failed to validate kafka connection: %v", err)
-		}
-		if c.Resume {
-			resumeID = k.GetResumeID()
-			if resumeID != "" {
-				logger.Infof("Resume Event ID found: %s", resumeID)
-			} else {
-				logger.Info("No resume ID found")
-			}
+	p, err := publisher.NewPublisher(prod, c.events, c.Privacy, c.Signals)
+	if err != nil {
+		return lastEventID, fmt.Errorf("Failed to initialize publisher: %v", err)
+	}
+	err = p.ValidateConnection()
+	if err != nil {
+		return lastEventID, fmt.Errorf("Failed to validate %s connection: %v", c.Transport, err)
+	}
+	if c.Resume {
+		resumeID = p.GetResumeID()
+		if resumeID != "" {
+			logger.Infof("Resume Event ID found: %s", resumeID)
+		} else {
+			logger.Info("No resume ID found")
 		}
-		wgSub.Add(1)
-		go func() {
-			defer wgSub.Done()
-			for {
-				for {
-					select {
-					case <-c.stop:
-						{
-							return
-						}
-					default:
-						count, err := k.ReadAndPublish()
-						logger.Debug("Kafka Publisher exited")
-						if err != nil {
-							logger.Errorf("Kafka Publisher exited with error after processing %d events: %s", count, err)
-						} else {
-							logger.Infof("Kafka Publisher finished after processing %d events\n", count)
-						}
-						restarts.WithLabelValues("kafka_publisher").Inc()
-					}
+	}
+	wgSub.Add(1)
+	go func() {
+		defer wgSub.Done()
+		for {
+			select {
+			case <-c.stop:
+				{
+					return
+				}
+			default:
+				count, err := p.ReadAndPublish()
+				logger.Debugf("%s Publisher exited", c.Transport)
+				if err != nil {
+					logger.Errorf("%s Publisher exited with error after processing %d events: %s", c.Transport, count, err)
+				} else {
+					logger.Infof("%s Publisher finished after processing %d events\n", c.Transport, count)
 				}
+				restarts.WithLabelValues(c.Transport + "_publisher").Inc()
 			}
-		}()
-		logger.Debug("kafka publisher is up")
-	}
+		}
+	}()
+	logger.Debugf("%s publisher is up", c.Transport)
 
 	wgPub.Add(1)
 	go func() {
@@ -0,0 +1,119 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const moduleName = "publisher"
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	skippedEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_publish_skipped_events_total",
+			Help: "Total number of events not published because they could not be processed",
+		},
+		[]string{"reason"})
+)
+
+// NewPublisher returns a Publisher initialized with the source channel and transport Producer provided
+// If pp is not nil, events are published only after marking reverts with the signals s, or the default ones
+// if s is nil, and applying the privacy policy to them.
+func NewPublisher(p transport.Producer, src <-chan *sse.Event, pp *privacy.Policy, s *aggregator.Signals) (*Publisher, error) {
+	if src == nil {
+		return nil, ErrNilChan
+	}
+	if s == nil {
+		var err error
+		s, err = aggregator.LoadSignals("")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Publisher{
+		source:   src,
+		producer: p,
+		privacy:  pp,
+		signals:  s,
+	}, nil
+}
+
+// ValidateConnection checks that the underlying transport is reachable
+func (p *Publisher) ValidateConnection() error {
+	return p.producer.ValidateConnection()
+}
+
+// GetResumeID returns the ID of the last event published by the underlying transport, if known
+func (p *Publisher) GetResumeID() string {
+	return p.producer.GetResumeID()
+}
+
+// ReadAndPublish will read Events from the input channel and publish them to the transport
+//
+// Calling ReadAndPublish() will reset the processed message counter of the Publisher and
+// returns the value of the counter when the Publisher's source channel is closed.
+// Once the source channel is closed, the underlying Producer is closed as well.
+func (p *Publisher) ReadAndPublish() (int64, error) {
+	logger.Debug("Publisher starting to process events")
+	p.msgCount = 0
+	for e := range p.source {
+		p.msgCount++
+		if e != nil {
+			err := p.ProcessEvent(e)
+			if err != nil {
+				return p.msgCount, fmt.Errorf("error processing event: %v", err)
+			}
+		}
+	}
+	err := p.producer.Close()
+	if err != nil {
+		logger.Errorf("Error closing transport: %v", err)
+	}
+	logger.Debug("Publisher stopped")
+	return p.msgCount, nil
+}
+
+// ProcessEvent publishes a single event
+// Events the privacy policy cannot be applied to are logged and skipped, as publishing them could leak what it removes.
+func (p *Publisher) ProcessEvent(e *sse.Event) error {
+	d, err := ioutil.ReadAll(e.GetData())
+	if err != nil {
+		return fmt.Errorf("error reading event data: %v", err)
+	}
+	if p.privacy != nil {
+		d, err = p.applyPrivacy(d)
+		if err != nil {
+			logger.Errorf("Skipping event %s: %v", e.ID, err)
+			skippedEvents.WithLabelValues("privacy").Inc()
+			return nil
+		}
+	}
+	return p.producer.Publish(&transport.Message{
+		ID:   e.ID,
+		Data: d,
+	})
+}
+
+// applyPrivacy returns the event data with reverts marked and the privacy policy applied
+// Reverts are marked first, so that the aggregator still counts them if the policy drops comments.
+func (p *Publisher) applyPrivacy(d []byte) ([]byte, error) {
+	var event map[string]interface{}
+	err := json.Unmarshal(d, &event)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing event data to apply privacy policy: %v", err)
+	}
+	p.signals.Annotate(event)
+	p.privacy.Apply(event)
+	return json.Marshal(event)
+}
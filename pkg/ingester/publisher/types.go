@@ -1,11 +1,22 @@
 package publisher
 
-import "github.com/gargath/pleiades/pkg/ingester/sse"
-
-//Publisher defines ways to send received Events to other systems or process them in some form
-type Publisher interface {
-	ReadAndPublish() (int64, error)
-	ProcessEvent(*sse.Event) error
-	GetResumeID() string
-	ValidateConnection() error
+import (
+	"fmt"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// Publisher reads Events from a channel and sends them to a transport Producer
+type Publisher struct {
+	source   <-chan *sse.Event
+	producer transport.Producer
+	privacy  *privacy.Policy
+	signals  *aggregator.Signals
+	msgCount int64
 }
+
+// ErrNilChan indicates that the Publisher has no source channel
+var ErrNilChan error = fmt.Errorf("Source channel is nil")
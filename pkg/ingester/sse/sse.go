@@ -125,7 +125,7 @@ func Notify(uri string, resumeID string, evCh chan<- *Event, stopChan <-chan boo
 			return lastEventID, fmt.Errorf("unknown error reading HTTP response")
 		}
 		if resp.StatusCode > 299 {
-			logger.Errorf("Server at %s responded %s", uri, resp.StatusCode)
+			logger.Errorf("Server at %s responded %d", uri, resp.StatusCode)
 			return lastEventID, fmt.Errorf("non 2xx status code from request for %s: %d", uri, resp.StatusCode)
 		}
 		res = resp
@@ -1,19 +1,24 @@
 package ingester
 
 import (
-	"github.com/gargath/pleiades/pkg/ingester/publisher/file"
-	"github.com/gargath/pleiades/pkg/ingester/publisher/kafka"
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/privacy"
+	"github.com/gargath/pleiades/pkg/transport"
 	"github.com/gargath/pleiades/pkg/util"
 )
 
 // Coordinator ingests an SSE stream from WMF and processes each event in turn
 type Coordinator struct {
-	LastMsgID string
-	Resume    bool
-	File      *file.Opts
-	Kafka     *kafka.Opts
-	stop      chan (bool)
-	events    chan *sse.Event
-	spinner   *util.Spinner
+	LastMsgID     string
+	Resume        bool
+	Transport     string
+	TransportOpts transport.Opts
+	// Privacy is applied to every event before it is published. Nil publishes events unchanged
+	Privacy *privacy.Policy
+	// Signals mark reverts in events before Privacy drops their comments. Defaults to aggregator.DefaultSignals
+	Signals *aggregator.Signals
+	stop    chan (bool)
+	events  chan *sse.Event
+	spinner *util.Spinner
 }
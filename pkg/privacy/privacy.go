@@ -0,0 +1,141 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// PseudonymPrefix starts every pseudonym. It cannot occur in MediaWiki user names, so pseudonyms are never
+// mistaken for users and pseudonymizing an event twice leaves it unchanged.
+const PseudonymPrefix = "#"
+
+// DefaultConfig truncates the addresses of anonymous users and drops edit summaries, but leaves user names alone
+var DefaultConfig = Config{
+	IPv4Prefix: 24,
+	IPv6Prefix: 48,
+	DropFields: []string{"comment", "parsedcomment", "log_action_comment"},
+}
+
+// Load returns the Policy defined by a privacy file, or nil if path is empty
+// Settings missing from the file keep their default.
+func Load(path string) (*Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read privacy file: %v", err)
+	}
+	c := DefaultConfig
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse privacy file: %v", err)
+	}
+	return New(c)
+}
+
+// New returns the Policy defined by a Config
+func New(c Config) (*Policy, error) {
+	p := &Policy{
+		keys:       make(map[string][]byte),
+		activeKey:  c.ActiveKey,
+		ipv4Prefix: c.IPv4Prefix,
+		ipv6Prefix: c.IPv6Prefix,
+		drop:       c.DropFields,
+	}
+	for id, secret := range c.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key ID %q, must be non-empty and not contain a colon", id)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("key %s is too short, use at least 16 characters", id)
+		}
+		p.keys[id] = []byte(secret)
+	}
+	if p.activeKey != "" && p.keys[p.activeKey] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, p.activeKey)
+	}
+	if p.ipv4Prefix < 0 || p.ipv4Prefix > 32 || p.ipv6Prefix < 0 || p.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IP prefix lengths %d and %d", p.ipv4Prefix, p.ipv6Prefix)
+	}
+	return p, nil
+}
+
+// Apply pseudonymizes the user of an event in place and removes the fields to drop
+// The accounts created by newusers log events are pseudonymized in their titles as well.
+func (p *Policy) Apply(event map[string]interface{}) {
+	for _, f := range p.drop {
+		delete(event, f)
+	}
+	if user, ok := event["user"].(string); ok {
+		event["user"] = p.User(user)
+	}
+	if event["type"] == "log" && event["log_type"] == "newusers" {
+		if title, ok := event["title"].(string); ok {
+			if i := strings.Index(title, ":"); i >= 0 {
+				event["title"] = title[:i+1] + p.User(title[i+1:])
+			}
+		}
+	}
+}
+
+// User returns the pseudonym of a user: the truncated address of anonymous users, and the keyed hash of
+// the name of registered users if a key is active
+func (p *Policy) User(user string) string {
+	if ip := net.ParseIP(user); ip != nil {
+		return p.truncate(ip)
+	}
+	if p.activeKey == "" || user == "" || strings.HasPrefix(user, PseudonymPrefix) {
+		return user
+	}
+	return Pseudonym(p.activeKey, p.keys[p.activeKey], user)
+}
+
+// Pseudonyms returns the pseudonym of a registered user under each key, by key ID
+// This finds a user's data pseudonymized with keys that have since been rotated.
+func (p *Policy) Pseudonyms(user string) map[string]string {
+	out := make(map[string]string, len(p.keys))
+	for id, key := range p.keys {
+		out[id] = Pseudonym(id, key, user)
+	}
+	return out
+}
+
+// KeyIDs returns the IDs of all keys, sorted
+func (p *Policy) KeyIDs() []string {
+	out := make([]string, 0, len(p.keys))
+	for id := range p.keys {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Pseudonym returns PseudonymPrefix, the key ID, a colon and the hex encoded first 16 bytes of the
+// HMAC-SHA256 of the user name under the key
+func Pseudonym(keyID string, key []byte, user string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(user))
+	return PseudonymPrefix + keyID + ":" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// truncate zeroes all but the leading prefix bits of an address
+func (p *Policy) truncate(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		if p.ipv4Prefix == 0 {
+			return v4.String()
+		}
+		return v4.Mask(net.CIDRMask(p.ipv4Prefix, 32)).String()
+	}
+	if p.ipv6Prefix == 0 {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(p.ipv6Prefix, 128)).String()
+}
@@ -0,0 +1,91 @@
+package privacy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func parse(data string) map[string]interface{} {
+	var event map[string]interface{}
+	Expect(json.Unmarshal([]byte(data), &event)).To(Succeed())
+	return event
+}
+
+var _ = Describe("Privacy", func() {
+	cfg := Config{
+		Keys:       map[string]string{"2020a": "0123456789abcdef0123456789abcdef", "2020b": "fedcba9876543210fedcba9876543210"},
+		ActiveKey:  "2020b",
+		IPv4Prefix: 24,
+		IPv6Prefix: 48,
+		DropFields: []string{"comment", "parsedcomment"},
+	}
+
+	It("pseudonymizes users, truncates addresses and drops fields", func() {
+		p, err := New(cfg)
+		Expect(err).NotTo(HaveOccurred())
+		event := parse(`{"user":"Alice","comment":"Hi, I am Alice","parsedcomment":"Hi","title":"Foo"}`)
+		p.Apply(event)
+		Expect(event).Should(Equal(map[string]interface{}{"user": Pseudonym("2020b", []byte(cfg.Keys["2020b"]), "Alice"), "title": "Foo"}))
+		Expect(event["user"]).Should(HavePrefix("#2020b:"))
+		Expect(event["user"]).Should(HaveLen(len("#2020b:") + 32))
+
+		Expect(p.User("192.0.2.123")).Should(Equal("192.0.2.0"))
+		Expect(p.User("2001:db8:1234:5678::1")).Should(Equal("2001:db8:1234::"))
+	})
+
+	It("is idempotent", func() {
+		p, _ := New(cfg)
+		event := parse(`{"user":"Alice"}`)
+		p.Apply(event)
+		once := event["user"]
+		p.Apply(event)
+		Expect(event["user"]).Should(Equal(once))
+		Expect(p.User(p.User("192.0.2.123"))).Should(Equal("192.0.2.0"))
+	})
+
+	It("pseudonymizes accounts created by newusers log events consistently with their edits", func() {
+		p, _ := New(cfg)
+		event := parse(`{"type":"log","log_type":"newusers","log_action":"create2","user":"Admin","title":"User:Bob"}`)
+		p.Apply(event)
+		Expect(event["title"]).Should(Equal("User:" + p.User("Bob")))
+	})
+
+	It("finds pseudonyms under rotated keys", func() {
+		p, _ := New(cfg)
+		Expect(p.KeyIDs()).Should(Equal([]string{"2020a", "2020b"}))
+		ps := p.Pseudonyms("Alice")
+		Expect(ps["2020b"]).Should(Equal(p.User("Alice")))
+		Expect(ps["2020a"]).ShouldNot(Equal(ps["2020b"]))
+	})
+
+	It("rejects invalid configurations", func() {
+		_, err := New(Config{ActiveKey: "missing"})
+		Expect(err).Should(MatchError(ErrUnknownKey))
+		_, err = New(Config{Keys: map[string]string{"a": "short"}})
+		Expect(err).To(HaveOccurred())
+		_, err = New(Config{IPv4Prefix: 33})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("loads the defaults for settings missing from the file", func() {
+		p, err := Load("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeNil())
+
+		f, err := ioutil.TempFile("", "privacy")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(`{"keys": {"k1": "0123456789abcdef0123"}, "active_key": "k1"}`)
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		p, err = Load(f.Name())
+		Expect(err).NotTo(HaveOccurred())
+		event := parse(`{"user":"198.51.100.7","comment":"x","log_action_comment":"y"}`)
+		p.Apply(event)
+		Expect(event).Should(Equal(map[string]interface{}{"user": "198.51.100.0"}))
+	})
+})
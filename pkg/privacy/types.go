@@ -0,0 +1,30 @@
+package privacy
+
+import (
+	"fmt"
+)
+
+// Config is the privacy policy as found in a privacy file
+type Config struct {
+	// Keys are the HMAC secrets users may be pseudonymized with, by key ID
+	Keys map[string]string `json:"keys"`
+	// ActiveKey is the ID of the key users are pseudonymized with. Empty leaves user names alone
+	ActiveKey string `json:"active_key"`
+	// IPv4Prefix and IPv6Prefix are the number of leading bits kept of the addresses of anonymous users. Zero keeps them whole
+	IPv4Prefix int `json:"ipv4_prefix"`
+	IPv6Prefix int `json:"ipv6_prefix"`
+	// DropFields are the top-level event fields removed entirely
+	DropFields []string `json:"drop_fields"`
+}
+
+// Policy pseudonymizes the users of events and removes fields that may identify them
+type Policy struct {
+	keys       map[string][]byte
+	activeKey  string
+	ipv4Prefix int
+	ipv6Prefix int
+	drop       []string
+}
+
+// ErrUnknownKey is returned when a privacy policy refers to a key it does not have
+var ErrUnknownKey = fmt.Errorf("Unknown pseudonymization key")
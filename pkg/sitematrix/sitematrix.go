@@ -0,0 +1,189 @@
+package sitematrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultSites are the wikis whose family or language cannot be derived from their database or host name
+// Other wikis are named <language><suffix> and served from <language>.<family>.org, see Families.
+var DefaultSites = []Site{
+	{DBName: "commonswiki", Server: "commons.wikimedia.org", Family: "commons"},
+	{DBName: "wikidatawiki", Server: "www.wikidata.org", Family: "wikidata"},
+	{DBName: "testwikidatawiki", Server: "test.wikidata.org", Family: "wikidata"},
+	{DBName: "wikifunctionswiki", Server: "www.wikifunctions.org", Family: "wikifunctions"},
+	{DBName: "metawiki", Server: "meta.wikimedia.org", Family: "meta"},
+	{DBName: "mediawikiwiki", Server: "www.mediawiki.org", Family: "mediawiki"},
+	{DBName: "specieswiki", Server: "species.wikimedia.org", Family: "species"},
+	{DBName: "incubatorwiki", Server: "incubator.wikimedia.org", Family: "incubator"},
+	{DBName: "foundationwiki", Server: "foundation.wikimedia.org", Family: "foundation"},
+	{DBName: "outreachwiki", Server: "outreach.wikimedia.org", Family: "outreach"},
+	{DBName: "loginwiki", Server: "login.wikimedia.org", Family: "login"},
+	{DBName: "sourceswiki", Server: "wikisource.org", Family: "wikisource"},
+	{DBName: "betawikiversity", Server: "beta.wikiversity.org", Family: "wikiversity"},
+	{DBName: "testwiki", Server: "test.wikipedia.org", Family: "wikipedia", Language: "en"},
+	{DBName: "test2wiki", Server: "test2.wikipedia.org", Family: "wikipedia", Language: "en"},
+	{DBName: "simplewiki", Server: "simple.wikipedia.org", Family: "wikipedia", Language: "en"},
+	{DBName: "simplewiktionary", Server: "simple.wiktionary.org", Family: "wiktionary", Language: "en"},
+	{DBName: "be_x_oldwiki", Server: "be-tarask.wikipedia.org", Family: "wikipedia", Language: "be-tarask"},
+	{DBName: "zh_min_nanwiki", Server: "zh-min-nan.wikipedia.org", Family: "wikipedia", Language: "nan"},
+	{DBName: "zh_classicalwiki", Server: "zh-classical.wikipedia.org", Family: "wikipedia", Language: "lzh"},
+	{DBName: "zh_yuewiki", Server: "zh-yue.wikipedia.org", Family: "wikipedia", Language: "yue"},
+}
+
+// Families maps the suffixes of the database names of language wikis to their project family
+// The host name of such a wiki is <language>.<family>.org.
+var Families = map[string]string{
+	"wiki":        "wikipedia",
+	"wiktionary":  "wiktionary",
+	"wikibooks":   "wikibooks",
+	"wikinews":    "wikinews",
+	"wikiquote":   "wikiquote",
+	"wikisource":  "wikisource",
+	"wikiversity": "wikiversity",
+	"wikivoyage":  "wikivoyage",
+}
+
+// languageCode matches the language part of the database name of a language wiki
+var languageCode = regexp.MustCompile(`^[a-z]{2,3}(_[a-z]+)*$`)
+
+// New returns a Matrix knowing the given sites in addition to the DefaultSites
+func New(sites ...Site) *Matrix {
+	m := &Matrix{byDB: make(map[string]*Site), byServer: make(map[string]*Site)}
+	for _, s := range append(append([]Site{}, DefaultSites...), sites...) {
+		s := s
+		if s.DBName != "" {
+			m.byDB[s.DBName] = &s
+		}
+		if s.Server != "" {
+			m.byServer[s.Server] = &s
+		}
+	}
+	return m
+}
+
+// Load returns a Matrix knowing the DefaultSites and, unless path is empty, the sites of a sitematrix snapshot
+// The snapshot is the response of the MediaWiki API, e.g. https://meta.wikimedia.org/w/api.php?action=sitematrix&format=json
+func Load(path string) (*Matrix, error) {
+	if path == "" {
+		return New(), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sitematrix file: %v", err)
+	}
+	sites, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sitematrix file %s: %v", path, err)
+	}
+	return New(sites...), nil
+}
+
+// Parse returns the sites listed in a response of the MediaWiki sitematrix API
+func Parse(data []byte) ([]Site, error) {
+	var s snapshot
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	if s.SiteMatrix == nil {
+		return nil, fmt.Errorf("no sitematrix object")
+	}
+	var out []Site
+	for k, v := range s.SiteMatrix {
+		switch k {
+		case "count":
+		case "specials":
+			specials, _ := v.([]interface{})
+			for _, sp := range specials {
+				out = append(out, parseSite(sp, ""))
+			}
+		default:
+			lang, _ := v.(map[string]interface{})
+			code, _ := lang["code"].(string)
+			sites, _ := lang["site"].([]interface{})
+			for _, st := range sites {
+				out = append(out, parseSite(st, code))
+			}
+		}
+	}
+	return out, nil
+}
+
+// parseSite converts a site object of the sitematrix API, whose code is the family of language wikis and
+// the name of special wikis
+func parseSite(v interface{}, language string) Site {
+	m, _ := v.(map[string]interface{})
+	s := Site{Language: language}
+	s.DBName, _ = m["dbname"].(string)
+	if u, _ := m["url"].(string); u != "" {
+		if parsed, err := url.Parse(u); err == nil {
+			s.Server = parsed.Host
+		}
+	}
+	code, _ := m["code"].(string)
+	s.Family = code
+	if f, ok := Families[code]; ok {
+		s.Family = f
+	}
+	return s
+}
+
+// Lookup returns the Site of a wiki, given its database name, its host name or both
+// Wikis not in the matrix are derived from the naming conventions of language wikis. The boolean is false if
+// that is not possible either.
+func (m *Matrix) Lookup(dbName string, server string) (Site, bool) {
+	if s, ok := m.byDB[dbName]; ok {
+		return *s, true
+	}
+	if s, ok := m.byServer[server]; ok {
+		return *s, true
+	}
+	if s, ok := fromDBName(dbName); ok {
+		return s, true
+	}
+	return fromServer(server)
+}
+
+// fromDBName derives the Site of a language wiki named <language><suffix>
+func fromDBName(dbName string) (Site, bool) {
+	for suffix, family := range Families {
+		if suffix == "wiki" {
+			continue
+		}
+		if lang := strings.TrimSuffix(dbName, suffix); lang != dbName && languageCode.MatchString(lang) {
+			return languageSite(dbName, lang, family), true
+		}
+	}
+	if lang := strings.TrimSuffix(dbName, "wiki"); lang != dbName && languageCode.MatchString(lang) {
+		return languageSite(dbName, lang, "wikipedia"), true
+	}
+	return Site{}, false
+}
+
+// fromServer derives the Site of a language wiki served from <language>.<family>.org
+func fromServer(server string) (Site, bool) {
+	parts := strings.Split(server, ".")
+	if len(parts) != 3 || parts[2] != "org" {
+		return Site{}, false
+	}
+	lang := strings.ReplaceAll(parts[0], "-", "_")
+	if !languageCode.MatchString(lang) {
+		return Site{}, false
+	}
+	for suffix, family := range Families {
+		if parts[1] == family {
+			return languageSite(lang+suffix, lang, family), true
+		}
+	}
+	return Site{}, false
+}
+
+func languageSite(dbName string, lang string, family string) Site {
+	code := strings.ReplaceAll(lang, "_", "-")
+	return Site{DBName: dbName, Server: code + "." + family + ".org", Family: family, Language: code}
+}
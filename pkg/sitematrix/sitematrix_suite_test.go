@@ -0,0 +1,13 @@
+package sitematrix
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSitematrix(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sitematrix Suite")
+}
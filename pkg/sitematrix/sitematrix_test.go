@@ -0,0 +1,56 @@
+package sitematrix
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sitematrix", func() {
+	m := New()
+
+	It("derives language wikis from their database or host name", func() {
+		s, ok := m.Lookup("dewiktionary", "")
+		Expect(ok).To(BeTrue())
+		Expect(s).Should(Equal(Site{DBName: "dewiktionary", Server: "de.wiktionary.org", Family: "wiktionary", Language: "de"}))
+		s, ok = m.Lookup("", "pt-br.wikipedia.org")
+		Expect(ok).To(BeTrue())
+		Expect(s).Should(Equal(Site{DBName: "pt_brwiki", Server: "pt-br.wikipedia.org", Family: "wikipedia", Language: "pt-br"}))
+		s, _ = m.Lookup("enwiki", "en.wikipedia.org")
+		Expect(s.Family).Should(Equal("wikipedia"))
+	})
+
+	It("knows special wikis", func() {
+		s, ok := m.Lookup("commonswiki", "")
+		Expect(ok).To(BeTrue())
+		Expect(s.Family).Should(Equal("commons"))
+		Expect(s.Language).Should(BeEmpty())
+		s, _ = m.Lookup("", "www.wikidata.org")
+		Expect(s.Family).Should(Equal("wikidata"))
+		s, _ = m.Lookup("zh_yuewiki", "")
+		Expect(s.Language).Should(Equal("yue"))
+	})
+
+	It("does not guess unknown wikis", func() {
+		_, ok := m.Lookup("wikimania2019wiki", "wikimania2019.wikimedia.org")
+		Expect(ok).To(BeFalse())
+		_, ok = m.Lookup("", "")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("parses sitematrix API responses", func() {
+		sites, err := Parse([]byte(`{"sitematrix": {"count": 3,
+			"0": {"code": "de", "name": "Deutsch", "site": [{"url": "https://de.wikipedia.org", "dbname": "dewiki", "code": "wiki", "sitename": "Wikipedia"}]},
+			"specials": [{"url": "https://wikimania2019.wikimedia.org", "dbname": "wikimania2019wiki", "code": "wikimania2019", "sitename": "Wikipedia"}]}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sites).Should(ConsistOf(
+			Site{DBName: "dewiki", Server: "de.wikipedia.org", Family: "wikipedia", Language: "de"},
+			Site{DBName: "wikimania2019wiki", Server: "wikimania2019.wikimedia.org", Family: "wikimania2019"},
+		))
+		s, ok := New(sites...).Lookup("wikimania2019wiki", "")
+		Expect(ok).To(BeTrue())
+		Expect(s.Family).Should(Equal("wikimania2019"))
+
+		_, err = Parse([]byte(`{"error": {}}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
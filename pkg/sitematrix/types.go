@@ -0,0 +1,25 @@
+package sitematrix
+
+// Site describes a single wiki
+type Site struct {
+	// DBName is the wiki's database name as found in the wiki field of events, e.g. dewiktionary
+	DBName string
+	// Server is the wiki's host name as found in the server_name field of events, e.g. de.wiktionary.org
+	Server string
+	// Family is the project the wiki belongs to, e.g. wikipedia, wiktionary, wikidata or commons
+	Family string
+	// Language is the wiki's language code, or empty for multilingual wikis such as Commons
+	Language string
+}
+
+// Matrix looks up Sites by database name or host name
+type Matrix struct {
+	byDB     map[string]*Site
+	byServer map[string]*Site
+}
+
+// snapshot is the response of the MediaWiki sitematrix API, which holds one language object per numeric key
+// and a list of special wikis under the key specials.
+type snapshot struct {
+	SiteMatrix map[string]interface{} `json:"sitematrix"`
+}
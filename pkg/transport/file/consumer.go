@@ -0,0 +1,104 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+const pollInterval = 5 * time.Second
+
+// NewConsumer returns a Consumer reading from the source directory in opts
+func NewConsumer(opts transport.Opts) (*Consumer, error) {
+	src := opts[OptDir]
+	if src == "" {
+		return nil, ErrNoSrc
+	}
+	o, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("source directory %s does not exist", src)
+	} else if o.Mode().IsRegular() {
+		logger.Errorf("source path %s exists and is file", src)
+		return nil, fmt.Errorf("source path %s exists as file", src)
+	}
+	return &Consumer{source: src}, nil
+}
+
+// Fetch returns the next event file in the source directory
+// If the directory is empty, it is polled until a file appears or the context expires
+func (c *Consumer) Fetch(ctx context.Context) (*transport.Message, error) {
+	for len(c.pending) == 0 {
+		start := time.Now()
+		logger.Debugf("Reading directory listing for %s", c.source)
+		files, err := ioutil.ReadDir(c.source)
+		logger.Debugf("Listing directory took %s", time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			c.pending = append(c.pending, filepath.Join(c.source, f.Name()))
+		}
+		if len(c.pending) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+	filename := c.pending[0]
+	c.pending = c.pending[1:]
+	return ReadMessage(filename)
+}
+
+// Commit deletes the files the given Messages were read from
+func (c *Consumer) Commit(ctx context.Context, msgs ...*transport.Message) error {
+	for _, m := range msgs {
+		filename, ok := m.Handle.(string)
+		if !ok {
+			return fmt.Errorf("message %s was not read by a file consumer", m.ID)
+		}
+		err := os.Remove(filename)
+		if err != nil {
+			return fmt.Errorf("failed to delete source file %s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+// Close is a no-op and only serves to satisfy the Consumer interface
+func (c *Consumer) Close() error {
+	return nil
+}
+
+// ReadMessage reads a single event file as written by the Producer
+func ReadMessage(filename string) (*transport.Message, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unreadable file %s: %v", filename, err)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("premature end of file while reading %s", filename)
+	}
+	msgID := scanner.Text()
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("premature end of file while reading %s", filename)
+	}
+	eventData := append([]byte(nil), scanner.Bytes()...)
+	if scerr := scanner.Err(); scerr != nil {
+		return nil, fmt.Errorf("failed to read data from file %s: %v", filename, scerr)
+	}
+	return &transport.Message{
+		ID:     msgID,
+		Data:   eventData,
+		Handle: filename,
+	}, nil
+}
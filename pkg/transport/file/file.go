@@ -0,0 +1,36 @@
+package file
+
+import (
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+const (
+	moduleName = "file-transport"
+
+	// Name is the name the file transport is registered under
+	Name = "file"
+
+	// OptDir is the directory events are written to and read from
+	OptDir = "publishDir"
+)
+
+var logger = log.MustGetLogger(moduleName)
+
+func init() {
+	transport.Register(&transport.Backend{
+		Name: Name,
+		Options: []transport.Option{
+			{Name: OptDir, Default: "./events", Usage: "the directory to publish events to"},
+		},
+		NewProducer: func(opts transport.Opts) (transport.Producer, error) {
+			return NewProducer(opts)
+		},
+		NewConsumer: func(opts transport.Opts) (transport.Consumer, error) {
+			return NewConsumer(opts)
+		},
+		NewReplayer: func(opts transport.Opts) (transport.Replayer, error) {
+			return NewReplayer(opts)
+		},
+	})
+}
@@ -0,0 +1,93 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const resumeIDFile = "./.pleiades_resumeID"
+
+var (
+	eventsPublished = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pleiades_file_publish_events_total",
+			Help: "The total number of events published to filesystem",
+		})
+
+	pubErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pleiades_file_publish_errors_total",
+			Help: "Total numbers of errors encountered while publishing to filesystem",
+		},
+		[]string{"type"})
+)
+
+// NewProducer returns a Producer writing to the destination directory in opts
+// The directory is created if it does not exist
+func NewProducer(opts transport.Opts) (*Producer, error) {
+	dest := opts[OptDir]
+	if dest == "" {
+		return nil, ErrNoDest
+	}
+	o, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		errDir := os.MkdirAll(dest, 0755)
+		if errDir != nil {
+			return nil, fmt.Errorf("failed to create destination directory: %v", errDir)
+		}
+	} else if o.Mode().IsRegular() {
+		logger.Errorf("destination path %s exists and is file", dest)
+		return nil, fmt.Errorf("destination path %s exists as file", dest)
+	}
+	uid := strconv.FormatInt(time.Now().Unix(), 10)
+	return &Producer{
+		destination: dest,
+		prefix:      uid,
+	}, nil
+}
+
+// ValidateConnection always returns nil and only serves to satisfy the Producer interface
+func (f *Producer) ValidateConnection() error {
+	return nil
+}
+
+// Publish writes a single Message to a file
+// File names are sequential and relative to the destination directory
+func (f *Producer) Publish(m *transport.Message) error {
+	eventsPublished.Inc()
+	f.msgCount++
+	d := append([]byte(m.ID+"\n"), m.Data...)
+	err := ioutil.WriteFile(fmt.Sprintf("%s/%s-event-%d.dat", f.destination, f.prefix, f.msgCount), d, 0644)
+	if err != nil {
+		pubErrors.WithLabelValues("write").Inc()
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	f.lastEventID = m.ID
+	return nil
+}
+
+// Close records the ID of the last published Message so it can be used to resume later
+func (f *Producer) Close() error {
+	err := ioutil.WriteFile(resumeIDFile, []byte(f.lastEventID), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write last processed event ID to file %s: %v", resumeIDFile, err)
+	}
+	return nil
+}
+
+// GetResumeID attempts to read the ID of the last processed event from disk and returns it
+func (f *Producer) GetResumeID() string {
+	data, err := ioutil.ReadFile(resumeIDFile)
+	if err != nil {
+		logger.Errorf("failed to open resume ID file %s: %v", resumeIDFile, err)
+		return ""
+	}
+	return string(data)
+}
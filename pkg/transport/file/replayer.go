@@ -0,0 +1,60 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// NewReplayer returns a Replayer reading from the source directory in opts
+func NewReplayer(opts transport.Opts) (*Replayer, error) {
+	src := opts[OptDir]
+	if src == "" {
+		return nil, ErrNoSrc
+	}
+	o, err := os.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("source directory %s is not accessible: %v", src, err)
+	}
+	if !o.IsDir() {
+		return nil, fmt.Errorf("source path %s is not a directory", src)
+	}
+	return &Replayer{source: src}, nil
+}
+
+// Replay reads every event file in the source directory that was written between from and to
+// Files are left in place. Only events not yet consumed by an aggregator are still on disk.
+func (r *Replayer) Replay(ctx context.Context, from time.Time, to time.Time, fn func(m *transport.Message) error) error {
+	files, err := ioutil.ReadDir(r.source)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || f.ModTime().Before(from) || f.ModTime().After(to) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg, err := ReadMessage(filepath.Join(r.source, f.Name()))
+		if err != nil {
+			logger.Errorf("Skipping unreadable event file: %v", err)
+			continue
+		}
+		err = fn(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op and only serves to satisfy the Replayer interface
+func (r *Replayer) Close() error {
+	return nil
+}
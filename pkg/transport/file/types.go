@@ -0,0 +1,30 @@
+package file
+
+import (
+	"fmt"
+)
+
+// Producer writes Messages to disk, one file per Message
+type Producer struct {
+	destination string
+	msgCount    int64
+	prefix      string
+	lastEventID string
+}
+
+// Consumer reads Messages from files in a directory and deletes each file once it is committed
+type Consumer struct {
+	source  string
+	pending []string
+}
+
+// Replayer reads the Messages in a directory without deleting them
+type Replayer struct {
+	source string
+}
+
+// ErrNoDest indicates that the Producer has no destination path
+var ErrNoDest error = fmt.Errorf("No destination path set")
+
+// ErrNoSrc indicates that the Consumer has no source path
+var ErrNoSrc error = fmt.Errorf("No source directory provided")
@@ -0,0 +1,120 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// headerError is the header of a dead-lettered message that holds the reason it could not be processed
+const headerError = "pleiades-error"
+
+// NewConsumer returns a Consumer initialized with the kafka source provided
+// Offsets are only committed when Commit is called, so messages fetched but not committed are delivered again
+// to the consumer group after a restart. A start position is only applied to a group without committed offsets.
+func NewConsumer(opts transport.Opts) (*Consumer, error) {
+	o, err := connectionOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := ParseStartPosition(opts[OptStartOffset])
+	if err != nil {
+		return nil, err
+	}
+	c := &Consumer{
+		source: o,
+		group:  groupID(opts),
+	}
+	startOffset := kafka.FirstOffset
+	if pos != nil && pos.relative() {
+		startOffset = pos.Offset
+	} else if pos != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		offsets, err := InitGroupOffsets(ctx, o, c.group, pos)
+		if err != nil {
+			return nil, err
+		}
+		if offsets == nil {
+			logger.Infof("Consumer group %s has committed offsets already, ignoring start position %s; move it with reset-offsets instead", c.group, opts[OptStartOffset])
+		} else {
+			logger.Infof("Started consumer group %s at offsets %v", c.group, offsets)
+		}
+	}
+	c.r = kafka.NewReader(kafka.ReaderConfig{
+		Brokers:               o.Brokers,
+		GroupID:               c.group,
+		Topic:                 o.Topic,
+		StartOffset:           startOffset,
+		ErrorLogger:           &crudErrorLogger{},
+		Logger:                newCrudLogger(),
+		WatchPartitionChanges: true,
+	})
+	if dlqTopic := opts[OptDeadLetterTopic]; dlqTopic != "" {
+		c.dlq = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:     o.Brokers,
+			Topic:       dlqTopic,
+			ErrorLogger: &crudErrorLogger{},
+			Logger:      newCrudLogger(),
+		})
+	}
+	return c, nil
+}
+
+// Fetch reads the next message from the topic without committing its offset
+func (c *Consumer) Fetch(ctx context.Context) (*transport.Message, error) {
+	msg, err := c.r.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &transport.Message{
+		ID:        string(msg.Key),
+		Data:      msg.Value,
+		Partition: PartitionName(c.group, msg.Topic, msg.Partition),
+		Offset:    msg.Offset,
+		Handle:    msg,
+	}, nil
+}
+
+// Commit commits the offsets of the given messages for the consumer group
+func (c *Consumer) Commit(ctx context.Context, msgs ...*transport.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	kmsgs := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		km, ok := m.Handle.(kafka.Message)
+		if !ok {
+			return fmt.Errorf("message %s was not fetched from kafka", m.ID)
+		}
+		kmsgs = append(kmsgs, km)
+	}
+	return c.r.CommitMessages(ctx, kmsgs...)
+}
+
+// DeadLetter publishes the message to the dead-letter topic, recording the reason in a header
+func (c *Consumer) DeadLetter(ctx context.Context, m *transport.Message, reason error) error {
+	if c.dlq == nil {
+		return transport.ErrNoDeadLetter
+	}
+	return c.dlq.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(m.ID),
+		Value:   m.Data,
+		Headers: []kafka.Header{{Key: headerError, Value: []byte(reason.Error())}},
+	})
+}
+
+// Close closes the underlying kafka reader and dead-letter writer
+func (c *Consumer) Close() error {
+	if c.dlq != nil {
+		err := c.dlq.Close()
+		if err != nil {
+			logger.Errorf("Error closing dead-letter writer: %v", err)
+		}
+	}
+	return c.r.Close()
+}
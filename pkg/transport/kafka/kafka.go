@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+const (
+	moduleName = "kafka-transport"
+
+	// Name is the name the kafka transport is registered under
+	Name = "kafka"
+
+	// OptBroker is the kafka broker to connect to
+	OptBroker = "broker"
+	// OptTopic is the topic events are published to and consumed from
+	OptTopic = "topic"
+	// OptGroupID is the consumer group aggregators join
+	OptGroupID = "groupID"
+	// OptStartOffset is where a consumer group starts reading
+	OptStartOffset = "startOffset"
+	// OptDeadLetterTopic is the topic consumers move messages to that cannot be processed
+	OptDeadLetterTopic = "deadLetterTopic"
+
+	// DefaultGroupID is the consumer group aggregators join unless configured otherwise
+	DefaultGroupID = "pleiades-aggregator-group"
+)
+
+var (
+	logger      = log.MustGetLogger(moduleName)
+	kafkaLogger = log.MustGetLogger("kafka-client")
+)
+
+func init() {
+	transport.Register(&transport.Backend{
+		Name: Name,
+		Options: []transport.Option{
+			{Name: OptBroker, Default: "localhost:9092", Usage: "the kafka broker to connect to"},
+			{Name: OptTopic, Default: "pleiades-events", Usage: "the kafka topic to publish to"},
+			{Name: OptGroupID, Default: DefaultGroupID, Usage: "the consumer group to aggregate events as"},
+			{Name: OptStartOffset, Default: "", Usage: "where a new consumer group starts reading: earliest, latest, an RFC3339 timestamp or partition:offset pairs (existing groups are moved with reset-offsets)"},
+			{Name: OptDeadLetterTopic, Default: "", Usage: "the kafka topic to move events to that cannot be aggregated (disabled if empty)"},
+		},
+		NewProducer: func(opts transport.Opts) (transport.Producer, error) {
+			return NewProducer(opts)
+		},
+		NewConsumer: func(opts transport.Opts) (transport.Consumer, error) {
+			return NewConsumer(opts)
+		},
+		NewReplayer: func(opts transport.Opts) (transport.Replayer, error) {
+			return NewReplayer(opts)
+		},
+	})
+}
+
+func connectionOpts(opts transport.Opts) (*ConnectionOpts, error) {
+	broker := opts[OptBroker]
+	topic := opts[OptTopic]
+	if (broker == "") || (topic == "") {
+		return nil, ErrNoBroker
+	}
+	return &ConnectionOpts{
+		Brokers: []string{broker},
+		Topic:   topic,
+	}, nil
+}
@@ -8,8 +8,8 @@ import (
 	"github.com/op/go-logging"
 )
 
-func TestKafkaPublisher(t *testing.T) {
+func TestKafkaTransport(t *testing.T) {
 	logging.InitForTesting(logging.CRITICAL)
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "Kafka Publisher Suite")
+	RunSpecs(t, "Kafka Transport Suite")
 }
@@ -0,0 +1,183 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// ParseStartPosition parses a start position given as "earliest", "latest", an RFC3339 timestamp
+// or a comma-separated list of partition:offset pairs. An empty string yields a nil position.
+func ParseStartPosition(s string) (*StartPosition, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "earliest":
+		return &StartPosition{Offset: kafka.FirstOffset}, nil
+	case "latest":
+		return &StartPosition{Offset: kafka.LastOffset}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &StartPosition{Time: t}, nil
+	}
+	offsets := make(map[int]int64)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidStartPosition, s)
+		}
+		p, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidStartPosition, s)
+		}
+		o, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidStartPosition, s)
+		}
+		offsets[p] = o
+	}
+	return &StartPosition{Offsets: offsets}, nil
+}
+
+// relative reports whether the position refers to the ends of the partitions rather than specific offsets
+func (p *StartPosition) relative() bool {
+	return p.Offsets == nil && p.Time.IsZero()
+}
+
+// PartitionName returns the name a partition is identified by in Messages read by the consumer group
+func PartitionName(group string, topic string, partition int) string {
+	return fmt.Sprintf("%s/%s/%d", group, topic, partition)
+}
+
+// ResolveOffsets returns the offset each partition of the topic is at for the given position
+// Explicit offsets are returned as they are, for the partitions they name.
+func ResolveOffsets(ctx context.Context, o *ConnectionOpts, pos *StartPosition) (map[int]int64, error) {
+	if pos.Offsets != nil {
+		return pos.Offsets, nil
+	}
+	conn, err := kafka.Dial("tcp", o.Brokers[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to kafka: %v", err)
+	}
+	partitions, err := conn.ReadPartitions(o.Topic)
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partitions of topic %s: %v", o.Topic, err)
+	}
+
+	offsets := make(map[int]int64)
+	for _, p := range partitions {
+		if p.Topic != o.Topic {
+			continue
+		}
+		offset, err := partitionOffset(ctx, o, p.ID, pos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offset of partition %d: %v", p.ID, err)
+		}
+		offsets[p.ID] = offset
+	}
+	return offsets, nil
+}
+
+func partitionOffset(ctx context.Context, o *ConnectionOpts, partition int, pos *StartPosition) (int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", o.Brokers[0], o.Topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	switch {
+	case !pos.Time.IsZero():
+		return conn.ReadOffset(pos.Time)
+	case pos.Offset == kafka.FirstOffset:
+		return conn.ReadFirstOffset()
+	default:
+		return conn.ReadLastOffset()
+	}
+}
+
+// CommitGroupOffsets commits the given offsets of the topic's partitions for a consumer group
+// Joining the group to commit causes a rebalance, so this is best done while no other members are running.
+func CommitGroupOffsets(ctx context.Context, o *ConnectionOpts, group string, offsets map[int]int64) error {
+	cg, gen, err := joinGroup(ctx, o, group)
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+	return gen.CommitOffsets(map[string]map[int]int64{o.Topic: offsets})
+}
+
+// InitGroupOffsets commits the offsets of pos for the consumer group, unless it has committed offsets already
+// It returns the offsets committed, or nil if the group already had some and was left where it is.
+func InitGroupOffsets(ctx context.Context, o *ConnectionOpts, group string, pos *StartPosition) (map[int]int64, error) {
+	cg, gen, err := joinGroup(ctx, o, group)
+	if err != nil {
+		return nil, err
+	}
+	defer cg.Close()
+	for _, a := range gen.Assignments[o.Topic] {
+		// partitions without a committed offset are assigned the group's start offset, which is negative
+		if a.Offset >= 0 {
+			return nil, nil
+		}
+	}
+	offsets, err := ResolveOffsets(ctx, o, pos)
+	if err != nil {
+		return nil, err
+	}
+	err = gen.CommitOffsets(map[string]map[int]int64{o.Topic: offsets})
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// joinGroup joins the consumer group and returns its first generation, along with the committed offsets it is assigned
+func joinGroup(ctx context.Context, o *ConnectionOpts, group string) (*kafka.ConsumerGroup, *kafka.Generation, error) {
+	cg, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:          group,
+		Brokers:     o.Brokers,
+		Topics:      []string{o.Topic},
+		StartOffset: kafka.FirstOffset,
+		ErrorLogger: &crudErrorLogger{},
+		Logger:      newCrudLogger(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to join consumer group %s: %v", group, err)
+	}
+	gen, err := cg.Next(ctx)
+	if err != nil {
+		cg.Close()
+		return nil, nil, fmt.Errorf("failed to join consumer group %s: %v", group, err)
+	}
+	return cg, gen, nil
+}
+
+// ResetOffsets moves the consumer group configured in opts to the given position and returns the new offsets
+func ResetOffsets(ctx context.Context, opts transport.Opts, pos *StartPosition) (map[int]int64, error) {
+	o, err := connectionOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := ResolveOffsets(ctx, o, pos)
+	if err != nil {
+		return nil, err
+	}
+	err = CommitGroupOffsets(ctx, o, groupID(opts), offsets)
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+func groupID(opts transport.Opts) string {
+	if g := opts[OptGroupID]; g != "" {
+		return g
+	}
+	return DefaultGroupID
+}
@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kafka Start Position", func() {
+
+	It("parses relative positions", func() {
+		pos, err := ParseStartPosition("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pos).To(BeNil())
+
+		pos, err = ParseStartPosition("earliest")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pos.relative()).To(BeTrue())
+		Expect(pos.Offset).Should(Equal(kafka.FirstOffset))
+
+		pos, err = ParseStartPosition("latest")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pos.Offset).Should(Equal(kafka.LastOffset))
+	})
+
+	It("parses timestamps", func() {
+		pos, err := ParseStartPosition("2020-08-10T12:00:00Z")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pos.relative()).To(BeFalse())
+		Expect(pos.Time).Should(Equal(time.Date(2020, 8, 10, 12, 0, 0, 0, time.UTC)))
+	})
+
+	It("parses explicit offsets", func() {
+		pos, err := ParseStartPosition("0:100,3:42")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pos.relative()).To(BeFalse())
+		Expect(pos.Offsets).Should(Equal(map[int]int64{0: 100, 3: 42}))
+	})
+
+	It("rejects anything else", func() {
+		for _, s := range []string{"yesterday", "0:abc", "1:2:3"} {
+			_, err := ParseStartPosition(s)
+			Expect(errors.Is(err, ErrInvalidStartPosition)).To(BeTrue(), s)
+		}
+	})
+
+	It("names partitions by group and topic", func() {
+		Expect(PartitionName("pleiades-aggregator-group", "pleiades-events", 2)).Should(Equal("pleiades-aggregator-group/pleiades-events/2"))
+	})
+})
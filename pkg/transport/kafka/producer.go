@@ -3,25 +3,18 @@ package kafka
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
 
-	"github.com/gargath/pleiades/pkg/ingester/publisher"
-	"github.com/gargath/pleiades/pkg/ingester/sse"
-	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const moduleName = "kafkapublisher"
-
 var (
-	logger      = log.MustGetLogger(moduleName)
-	kafkaLogger = log.MustGetLogger("kafka-client")
-
 	timeStampRegExp = regexp.MustCompile(`"timestamp":([0-9]+).*`)
 
 	pubErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -30,42 +23,87 @@ var (
 	},
 		[]string{"type"},
 	)
+
+	writers = &writerPool{writers: make(map[string]*topicWriter)}
 )
 
-// NewPublisher returns a Publisher initialized with the source channel and kafka destination provided
-func NewPublisher(opts *Opts, src <-chan *sse.Event) (publisher.Publisher, error) {
-	dest := opts.Broker
-	topic := opts.Topic
-	if src == nil {
-		return nil, ErrNilChan
-	}
-	o := &ConnectionOpts{
-		Brokers: []string{dest},
-		Topic:   topic,
+// NewProducer returns a Producer initialized with the kafka destination provided
+// Producers of the same brokers and topic share one writer, and all writers are reported by one collector
+func NewProducer(opts transport.Opts) (*Producer, error) {
+	o, err := connectionOpts(opts)
+	if err != nil {
+		return nil, err
 	}
-	f := &Publisher{
-		source:      src,
+	registerCollector.Do(func() {
+		prometheus.DefaultRegisterer.MustRegister(collector)
+	})
+	f := &Producer{
 		destination: o,
+		w:           writers.open(o),
 	}
+	return f, nil
+}
 
-	f.w = kafka.NewWriter(kafka.WriterConfig{
-		Brokers:      f.destination.Brokers,
-		Topic:        f.destination.Topic,
-		BatchSize:    100,
-		RequiredAcks: 0,
-		Async:        true,
-		Balancer:     kafka.Murmur2Balancer{},
-	})
-	kc := PrometheusCollector{
-		Publisher: f,
+// open returns the writer for the brokers and topic in o, creating it if no Producer holds it yet
+func (p *writerPool) open(o *ConnectionOpts) *topicWriter {
+	key := strings.Join(o.Brokers, ",") + "/" + o.Topic
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w, ok := p.writers[key]
+	if !ok {
+		w = &topicWriter{
+			key:   key,
+			topic: o.Topic,
+			w: kafka.NewWriter(kafka.WriterConfig{
+				Brokers:      o.Brokers,
+				Topic:        o.Topic,
+				BatchSize:    100,
+				RequiredAcks: 0,
+				Async:        true,
+				Balancer:     kafka.Murmur2Balancer{},
+			}),
+		}
+		p.writers[key] = w
 	}
-	prometheus.DefaultRegisterer.MustRegister(kc)
+	w.refs++
+	return w
+}
 
-	return f, nil
+// release closes w once the last Producer holding it is closed
+func (p *writerPool) release(w *topicWriter) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.refs--
+	if w.refs > 0 {
+		return nil
+	}
+	delete(p.writers, w.key)
+	err := w.w.Close()
+	// Stats are reset on every read, so record what was written since the last scrape
+	w.record()
+	return err
 }
 
-// ValidateConnection tests the connection to Kafka using the details given when creating the Publisher
-func (f *Publisher) ValidateConnection() error {
+// all returns the writers currently open
+func (p *writerPool) all() []*topicWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ws := make([]*topicWriter, 0, len(p.writers))
+	for _, w := range p.writers {
+		ws = append(ws, w)
+	}
+	return ws
+}
+
+// lastID returns the ID of the latest message published through w
+func (w *topicWriter) lastID() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.currMsgID
+}
+
+// ValidateConnection tests the connection to Kafka using the details given when creating the Producer
+func (f *Producer) ValidateConnection() error {
 	logger.Debug("Testing kafka connection")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -86,51 +124,31 @@ func (f *Publisher) ValidateConnection() error {
 	return nil
 }
 
-// ReadAndPublish will read Events from the input channel and write them to the kafka topic
-// configured for this Publisher.
-//
-// Calling ReadAndPublish() will reset the processed message counter of the underlying Publisher and
-// returns the value of the counter when the Publisher's source channel is closed
-func (f *Publisher) ReadAndPublish() (int64, error) {
-
-	logger.Debug("Kafka publisher starting to process events")
-	f.msgCount = 0
-	for e := range f.source {
-		f.msgCount++
-		if e != nil {
-			err := f.ProcessEvent(e)
-			if err != nil {
-				return f.msgCount, fmt.Errorf("error processing event: %v", err)
-			}
-		}
-	}
-	logger.Debug("Kafka publisher stopped")
-	return f.msgCount, nil
-}
-
-// ProcessEvent writes a single event to a kafka
-func (f *Publisher) ProcessEvent(e *sse.Event) error {
-	d, err := ioutil.ReadAll(e.GetData())
-	if err != nil {
-		pubErrors.WithLabelValues("event_data_read").Inc()
-		return fmt.Errorf("error reading event data: %v", err)
-	}
+// Publish writes a single Message to kafka, keyed by its event ID
+func (f *Producer) Publish(m *transport.Message) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err = f.w.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(e.ID),
-		Value: d,
+	err := f.w.w.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(m.ID),
+		Value: m.Data,
 	})
 	if err != nil {
 		pubErrors.WithLabelValues("write").Inc()
 		return fmt.Errorf("error writing to kafka: %v", err)
 	}
-	f.currMsgID = e.ID
+	f.w.mu.Lock()
+	f.w.currMsgID = m.ID
+	f.w.mu.Unlock()
 	return nil
 }
 
+// Close flushes pending writes and closes the underlying kafka writer unless another Producer still uses it
+func (f *Producer) Close() error {
+	return writers.release(f.w)
+}
+
 // GetResumeID will try to get the latest message published to Kafka and extract a resume ID from it
-func (f *Publisher) GetResumeID() string {
+func (f *Producer) GetResumeID() string {
 	logger.Infof("Trying to retrieve resumable event ID from kafka")
 	co1, cancel1 := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel1()
@@ -153,8 +171,7 @@ func (f *Publisher) GetResumeID() string {
 	}
 	return string(latest.Key)
 }
-
-func (f *Publisher) findLatestMessage(partitions []kafka.Partition) (*kafka.Message, error) {
+func (f *Producer) findLatestMessage(partitions []kafka.Partition) (*kafka.Message, error) {
 	for _, p := range partitions {
 		logger.Debugf("Scanning t partition for latest messages: %+v", p)
 	}
@@ -210,7 +227,7 @@ func (f *Publisher) findLatestMessage(partitions []kafka.Partition) (*kafka.Mess
 	return latest, nil
 }
 
-func (f *Publisher) getLatestMessageForPartition(ctx context.Context, p kafka.Partition, m chan<- (*kafka.Message), e chan<- (error)) {
+func (f *Producer) getLatestMessageForPartition(ctx context.Context, p kafka.Partition, m chan<- (*kafka.Message), e chan<- (error)) {
 	c, err := kafka.DialLeader(ctx, "tcp", f.destination.Brokers[0], f.destination.Topic, p.ID)
 	if err != nil {
 		e <- fmt.Errorf("Error connecting to leader for partition %d: %v", p.ID, err)
@@ -0,0 +1,133 @@
+package kafka
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pleiades_kafka_publish_events_total",
+		Help: "The total number of messages published to kafka",
+	},
+		[]string{"topic"},
+	)
+
+	writes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pleiades_kafka_publish_writes_total",
+		Help: "The total number of writes performed to kafka",
+	},
+		[]string{"topic"},
+	)
+
+	writeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pleiades_kafka_writer_errors_total",
+		Help: "Total numbers of errors encountered while publishing to kafka",
+	},
+		[]string{"topic"},
+	)
+
+	kafkaWriteTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pleiades_kafka_publish_write_time_seconds",
+		Help: "Time the kafka writer spent writing",
+	},
+		[]string{"topic", "agg"},
+	)
+
+	kafkaWaitTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pleiades_kafka_publish_wait_time_seconds",
+		Help: "Time the kafka writer spent waiting",
+	},
+		[]string{"topic", "agg"},
+	)
+
+	kafkaLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pleiades_kafka_publish_lag_milliseconds",
+		Help: "Time delay between publish time and timestamp of latest event",
+	},
+		[]string{"topic"},
+	)
+
+	// collector is registered once and reports the writers of all open Producers
+	collector         = &PrometheusCollector{writers: writers}
+	registerCollector sync.Once
+)
+
+// PrometheusCollector reports stats from the kafka writers in a pool to Prometheus, labelled by topic
+type PrometheusCollector struct {
+	writers *writerPool
+}
+
+// Describe implements the Collector's Describe method
+func (k *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	messages.Describe(ch)
+	writes.Describe(ch)
+	writeErrors.Describe(ch)
+	kafkaWriteTime.Describe(ch)
+	kafkaWaitTime.Describe(ch)
+	kafkaLag.Describe(ch)
+}
+
+// Collect implements the Collector's Collect method
+func (k *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, w := range k.writers.all() {
+		w.record()
+	}
+	messages.Collect(ch)
+	writes.Collect(ch)
+	writeErrors.Collect(ch)
+	kafkaWriteTime.Collect(ch)
+	kafkaWaitTime.Collect(ch)
+	kafkaLag.Collect(ch)
+}
+
+// record adds the writer's stats since the last call to the metrics of its topic
+func (w *topicWriter) record() {
+	stats := w.w.Stats()
+	topic := w.topic
+
+	messages.WithLabelValues(topic).Add(float64(stats.Messages))
+	writes.WithLabelValues(topic).Add(float64(stats.Writes))
+	writeErrors.WithLabelValues(topic).Add(float64(stats.Errors))
+
+	kafkaWriteTime.WithLabelValues(topic, "min").Set(stats.WriteTime.Min.Seconds())
+	kafkaWriteTime.WithLabelValues(topic, "max").Set(stats.WriteTime.Max.Seconds())
+	kafkaWriteTime.WithLabelValues(topic, "avg").Set(stats.WriteTime.Avg.Seconds())
+
+	kafkaWaitTime.WithLabelValues(topic, "min").Set(stats.WaitTime.Min.Seconds())
+	kafkaWaitTime.WithLabelValues(topic, "max").Set(stats.WaitTime.Max.Seconds())
+	kafkaWaitTime.WithLabelValues(topic, "avg").Set(stats.WaitTime.Avg.Seconds())
+
+	id := w.lastID()
+	if id == "" {
+		return
+	}
+
+	now := time.Now().UnixNano() / 1000000
+	msgTimestamp, err := tStampFromID(id)
+	logger.Debugf("Time now is %d, last Timestamp was %d, lag is thus %d ms", now, msgTimestamp, now-msgTimestamp)
+	if err != nil {
+		// Not every message published is an event, e.g. hot pages are keyed by page
+		logger.Debugf("No timestamp in message ID %s: %v", id, err)
+		return
+	}
+	kafkaLag.WithLabelValues(topic).Set(float64(now - msgTimestamp))
+}
+
+func tStampFromID(id string) (int64, error) {
+	tokens := strings.SplitAfter(id, "timestamp\":")
+	if len(tokens) < 2 {
+		return 0, fmt.Errorf("'timestamp' string not found")
+	}
+	stampString := strings.Split(tokens[1], "}")[0]
+	stamp, err := strconv.ParseInt(stampString, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return stamp, nil
+}
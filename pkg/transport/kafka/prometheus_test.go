@@ -1,7 +1,7 @@
 package kafka
 
 import (
-	"github.com/gargath/pleiades/pkg/ingester/sse"
+	"github.com/gargath/pleiades/pkg/transport"
 	. "github.com/onsi/ginkgo"
 
 	. "github.com/onsi/gomega"
@@ -11,23 +11,19 @@ import (
 var _ = Describe("Kafka Client Prometheus Collector", func() {
 
 	It("assembles metrics", func() {
-		ch := make(chan (*sse.Event))
-		defer close(ch)
 		broker := "foo"
 		topic := "bar"
 
-		pub, err := NewPublisher(&Opts{
-			Broker: broker,
-			Topic:  topic,
-		},
-			ch)
+		p, err := NewProducer(transport.Opts{
+			OptBroker: broker,
+			OptTopic:  topic,
+		})
 		Expect(err).NotTo(HaveOccurred())
-		p := pub.(*Publisher)
 		Expect(p.destination.Topic).Should(Equal(topic))
 		Expect(p.destination.Brokers).Should(ContainElement(broker))
 
-		p.currMsgID = `[{"topic":"codfw.mediawiki.recentchange","partition":0,"offset":-1},{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":1596550548001}]`
-		collector := &PrometheusCollector{Publisher: p}
+		p.w.currMsgID = `[{"topic":"codfw.mediawiki.recentchange","partition":0,"offset":-1},{"topic":"eqiad.mediawiki.recentchange","partition":0,"timestamp":1596550548001}]`
+		defer p.Close()
 
 		dscCh := make(chan (*prometheus.Desc), 100)
 		collector.Describe(dscCh)
@@ -37,11 +33,28 @@ var _ = Describe("Kafka Client Prometheus Collector", func() {
 			dscs[d.String()] = true
 		}
 		Expect(len(dscs)).Should(Equal(6))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_events_total", help: "The total number of messages published to kafka", constLabels: {}, variableLabels: []}`))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_writes_total", help: "The total number of writes performed to kafka", constLabels: {}, variableLabels: []}`))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_writer_errors_total", help: "Total numbers of errors encountered while publishing to kafka", constLabels: {}, variableLabels: []}`))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_write_time_seconds", help: "Time the kafka writer spent writing", constLabels: {}, variableLabels: [agg]}`))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_wait_time_seconds", help: "Time the kafka writer spent waiting", constLabels: {}, variableLabels: [agg]}`))
-		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_lag_milliseconds", help: "Time delay between publish time and timestamp of latest event", constLabels: {}, variableLabels: []}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_events_total", help: "The total number of messages published to kafka", constLabels: {}, variableLabels: [topic]}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_writes_total", help: "The total number of writes performed to kafka", constLabels: {}, variableLabels: [topic]}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_writer_errors_total", help: "Total numbers of errors encountered while publishing to kafka", constLabels: {}, variableLabels: [topic]}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_write_time_seconds", help: "Time the kafka writer spent writing", constLabels: {}, variableLabels: [topic agg]}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_wait_time_seconds", help: "Time the kafka writer spent waiting", constLabels: {}, variableLabels: [topic agg]}`))
+		Expect(dscs).Should(HaveKey(`Desc{fqName: "pleiades_kafka_publish_lag_milliseconds", help: "Time delay between publish time and timestamp of latest event", constLabels: {}, variableLabels: [topic]}`))
+	})
+	It("shares one writer between producers of the same topic", func() {
+		events, err := NewProducer(transport.Opts{OptBroker: "foo", OptTopic: "events"})
+		Expect(err).NotTo(HaveOccurred())
+		again, err := NewProducer(transport.Opts{OptBroker: "foo", OptTopic: "events"})
+		Expect(err).NotTo(HaveOccurred())
+		hot, err := NewProducer(transport.Opts{OptBroker: "foo", OptTopic: "hot-pages"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.w).Should(BeIdenticalTo(events.w))
+		Expect(hot.w).ShouldNot(BeIdenticalTo(events.w))
+		Expect(writers.all()).Should(HaveLen(2))
+
+		Expect(events.Close()).To(Succeed())
+		Expect(writers.all()).Should(HaveLen(2))
+		Expect(again.Close()).To(Succeed())
+		Expect(hot.Close()).To(Succeed())
+		Expect(writers.all()).Should(BeEmpty())
 	})
 })
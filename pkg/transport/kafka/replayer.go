@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// NewReplayer returns a Replayer for the kafka source provided
+func NewReplayer(opts transport.Opts) (*Replayer, error) {
+	o, err := connectionOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Replayer{source: o}, nil
+}
+
+// Replay reads each partition of the topic from the first message at or after from up to the first one after to
+// Partitions are read one after the other and up to the last offset at the time Replay is called.
+func (r *Replayer) Replay(ctx context.Context, from time.Time, to time.Time, fn func(m *transport.Message) error) error {
+	start, err := ResolveOffsets(ctx, r.source, &StartPosition{Time: from})
+	if err != nil {
+		return err
+	}
+	end, err := ResolveOffsets(ctx, r.source, &StartPosition{Offset: kafka.LastOffset})
+	if err != nil {
+		return err
+	}
+	for p, offset := range start {
+		logger.Infof("Replaying partition %d of %s from offset %d to %d", p, r.source.Topic, offset, end[p])
+		err := r.replayPartition(ctx, p, offset, end[p], to, fn)
+		if err != nil {
+			return fmt.Errorf("failed to replay partition %d: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) replayPartition(ctx context.Context, partition int, offset int64, end int64, to time.Time, fn func(m *transport.Message) error) error {
+	if offset < 0 || offset >= end {
+		return nil
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     r.source.Brokers,
+		Topic:       r.source.Topic,
+		Partition:   partition,
+		ErrorLogger: &crudErrorLogger{},
+		Logger:      newCrudLogger(),
+	})
+	defer reader.Close()
+	err := reader.SetOffset(offset)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if msg.Time.After(to) {
+			return nil
+		}
+		err = fn(&transport.Message{
+			ID:     string(msg.Key),
+			Data:   msg.Value,
+			Handle: msg,
+		})
+		if err != nil {
+			return err
+		}
+		if msg.Offset >= end-1 {
+			return nil
+		}
+	}
+}
+
+// Close is a no-op, readers are closed after each partition has been replayed
+func (r *Replayer) Close() error {
+	return nil
+}
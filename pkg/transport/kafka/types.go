@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// Producer writes Messages to a kafka topic
+type Producer struct {
+	destination *ConnectionOpts
+	w           *topicWriter
+}
+
+// topicWriter is a kafka writer shared by all open Producers of the same brokers and topic
+type topicWriter struct {
+	key   string
+	topic string
+	w     *kafka.Writer
+	refs  int
+
+	mu        sync.Mutex
+	currMsgID string
+}
+
+// writerPool holds the topicWriters of all open Producers
+type writerPool struct {
+	mu      sync.Mutex
+	writers map[string]*topicWriter
+}
+
+// Consumer reads Messages from a kafka topic as part of a consumer group
+type Consumer struct {
+	source *ConnectionOpts
+	group  string
+	r      *kafka.Reader
+	dlq    *kafka.Writer
+}
+
+// Replayer reads Messages from every partition of a kafka topic without joining a consumer group
+type Replayer struct {
+	source *ConnectionOpts
+}
+
+// ConnectionOpts wrap the information needed to connect to kafka
+type ConnectionOpts struct {
+	Brokers []string
+	Topic   string
+}
+
+// StartPosition is where a consumer group starts reading its topic
+type StartPosition struct {
+	// Offset is kafka.FirstOffset or kafka.LastOffset if neither Time nor Offsets are set
+	Offset int64
+	// Time starts each partition at its first message at or after this time
+	Time time.Time
+	// Offsets start each partition listed at an explicit offset
+	Offsets map[int]int64
+}
+
+// ErrNoBroker is returned when a Producer or Consumer is created without kafka connection details
+var ErrNoBroker error = fmt.Errorf("No kafka broker or topic provided")
+
+// ErrInvalidStartPosition is returned when a start position cannot be parsed
+var ErrInvalidStartPosition error = fmt.Errorf("Invalid start position, expected earliest, latest, an RFC3339 timestamp or partition:offset pairs")
@@ -0,0 +1,168 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/gargath/pleiades/pkg/log"
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+const (
+	moduleName = "memory-transport"
+
+	// Name is the name the in-memory transport is registered under
+	Name = "memory"
+
+	// OptChannel is the name of the in-process channel to use
+	OptChannel = "channel"
+	// OptBuffer is the number of Messages the channel can hold before publishing blocks
+	OptBuffer = "buffer"
+)
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	mu       sync.Mutex
+	channels = make(map[string]*channel)
+)
+
+func init() {
+	transport.Register(&transport.Backend{
+		Name: Name,
+		Options: []transport.Option{
+			{Name: OptChannel, Default: "pleiades-events", Usage: "the name of the in-process channel to pass events through"},
+			{Name: OptBuffer, Default: "10000", Usage: "the number of events the in-process channel buffers"},
+		},
+		NewProducer: func(opts transport.Opts) (transport.Producer, error) {
+			return NewProducer(opts)
+		},
+		NewConsumer: func(opts transport.Opts) (transport.Consumer, error) {
+			return NewConsumer(opts)
+		},
+	})
+}
+
+// getChannel returns the channel of the given name, creating it if necessary, and counts consumers using it
+// The buffer size of a channel is fixed by whichever Producer or Consumer asks for it first
+func getChannel(opts transport.Opts, consumer bool) (*channel, error) {
+	name := opts[OptChannel]
+	if name == "" {
+		return nil, fmt.Errorf("no channel name provided")
+	}
+	size, err := strconv.Atoi(opts[OptBuffer])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid buffer size %s", opts[OptBuffer])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	ch, ok := channels[name]
+	if !ok {
+		logger.Debugf("Creating in-memory channel %s with buffer size %d", name, size)
+		ch = &channel{
+			name:  name,
+			queue: make(chan *transport.Message, size),
+			done:  make(chan struct{}),
+		}
+		channels[name] = ch
+	}
+	if consumer {
+		ch.consumers++
+	}
+	return ch, nil
+}
+
+// NewProducer returns a Producer for the channel named in opts
+func NewProducer(opts transport.Opts) (*Producer, error) {
+	ch, err := getChannel(opts, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{ch: ch, done: make(chan struct{})}, nil
+}
+
+// Publish places a Message on the channel, blocking while the channel is full
+// It fails with ErrClosed once the Producer is closed, or all Consumers of the channel are, instead of blocking forever.
+func (p *Producer) Publish(m *transport.Message) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("%w: %s", ErrClosed, p.ch.name)
+	default:
+	}
+	select {
+	case p.ch.queue <- m:
+	case <-p.done:
+		return fmt.Errorf("%w: %s", ErrClosed, p.ch.name)
+	case <-p.ch.done:
+		return fmt.Errorf("%w: %s has no consumers left", ErrClosed, p.ch.name)
+	}
+	p.ch.mu.Lock()
+	p.ch.lastID = m.ID
+	p.ch.mu.Unlock()
+	return nil
+}
+
+// GetResumeID returns the ID of the last Message published to the channel by this process
+func (p *Producer) GetResumeID() string {
+	p.ch.mu.RLock()
+	defer p.ch.mu.RUnlock()
+	return p.ch.lastID
+}
+
+// ValidateConnection always returns nil and only serves to satisfy the Producer interface
+func (p *Producer) ValidateConnection() error {
+	return nil
+}
+
+// Close stops the Producer from publishing and unblocks a pending Publish
+// The channel stays open for Consumers to drain.
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+// NewConsumer returns a Consumer for the channel named in opts
+func NewConsumer(opts transport.Opts) (*Consumer, error) {
+	ch, err := getChannel(opts, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{ch: ch}, nil
+}
+
+// Fetch returns the next Message on the channel, blocking until one arrives or the context expires
+func (c *Consumer) Fetch(ctx context.Context) (*transport.Message, error) {
+	select {
+	case m := <-c.ch.queue:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Commit is a no-op, Messages are removed from the channel as soon as they are fetched
+func (c *Consumer) Commit(ctx context.Context, msgs ...*transport.Message) error {
+	return nil
+}
+
+// Close releases the Consumer, closing the channel to Producers once no Consumers are left
+// A new Consumer of the same name gets a new channel.
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		c.ch.consumers--
+		if c.ch.consumers > 0 {
+			return
+		}
+		close(c.ch.done)
+		if channels[c.ch.name] == c.ch {
+			delete(channels, c.ch.name)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,15 @@
+package memory
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/op/go-logging"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Memory Transport Suite")
+}
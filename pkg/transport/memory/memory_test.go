@@ -0,0 +1,87 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/transport"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory Transport", func() {
+
+	It("passes messages from producer to consumer", func() {
+		opts := transport.Opts{OptChannel: "test-pass", OptBuffer: "10"}
+		p, err := NewProducer(opts)
+		Expect(err).NotTo(HaveOccurred())
+		c, err := NewConsumer(opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(p.Publish(&transport.Message{ID: "1", Data: []byte("foo")})).To(Succeed())
+		Expect(p.Publish(&transport.Message{ID: "2", Data: []byte("bar")})).To(Succeed())
+		Expect(p.GetResumeID()).Should(Equal("2"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m, err := c.Fetch(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.ID).Should(Equal("1"))
+		m, err = c.Fetch(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(m.Data)).Should(Equal("bar"))
+	})
+
+	It("keeps channels of different names apart", func() {
+		p, _ := NewProducer(transport.Opts{OptChannel: "test-a", OptBuffer: "10"})
+		c, _ := NewConsumer(transport.Opts{OptChannel: "test-b", OptBuffer: "10"})
+		Expect(p.Publish(&transport.Message{ID: "1"})).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := c.Fetch(ctx)
+		Expect(err).Should(Equal(context.DeadlineExceeded))
+	})
+
+	It("rejects invalid buffer sizes", func() {
+		_, err := NewProducer(transport.Opts{OptChannel: "test-invalid", OptBuffer: "lots"})
+		Expect(err).To(HaveOccurred())
+	})
+	It("fails to publish once the producer is closed", func() {
+		p, err := NewProducer(transport.Opts{OptChannel: "test-closed", OptBuffer: "10"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Close()).To(Succeed())
+		Expect(p.Close()).To(Succeed())
+		err = p.Publish(&transport.Message{ID: "1"})
+		Expect(errors.Is(err, ErrClosed)).To(BeTrue())
+	})
+
+	It("stops blocking on a full channel once its consumers are closed", func() {
+		opts := transport.Opts{OptChannel: "test-full", OptBuffer: "1"}
+		p, err := NewProducer(opts)
+		Expect(err).NotTo(HaveOccurred())
+		c, err := NewConsumer(opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Publish(&transport.Message{ID: "1"})).To(Succeed())
+
+		errs := make(chan error)
+		go func() {
+			errs <- p.Publish(&transport.Message{ID: "2"})
+		}()
+		select {
+		case err = <-errs:
+			Fail(fmt.Sprintf("publishing to a full channel returned early: %v", err))
+		case <-time.After(10 * time.Millisecond):
+		}
+		Expect(c.Close()).To(Succeed())
+		select {
+		case err = <-errs:
+			Expect(errors.Is(err, ErrClosed)).To(BeTrue())
+		case <-time.After(time.Second):
+			Fail("publishing to a full channel kept blocking after its consumer was closed")
+		}
+	})
+})
@@ -0,0 +1,35 @@
+package memory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gargath/pleiades/pkg/transport"
+)
+
+// Producer sends Messages to an in-process channel
+type Producer struct {
+	ch        *channel
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Consumer receives Messages from an in-process channel
+type Consumer struct {
+	ch        *channel
+	closeOnce sync.Once
+}
+
+// channel is a named, buffered queue shared by all Producers and Consumers of the same name
+// Once the last of its Consumers is closed, done is closed as nothing drains the queue anymore.
+type channel struct {
+	name      string
+	queue     chan *transport.Message
+	mu        sync.RWMutex
+	lastID    string
+	consumers int
+	done      chan struct{}
+}
+
+// ErrClosed is returned when publishing to a channel whose Producer or Consumers have been closed
+var ErrClosed = fmt.Errorf("In-memory channel closed")
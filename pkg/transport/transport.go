@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gargath/pleiades/pkg/log"
+)
+
+const moduleName = "transport"
+
+var (
+	logger = log.MustGetLogger(moduleName)
+
+	mu       sync.RWMutex
+	backends = make(map[string]*Backend)
+)
+
+// Register makes a transport backend available by name
+// It is intended to be called from the init function of the backend package and panics if the name is already taken
+func Register(b *Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := backends[b.Name]; dup {
+		panic(fmt.Sprintf("transport backend %s registered twice", b.Name))
+	}
+	backends[b.Name] = b
+}
+
+// Lookup returns the transport backend registered under the given name
+func Lookup(name string) (*Backend, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, name)
+	}
+	return b, nil
+}
+
+// Backends returns all registered transport backends, sorted by name
+func Backends() []*Backend {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Names returns the names of all registered transport backends, sorted
+func Names() []string {
+	var out []string
+	for _, b := range Backends() {
+		out = append(out, b.Name)
+	}
+	return out
+}
+
+// NewProducer creates a Producer for the named backend
+// Options not present in opts are set to the defaults declared by the backend
+func NewProducer(name string, opts Opts) (Producer, error) {
+	b, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.NewProducer == nil {
+		return nil, fmt.Errorf("transport backend %s does not support producing", name)
+	}
+	logger.Debugf("Creating %s producer", name)
+	return b.NewProducer(b.withDefaults(opts))
+}
+
+// NewConsumer creates a Consumer for the named backend
+// Options not present in opts are set to the defaults declared by the backend
+func NewConsumer(name string, opts Opts) (Consumer, error) {
+	b, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.NewConsumer == nil {
+		return nil, fmt.Errorf("transport backend %s does not support consuming", name)
+	}
+	logger.Debugf("Creating %s consumer", name)
+	return b.NewConsumer(b.withDefaults(opts))
+}
+
+// NewReplayer creates a Replayer for the named backend
+// Options not present in opts are set to the defaults declared by the backend
+func NewReplayer(name string, opts Opts) (Replayer, error) {
+	b, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.NewReplayer == nil {
+		return nil, fmt.Errorf("transport backend %s does not support replaying", name)
+	}
+	logger.Debugf("Creating %s replayer", name)
+	return b.NewReplayer(b.withDefaults(opts))
+}
+
+func (b *Backend) withDefaults(opts Opts) Opts {
+	out := make(Opts)
+	for _, o := range b.Options {
+		out[o.Name] = o.Default
+	}
+	for k, v := range opts {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,15 @@
+package transport
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/op/go-logging"
+)
+
+func TestTransport(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Transport Suite")
+}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport Registry", func() {
+
+	var received Opts
+	Register(&Backend{
+		Name: "test",
+		Options: []Option{
+			{Name: "foo", Default: "bar"},
+			{Name: "baz", Default: "qux"},
+		},
+		NewConsumer: func(opts Opts) (Consumer, error) {
+			received = opts
+			return nil, nil
+		},
+	})
+
+	It("applies option defaults", func() {
+		_, err := NewConsumer("test", Opts{"foo": "override"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(received).Should(Equal(Opts{"foo": "override", "baz": "qux"}))
+	})
+
+	It("rejects unknown backends", func() {
+		_, err := NewConsumer("nope", nil)
+		Expect(errors.Is(err, ErrUnknownBackend)).Should(BeTrue())
+	})
+
+	It("rejects unsupported directions", func() {
+		_, err := NewProducer("test", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("lists registered backends", func() {
+		Expect(Names()).Should(ContainElement("test"))
+	})
+})
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Message is a single event travelling through a transport
+type Message struct {
+	// ID is the upstream event ID
+	ID string
+	// Data is the raw event payload
+	Data []byte
+	// Partition identifies the ordered log the Message was read from, if the backend has one
+	Partition string
+	// Offset is the position of the Message within its Partition
+	Offset int64
+	// Handle is opaque, backend-specific state the originating Consumer uses to commit the Message
+	Handle interface{}
+}
+
+// Producer publishes Messages to a transport backend
+type Producer interface {
+	// Publish sends a single Message
+	Publish(m *Message) error
+	// GetResumeID returns the ID of the last Message published, if it can be determined
+	GetResumeID() string
+	// ValidateConnection checks that the backend is reachable
+	ValidateConnection() error
+	// Close flushes any buffered Messages and releases resources held by the Producer
+	Close() error
+}
+
+// Consumer reads Messages from a transport backend
+//
+// Every Message returned by Fetch must be passed to Commit once it has been fully processed.
+// Until then, the backend is free to deliver it again, e.g. after a restart.
+type Consumer interface {
+	// Fetch blocks until the next Message is available or the context expires
+	Fetch(ctx context.Context) (*Message, error)
+	// Commit acknowledges that the given Messages have been processed and need not be delivered again
+	Commit(ctx context.Context, msgs ...*Message) error
+	// Close releases resources held by the Consumer
+	Close() error
+}
+
+// Replayer reads historic Messages from a transport backend without affecting its Consumers
+type Replayer interface {
+	// Replay calls fn for every retained Message published between from and to, and possibly some published around them
+	// It stops at the first error returned by fn.
+	Replay(ctx context.Context, from time.Time, to time.Time, fn func(m *Message) error) error
+	// Close releases resources held by the Replayer
+	Close() error
+}
+
+// DeadLetterer is implemented by Consumers that can set aside Messages which will never be processed successfully
+// A dead-lettered Message must still be passed to Commit.
+type DeadLetterer interface {
+	// DeadLetter stores the Message together with the reason it could not be processed
+	DeadLetter(ctx context.Context, m *Message, reason error) error
+}
+
+// Option describes a single configuration value understood by a transport backend
+type Option struct {
+	Name    string
+	Default string
+	Usage   string
+}
+
+// Opts hold configuration values for a transport backend, keyed by Option name
+type Opts map[string]string
+
+// Backend is a transport implementation that can be selected by name
+type Backend struct {
+	Name        string
+	Options     []Option
+	NewProducer func(opts Opts) (Producer, error)
+	NewConsumer func(opts Opts) (Consumer, error)
+	// NewReplayer is nil for backends that do not retain Messages once consumed
+	NewReplayer func(opts Opts) (Replayer, error)
+}
+
+// ErrUnknownBackend is returned when a transport is requested that has not been registered
+var ErrUnknownBackend = fmt.Errorf("Unknown transport backend")
+
+// ErrNoDeadLetter is returned by a DeadLetterer that has not been configured with a destination
+var ErrNoDeadLetter = fmt.Errorf("No dead-letter destination configured")
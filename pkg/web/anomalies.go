@@ -0,0 +1,65 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+)
+
+// anomaliesHandler serves the anomalies the aggregator currently sees in event rates, most severe first
+// The kind query parameter restricts the anomalies returned to spikes, drops or stalls.
+func (f *Frontend) anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	anomalies, err := f.getAnomalies(ctx, r.URL.Query().Get("kind"))
+	if err != nil {
+		logger.Errorf("Error retrieving Redis anomalies: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, false)
+	out, err := json.Marshal(&Anomalies{Anomalies: anomalies})
+	if err != nil {
+		logger.Errorf("Error marshalling anomalies respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
+
+// getAnomalies returns the active anomalies of the given kind, or of any if empty, by descending absolute score
+func (f *Frontend) getAnomalies(ctx context.Context, kind string) ([]aggregator.Anomaly, error) {
+	hashes, err := f.store.Hashes(ctx, []string{aggregator.AnomaliesKey})
+	if err != nil {
+		return nil, err
+	}
+	fields := hashes[0]
+	out := make([]aggregator.Anomaly, 0, len(fields))
+	for series, data := range fields {
+		var a aggregator.Anomaly
+		err = json.Unmarshal([]byte(data), &a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid anomaly of %s: %v", series, err)
+		}
+		if kind == "" || a.Kind == kind {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if math.Abs(out[i].Score) != math.Abs(out[j].Score) {
+			return math.Abs(out[i].Score) > math.Abs(out[j].Score)
+		}
+		return out[i].Series < out[j].Series
+	})
+	return out, nil
+}
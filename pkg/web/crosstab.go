@@ -0,0 +1,138 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gorilla/mux"
+)
+
+// crosstabParams are the query parameters of the cross-tab API that do not filter by a dimension
+var crosstabParams = map[string]bool{"day": true, "tz": true, "by": true}
+
+// crosstabHandler serves a cross-tab of the day selected by the day query parameter
+// The by query parameter lists the dimensions to break the counts down by, all others are rolled up.
+// Any other query parameter restricts the counts to events with the given value of the dimension of that name.
+func (f *Frontend) crosstabHandler(w http.ResponseWriter, r *http.Request) {
+	b, status := dayFromRequest(r)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	q := r.URL.Query()
+	var by []string
+	if q.Get("by") != "" {
+		by = strings.Split(q.Get("by"), ",")
+	}
+	filters := make(map[string]string)
+	for k := range q {
+		if !crosstabParams[k] {
+			filters[k] = q.Get(k)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	hashes, err := f.store.Hashes(ctx, []string{b.Prefix() + aggregator.CrosstabPrefix + mux.Vars(r)["name"]})
+	if err != nil {
+		logger.Errorf("Error retrieving cross-tab: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fields := hashes[0]
+	if len(fields) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ct, err := rollUp(fields, by, filters)
+	if err != nil {
+		logger.Infof("Rejecting invalid cross-tab query: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ct.Since = b.Start().Unix()
+	ct.Finalized, err = f.isFinalized(ctx, b)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized state of %s bucket %d: %v", b.Resolution.Name, b.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, ct.Finalized)
+	out, err := json.Marshal(ct)
+	if err != nil {
+		logger.Errorf("Error marshalling cross-tab respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
+
+// rollUp sums the fields of a cross-tab hash matching all filters by the values of the dimensions in by
+// Rows are sorted by descending count. Dimensions in by or filters that the cross-tab does not have are an error.
+func rollUp(fields map[string]string, by []string, filters map[string]string) (*Crosstab, error) {
+	ct := &Crosstab{Dimensions: by}
+	rows := make(map[string]*CrosstabRow)
+	for field, val := range fields {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count %s in cross-tab field %s", val, field)
+		}
+		if field == aggregator.CrosstabOther {
+			ct.Other += n
+			continue
+		}
+		values := make(map[string]string)
+		for _, part := range strings.Split(field, "|") {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) == 2 {
+				values[kv[0]] = kv[1]
+			}
+		}
+		match := true
+		for k, v := range filters {
+			actual, ok := values[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown dimension %s", k)
+			}
+			match = match && actual == v
+		}
+		if !match {
+			continue
+		}
+		row := make([]string, len(by))
+		for i, d := range by {
+			v, ok := values[d]
+			if !ok {
+				return nil, fmt.Errorf("unknown dimension %s", d)
+			}
+			row[i] = v
+		}
+		key := strings.Join(row, "|")
+		if rows[key] == nil {
+			rows[key] = &CrosstabRow{Values: row}
+		}
+		rows[key].Value += n
+	}
+	ct.Rows = make([]CrosstabRow, 0, len(rows))
+	for _, r := range rows {
+		ct.Rows = append(ct.Rows, *r)
+	}
+	sort.Slice(ct.Rows, func(i, j int) bool {
+		if ct.Rows[i].Value != ct.Rows[j].Value {
+			return ct.Rows[i].Value > ct.Rows[j].Value
+		}
+		return strings.Join(ct.Rows[i].Values, "|") < strings.Join(ct.Rows[j].Values, "|")
+	})
+	return ct, nil
+}
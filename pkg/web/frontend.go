@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/log"
 	"github.com/gargath/pleiades/pkg/util"
 	"github.com/gargath/pleiades/pkg/web/static"
@@ -18,7 +19,7 @@ var (
 	logger = log.MustGetLogger(moduleName)
 )
 
-// Stop stops the frontend webserver
+// Stop stops the frontend webserver and closes its counter store
 func (f *Frontend) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -26,6 +27,10 @@ func (f *Frontend) Stop() {
 	if err != nil {
 		logger.Errorf("Error shutting down: %v", err)
 	}
+	err = f.store.Close()
+	if err != nil {
+		logger.Errorf("Error closing counter store: %v", err)
+	}
 }
 
 // Start starts the server
@@ -35,7 +40,16 @@ func (f *Frontend) Start() error {
 	sr := r.PathPrefix("/api").Subrouter()
 	sr.HandleFunc("/stats", f.statsHandler)
 	sr.HandleFunc("/stats/{day}", f.statsForDayHandler)
+	sr.HandleFunc("/stats/{resolution}/{bucket}", f.statsForBucketHandler)
 	sr.HandleFunc("/days", f.daysHandler)
+	sr.HandleFunc("/buckets/{resolution}", f.bucketsHandler)
+	sr.HandleFunc("/uniques", f.uniquesHandler)
+	sr.HandleFunc("/uniques/{resolution}/{bucket}", f.uniquesForBucketHandler)
+	sr.HandleFunc("/top/{dimension}", f.topHandler)
+	sr.HandleFunc("/crosstab/{name}", f.crosstabHandler)
+	sr.HandleFunc("/histogram/{name}", f.histogramHandler)
+	sr.HandleFunc("/hot-pages", f.hotPagesHandler)
+	sr.HandleFunc("/anomalies", f.anomaliesHandler)
 	//	s.HandleFunc("/stats/{key}", f.singleStatHandler)
 	//	r.HandleFunc("/ws", f.websocketHandler)
 
@@ -52,15 +66,19 @@ func (f *Frontend) Start() error {
 
 // NewFrontend initialized a frontend server
 func NewFrontend(fo *Opts) (*Frontend, error) {
-	r, err := util.NewValidatedRedisClient(fo.Redis)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create frontend: %v", err)
+	store := fo.Store
+	if store == nil {
+		r, err := util.NewValidatedRedisClient(fo.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create frontend: %v", err)
+		}
+		store = aggregator.NewStore(r, 0)
 	}
 
 	s := &Frontend{
 		redis:      fo.Redis,
 		listenAddr: fo.ListenAddr,
+		store:      store,
 	}
-	s.r = r
 	return s, nil
 }
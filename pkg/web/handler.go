@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gargath/pleiades/pkg/bucket"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -32,9 +33,16 @@ func (f *Frontend) daysHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	days, err := f.getDays(ctx)
+	zone, err := bucket.LoadZone(r.URL.Query().Get("tz"))
 	if err != nil {
-		logger.Errorf("Error retrieving available days from Redis keys: %v", err)
+		logger.Infof("Rejecting invalid time zone: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	days, err := f.getDays(ctx, zone)
+	if err != nil {
+		logger.Errorf("Error retrieving available days from the bucket index: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -52,15 +60,120 @@ func (f *Frontend) daysHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(b))
 }
 
+// resolutionFromRequest returns the named resolution, aligned to the time zone given in the tz query parameter
+func resolutionFromRequest(r *http.Request, name string) (*bucket.Resolution, int) {
+	res, err := bucket.Lookup(name)
+	if err != nil {
+		logger.Infof("Rejecting unknown resolution %s", name)
+		return nil, http.StatusNotFound
+	}
+	zone, err := bucket.LoadZone(r.URL.Query().Get("tz"))
+	if err != nil {
+		logger.Infof("Rejecting invalid time zone: %v", err)
+		return nil, http.StatusBadRequest
+	}
+	return res.In(zone), http.StatusOK
+}
+
+// dayFromRequest returns the day selected by the day query parameter, defaulting to the current day
+// The day is aligned to the time zone given in the tz query parameter.
+func dayFromRequest(r *http.Request) (bucket.Bucket, int) {
+	res, status := resolutionFromRequest(r, bucket.Day.Name)
+	if res == nil {
+		return bucket.Bucket{}, status
+	}
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		return res.At(time.Now()), http.StatusOK
+	}
+	b, err := res.ParseBucket(day)
+	if err != nil {
+		logger.Infof("Rejecting invalid day: %v", err)
+		return bucket.Bucket{}, http.StatusBadRequest
+	}
+	return b, http.StatusOK
+}
+
+// maxDays is the longest range of days that can be requested at once
+const maxDays = 366
+
+// daysFromRequest returns the days from the from query parameter up to the to query parameter, inclusive
+// If neither is given, it returns the day selected by dayFromRequest.
+func daysFromRequest(r *http.Request) ([]bucket.Bucket, int) {
+	q := r.URL.Query()
+	if q.Get("from") == "" && q.Get("to") == "" {
+		b, status := dayFromRequest(r)
+		if status != http.StatusOK {
+			return nil, status
+		}
+		return []bucket.Bucket{b}, status
+	}
+	res, status := resolutionFromRequest(r, bucket.Day.Name)
+	if res == nil {
+		return nil, status
+	}
+	from, err := res.ParseBucket(q.Get("from"))
+	if err != nil {
+		logger.Infof("Rejecting invalid day: %v", err)
+		return nil, http.StatusBadRequest
+	}
+	to, err := res.ParseBucket(q.Get("to"))
+	if err != nil {
+		logger.Infof("Rejecting invalid day: %v", err)
+		return nil, http.StatusBadRequest
+	}
+	if to.ID < from.ID || to.ID-from.ID >= maxDays {
+		logger.Infof("Rejecting invalid range of days %d to %d", from.ID, to.ID)
+		return nil, http.StatusBadRequest
+	}
+	var days []bucket.Bucket
+	for id := from.ID; id <= to.ID; id++ {
+		days = append(days, res.Bucket(id))
+	}
+	return days, http.StatusOK
+}
+
 func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
+	res, status := resolutionFromRequest(r, bucket.Day.Name)
+	if res == nil {
+		w.WriteHeader(status)
+		return
+	}
+	f.serveCounters(w, res.At(time.Now()))
+}
+
+func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
+	f.serveBucket(w, r, bucket.Day.Name, mux.Vars(r)["day"])
+}
+
+func (f *Frontend) statsForBucketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	f.serveBucket(w, r, vars["resolution"], vars["bucket"])
+}
+
+// serveBucket serves the counters of a bucket given as an ID, date or timestamp
+func (f *Frontend) serveBucket(w http.ResponseWriter, r *http.Request, resolution string, id string) {
+	res, status := resolutionFromRequest(r, resolution)
+	if res == nil {
+		w.WriteHeader(status)
+		return
+	}
+	b, err := res.ParseBucket(id)
+	if err != nil {
+		logger.Infof("Rejecting invalid bucket: %v", err)
+		w.WriteHeader(http.StatusBadRequest) //TODO: Add an error response that is useful
+		return
+	}
+	f.serveCounters(w, b)
+}
+
+func (f *Frontend) serveCounters(w http.ResponseWriter, bkt bucket.Bucket) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	julianDay := time.Now().Unix() / 86400
-
-	counters, err := f.getAllCounters(ctx, julianDay)
+	counters, err := f.getAllCounters(ctx, bkt)
 	if err != nil {
 		logger.Errorf("Error retrieving Redis stats: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -70,10 +183,22 @@ func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	resp := &Counters{
-		Since:    julianDay * 86400,
-		Counters: counters,
+	finalized, err := f.isFinalized(ctx, bkt)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized state of %s bucket %d: %v", bkt.Resolution.Name, bkt.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	writeCounters(w, &Counters{
+		Since:     bkt.Start().Unix(),
+		Finalized: finalized,
+		Counters:  counters,
+	})
+}
+
+// writeCounters writes a stats response, allowing it to be cached if its counters are finalized
+func writeCounters(w http.ResponseWriter, resp *Counters) {
+	setCacheControl(w, resp.Finalized)
 	b, err := json.Marshal(resp)
 	if err != nil {
 		logger.Errorf("Error marshalling stats respone: %v", err)
@@ -84,38 +209,47 @@ func (f *Frontend) statsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(b))
 }
 
-func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+// setCacheControl allows responses about finalized buckets to be cached indefinitely, and others not at all
+func setCacheControl(w http.ResponseWriter, finalized bool) {
+	if finalized {
+		w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
 
-	julianDay, err := strconv.ParseInt(vars["day"], 10, 64)
-	if err != nil {
-		logger.Infof("Rejecting invalid day format %s: %v", vars["day"], err)
-		w.WriteHeader(http.StatusBadRequest) //TODO: Add an error response that is useful
+func (f *Frontend) bucketsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	res, status := resolutionFromRequest(r, vars["resolution"])
+	if res == nil {
+		w.WriteHeader(status)
 		return
 	}
-
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
 
-	counters, err := f.getAllCounters(ctx, julianDay)
+	ids, err := f.getBuckets(ctx, res)
 	if err != nil {
-		logger.Errorf("Error retrieving Redis stats: %v", err)
+		logger.Errorf("Error retrieving available %s buckets from the bucket index: %v", res.Name, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if counters == nil {
-		w.WriteHeader(http.StatusNotFound)
+	finalized, err := f.getFinalized(ctx, res)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized %s buckets: %v", res.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resp := &Counters{
-		Since:    julianDay * 86400,
-		Counters: counters,
+	out := make([]Bucket, len(ids))
+	for i, id := range ids {
+		b := res.Bucket(id)
+		out[i] = Bucket{ID: id, Since: b.Start().Unix(), Until: b.End().Unix(), Finalized: finalized[id]}
 	}
-	b, err := json.Marshal(resp)
+	b, err := json.Marshal(out)
 	if err != nil {
-		logger.Errorf("Error marshalling stats respone: %v", err)
+		logger.Errorf("Error marshalling buckets respone: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -123,50 +257,57 @@ func (f *Frontend) statsForDayHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(b))
 }
 
-func (f *Frontend) getKeys(ctx context.Context, day int64) ([]string, error) {
-	prefix := fmt.Sprintf("day_%d_pleiades*", day)
-	logger.Debugf("getting counters for prefix %s", prefix)
-	keys, err := f.r.Keys(ctx, prefix).Result()
+// getNames returns the names of the counters in a bucket starting with prefix, sorted, as recorded in the bucket index
+func (f *Frontend) getNames(ctx context.Context, b bucket.Bucket, prefix string) ([]string, error) {
+	names, err := f.store.Names(ctx, b)
 	if err != nil {
 		return nil, err
 	}
-
-	return keys, nil
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if strings.HasPrefix(n, prefix) {
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
 }
 
-func (f *Frontend) getAllCounters(ctx context.Context, julianDay int64) ([]Counter, error) {
+func (f *Frontend) getAllCounters(ctx context.Context, b bucket.Bucket) ([]Counter, error) {
 	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_counters"))
 
-	prefix := fmt.Sprintf("day_%d_", julianDay)
-	keys, err := f.getKeys(ctx, julianDay)
+	names, err := f.getNames(ctx, b, "pleiades")
 	if err != nil {
 		return nil, err
 	}
-	if len(keys) == 0 {
+	if len(names) == 0 {
 		return nil, nil
 	}
-	out := make([]Counter, len(keys))
-	result, error := f.r.MGet(ctx, keys...).Result()
-	if error != nil {
-		return nil, error
+	keys := make([]string, len(names))
+	for i, n := range names {
+		keys[i] = b.Prefix() + n
+	}
+	values, err := f.store.Counters(ctx, keys)
+	if err != nil {
+		return nil, err
 	}
+	out := make([]Counter, 0, len(keys))
 	for i, k := range keys {
-		var val string
-		var ok bool
-		if val, ok = result[i].(string); !ok {
-			return nil, fmt.Errorf("invalid non-string type in Redis counter %s: %v ", k, result[i])
+		val, ok := values[k]
+		if !ok {
+			// indexed, but expired or deleted since
+			continue
 		}
-		parsedVal, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("redis value not parsable as number: %s - %v", val, err)
-		}
-		out[i] = Counter{
-			Name:        strings.SplitAfter(k, prefix)[1],
+		out = append(out, Counter{
+			Name:        names[i],
 			Description: "",
-			Value:       parsedVal,
-		}
+			Value:       val,
+		})
 	}
 	timer.ObserveDuration()
+	if len(out) == 0 {
+		return nil, nil
+	}
 	return out, nil
 }
 
@@ -175,30 +316,43 @@ func (f *Frontend) getCounter(ctx context.Context, name string) (Counter, error)
 	return c, nil
 }
 
-func (f *Frontend) getDays(ctx context.Context) ([]Day, error) {
+// getBuckets returns the IDs of all buckets of a resolution that hold counters, sorted, as recorded in the bucket index
+func (f *Frontend) getBuckets(ctx context.Context, res *bucket.Resolution) ([]int64, error) {
+	return f.store.Buckets(ctx, res)
+}
+
+// isFinalized reports whether the aggregator has marked a bucket as finalized
+func (f *Frontend) isFinalized(ctx context.Context, b bucket.Bucket) (bool, error) {
+	return f.store.IsFinalized(ctx, b)
+}
+
+// allFinalized reports whether all of the given buckets have been marked as finalized
+func (f *Frontend) allFinalized(ctx context.Context, buckets []bucket.Bucket) (bool, error) {
+	for _, b := range buckets {
+		ok, err := f.isFinalized(ctx, b)
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// getFinalized returns the IDs of the finalized buckets of a resolution
+func (f *Frontend) getFinalized(ctx context.Context, res *bucket.Resolution) (map[int64]bool, error) {
+	return f.store.Finalized(ctx, res)
+}
+
+func (f *Frontend) getDays(ctx context.Context, zone *bucket.Zone) ([]Day, error) {
 	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_days"))
 
-	keys, err := f.r.Keys(ctx, "day_*").Result()
+	ids, err := f.getBuckets(ctx, bucket.Day.In(zone))
 	if err != nil {
 		return nil, err
 	}
 
-	uniqueDays := make(map[string]bool)
-	for _, v := range keys {
-		d := strings.Split(v, "_")[1]
-		dNum, _ := strconv.Atoi(d)
-		if dNum > 18488 { // data before this date is spurious because the ingest wasn't running. All we have is events that arrived out of sequence
-			uniqueDays[d] = true
-		}
-	}
-	d := []string{}
-	for k := range uniqueDays {
-		d = append(d, k)
-	}
-	sort.Strings(d)
-	out := make([]Day, len(d))
-	for i, v := range d {
-		out[i] = Day(v)
+	out := []Day{}
+	for _, id := range ids {
+		out = append(out, Day(strconv.FormatInt(id, 10)))
 	}
 	timer.ObserveDuration()
 	return out, nil
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gorilla/mux"
+)
+
+// histogramHandler serves a histogram merged across the days selected by the day, or from and to query parameters
+func (f *Frontend) histogramHandler(w http.ResponseWriter, r *http.Request) {
+	days, status := daysFromRequest(r)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	h, err := f.getHistogram(ctx, days, aggregator.HistogramPrefix+mux.Vars(r)["name"])
+	if err != nil {
+		logger.Errorf("Error retrieving Redis histogram: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if h.Count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.Since = days[0].Start().Unix()
+	h.Finalized, err = f.allFinalized(ctx, days)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized state of %d buckets: %v", len(days), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, h.Finalized)
+	out, err := json.Marshal(h)
+	if err != nil {
+		logger.Errorf("Error marshalling histogram respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
+
+// getHistogram merges the histogram of the given name of each of the buckets and estimates its percentiles
+func (f *Frontend) getHistogram(ctx context.Context, buckets []bucket.Bucket, name string) (*Histogram, error) {
+	keys := make([]string, len(buckets))
+	for i, b := range buckets {
+		keys[i] = b.Prefix() + name
+	}
+	hashes, err := f.store.Hashes(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[float64]int64)
+	for _, fields := range hashes {
+		for le, v := range fields {
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid histogram bin %s: %v", le, err)
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid count %s in histogram bin %s: %v", v, le, err)
+			}
+			counts[bound] += n
+		}
+	}
+	bounds := make([]float64, 0, len(counts))
+	for b := range counts {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+	h := &Histogram{Bins: make([]HistogramBin, len(bounds))}
+	for i, b := range bounds {
+		h.Bins[i] = HistogramBin{Le: aggregator.FormatBound(b), Count: counts[b]}
+		h.Count += counts[b]
+	}
+	h.P50 = percentile(bounds, counts, h.Count, 0.5)
+	h.P90 = percentile(bounds, counts, h.Count, 0.9)
+	h.P99 = percentile(bounds, counts, h.Count, 0.99)
+	return h, nil
+}
+
+// percentile estimates the q-th quantile of a histogram as the upper bound of the bin it falls into
+// Empty bins are not stored, so the lower bound of a bin and thus where in it the quantile lies is unknown.
+// A quantile in the +Inf bin is estimated as the highest finite bound.
+func percentile(bounds []float64, counts map[float64]int64, total int64, q float64) float64 {
+	rank := q * float64(total)
+	var seen int64
+	for i, b := range bounds {
+		seen += counts[b]
+		if float64(seen) < rank {
+			continue
+		}
+		if math.IsInf(b, 1) && i > 0 {
+			return bounds[i-1]
+		}
+		if math.IsInf(b, 1) {
+			return 0
+		}
+		return b
+	}
+	return 0
+}
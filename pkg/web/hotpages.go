@@ -0,0 +1,82 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+)
+
+// hotPagesHandler serves the pages currently flagged as hot or as the subject of an edit war, most recently flagged first
+// The wiki and reason query parameters restrict the pages returned, the limit query parameter their number.
+func (f *Frontend) hotPagesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultTopLimit
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxTopLimit {
+			logger.Infof("Rejecting invalid limit %s", l)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	pages, err := f.getHotPages(ctx, q.Get("wiki"), q.Get("reason"), limit)
+	if err != nil {
+		logger.Errorf("Error retrieving Redis hot pages: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, false)
+	out, err := json.Marshal(&HotPages{Pages: pages})
+	if err != nil {
+		logger.Errorf("Error marshalling hot pages respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
+
+// getHotPages returns up to limit flagged pages of the given wiki and reason, or of any if empty
+func (f *Frontend) getHotPages(ctx context.Context, wiki string, reason string, limit int) ([]aggregator.HotPage, error) {
+	zs, err := f.store.Top(ctx, aggregator.HotPagesKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := f.store.Hashes(ctx, []string{aggregator.HotPagesInfoKey})
+	if err != nil {
+		return nil, err
+	}
+	info := hashes[0]
+	out := make([]aggregator.HotPage, 0, limit)
+	for _, z := range zs {
+		data, ok := info[z.Member]
+		if !ok {
+			continue
+		}
+		var p aggregator.HotPage
+		err = json.Unmarshal([]byte(data), &p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hot page %v: %v", z.Member, err)
+		}
+		if (wiki != "" && p.Wiki != wiki) || (reason != "" && p.Reason != reason) {
+			continue
+		}
+		out = append(out, p)
+		if len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
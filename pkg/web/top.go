@@ -0,0 +1,88 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultTopLimit is the number of leaderboard entries returned unless a limit is requested
+	defaultTopLimit = 10
+	// maxTopLimit is the largest number of leaderboard entries that can be requested
+	maxTopLimit = 1000
+)
+
+// topHandler serves a leaderboard of a day, selected by the day query parameter and defaulting to the current day
+// The number of entries is set by the limit query parameter.
+func (f *Frontend) topHandler(w http.ResponseWriter, r *http.Request) {
+	b, status := dayFromRequest(r)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	limit := defaultTopLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxTopLimit {
+			logger.Infof("Rejecting invalid limit %s", l)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	entries, err := f.getTop(ctx, b.Prefix()+aggregator.TopPrefix+mux.Vars(r)["dimension"], limit)
+	if err != nil {
+		logger.Errorf("Error retrieving Redis leaderboard: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	finalized, err := f.isFinalized(ctx, b)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized state of %s bucket %d: %v", b.Resolution.Name, b.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, finalized)
+	out, err := json.Marshal(&Leaderboard{
+		Since:     b.Start().Unix(),
+		Finalized: finalized,
+		Entries:   entries,
+	})
+	if err != nil {
+		logger.Errorf("Error marshalling leaderboard respone: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(out))
+}
+
+// getTop returns the limit highest scoring entries of the leaderboard at key
+func (f *Frontend) getTop(ctx context.Context, key string, limit int) ([]Entry, error) {
+	zs, err := f.store.Top(ctx, key, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Entry, len(zs))
+	for i, z := range zs {
+		out[i] = Entry{Name: z.Member, Score: int64(z.Score)}
+	}
+	return out, nil
+}
@@ -3,8 +3,8 @@ package web
 import (
 	"net/http"
 
+	"github.com/gargath/pleiades/pkg/aggregator"
 	"github.com/gargath/pleiades/pkg/util"
-	"github.com/go-redis/redis/v8"
 )
 
 // Frontend is the web frontend server
@@ -12,19 +12,24 @@ type Frontend struct {
 	listenAddr string
 	redis      *util.RedisOpts
 	s          *http.Server
-	r          *redis.Client
+	store      aggregator.CounterStore
 }
 
 // Opts configure the frontend server
 type Opts struct {
 	Redis      *util.RedisOpts
 	ListenAddr string
+	// Store is where counters are read from. If nil, they are read from Redis
+	// The frontend closes it when stopped.
+	Store aggregator.CounterStore
 }
 
 // Counters is the return type for the stats API
+// Finalized is set once the aggregator has seen all events of the bucket, so its counters no longer change
 type Counters struct {
-	Since    int64
-	Counters []Counter
+	Since     int64
+	Finalized bool
+	Counters  []Counter
 }
 
 // Counter is a single redis counter value
@@ -36,3 +41,67 @@ type Counter struct {
 
 // Day is a single day we have stats for
 type Day string
+
+// Bucket is a single time bucket we have stats for, with its start and end as unix timestamps
+type Bucket struct {
+	ID        int64
+	Since     int64
+	Until     int64
+	Finalized bool
+}
+
+// Leaderboard is the return type for the top API, listing the highest ranking entries of a bucket
+type Leaderboard struct {
+	Since     int64
+	Finalized bool
+	Entries   []Entry
+}
+
+// Entry is a single entry of a leaderboard
+type Entry struct {
+	Name  string
+	Score int64
+}
+
+// HotPages is the return type for the hot pages API, listing the pages currently flagged by the aggregator
+type HotPages struct {
+	Pages []aggregator.HotPage
+}
+
+// Anomalies is the return type for the anomalies API, listing the series whose event rates are currently anomalous
+type Anomalies struct {
+	Anomalies []aggregator.Anomaly
+}
+
+// Crosstab is the return type for the cross-tab API, counting events by combinations of dimension values
+// Other counts events whose combination was not tracked because the cross-tab reached its size limit.
+type Crosstab struct {
+	Since      int64
+	Finalized  bool
+	Dimensions []string
+	Rows       []CrosstabRow
+	Other      int64
+}
+
+// CrosstabRow is the count of a single combination of values, in the order of the cross-tab's Dimensions
+type CrosstabRow struct {
+	Values []string
+	Value  int64
+}
+
+// Histogram is the return type for the histogram API, with percentiles estimated from its bins
+type Histogram struct {
+	Since     int64
+	Finalized bool
+	Count     int64
+	Bins      []HistogramBin
+	P50       float64
+	P90       float64
+	P99       float64
+}
+
+// HistogramBin counts the values greater than the previous bin's upper bound and at most the bin's upper bound Le
+type HistogramBin struct {
+	Le    string
+	Count int64
+}
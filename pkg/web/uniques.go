@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gargath/pleiades/pkg/aggregator"
+	"github.com/gargath/pleiades/pkg/bucket"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uniquesHandler serves the unique counts of the current day, or of the range of days given by the from and to query parameters
+func (f *Frontend) uniquesHandler(w http.ResponseWriter, r *http.Request) {
+	days, status := daysFromRequest(r)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	f.serveUniques(w, days)
+}
+
+// uniquesForBucketHandler serves the unique counts of a bucket
+// Week and month buckets without unique counts of their own are counted from the days they span.
+func (f *Frontend) uniquesForBucketHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	res, status := resolutionFromRequest(r, vars["resolution"])
+	if res == nil {
+		w.WriteHeader(status)
+		return
+	}
+	b, err := res.ParseBucket(vars["bucket"])
+	if err != nil {
+		logger.Infof("Rejecting invalid bucket: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if res.Name == bucket.Week.Name || res.Name == bucket.Month.Name {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		names, err := f.getUniqueNames(ctx, []bucket.Bucket{b})
+		if err != nil {
+			logger.Errorf("Error retrieving Redis unique counts: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(names) == 0 {
+			f.serveUniques(w, daysOf(b))
+			return
+		}
+	}
+	f.serveUniques(w, []bucket.Bucket{b})
+}
+
+// daysOf returns the day buckets spanned by a bucket, in the same time zone
+func daysOf(b bucket.Bucket) []bucket.Bucket {
+	day := bucket.Day.In(b.Resolution.Zone)
+	var out []bucket.Bucket
+	for d := day.At(b.Start()); d.Start().Before(b.End()); d = day.Bucket(d.ID + 1) {
+		out = append(out, d)
+	}
+	return out
+}
+
+// serveUniques serves the number of distinct values of each unique counter across all the given buckets
+func (f *Frontend) serveUniques(w http.ResponseWriter, buckets []bucket.Bucket) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") //remove later
+
+	counters, err := f.getUniques(ctx, buckets)
+	if err != nil {
+		logger.Errorf("Error retrieving Redis unique counts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(counters) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	finalized, err := f.allFinalized(ctx, buckets)
+	if err != nil {
+		logger.Errorf("Error retrieving finalized state of %d buckets: %v", len(buckets), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeCounters(w, &Counters{
+		Since:     buckets[0].Start().Unix(),
+		Finalized: finalized,
+		Counters:  counters,
+	})
+}
+
+// getUniqueNames returns the names of the unique counters present in any of the given buckets, sorted
+func (f *Frontend) getUniqueNames(ctx context.Context, buckets []bucket.Bucket) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, b := range buckets {
+		names, err := f.getNames(ctx, b, aggregator.DistinctPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			unique[n] = true
+		}
+	}
+	out := make([]string, 0, len(unique))
+	for n := range unique {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// getUniques estimates the number of distinct values of each unique counter across all the given buckets
+func (f *Frontend) getUniques(ctx context.Context, buckets []bucket.Bucket) ([]Counter, error) {
+	timer := prometheus.NewTimer(counterDuration.WithLabelValues("get_uniques"))
+
+	names, err := f.getUniqueNames(ctx, buckets)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	keys := make([][]string, len(names))
+	for i, n := range names {
+		keys[i] = make([]string, len(buckets))
+		for j, b := range buckets {
+			keys[i][j] = b.Prefix() + n
+		}
+	}
+	counts, err := f.store.Distinct(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Counter, len(names))
+	for i, n := range names {
+		out[i] = Counter{Name: n, Value: counts[i]}
+	}
+	timer.ObserveDuration()
+	return out, nil
+}